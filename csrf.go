@@ -3,23 +3,39 @@
 package csrf
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"github.com/zenazn/goji/web"
 )
 
-// CSRF token length in bytes.
+// Default (and minimum) CSRF token length in bytes.
 const tokenLength = 32
 
+// The method that Token binds tokens to with BindMethod.
+const boundMethod = "POST"
+
+// Default maximum memory used to parse multipart forms, matching net/http.
+const multipartMaxMemory = 32 << 20
+
 // Context/session keys & prefixes
 const (
 	tokenKey    string = "goji.csrf.Token"
 	formKey     string = "goji.csrf.Form"
 	errorKey    string = "goji.csrf.Error"
+	handlerKey  string = "goji.csrf.Handler"
+	realKey     string = "goji.csrf.RealToken"
+	saveKey     string = "goji.csrf.Save"
+	issuedKey   string = "goji.csrf.Issued"
+	nonceKey    string = "goji.csrf.Nonce"
 	cookieName  string = "_goji_csrf"
 	errorPrefix string = "goji/csrf: "
 )
@@ -29,34 +45,79 @@ var (
 	fieldName = tokenKey
 	// The default HTTP request header to inspect
 	headerName = "X-CSRF-Token"
+	// The default name of the <meta> tag generated by MetaTag.
+	metaName = "csrf-token"
 	// Idempotent (safe) methods as defined by RFC7231 section 4.2.2.
 	safeMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE"}
+	// Methods that are not issued a token cookie - see NoIssueOnMethods.
+	noIssueMethods = []string{"HEAD", "OPTIONS"}
 )
 
 // TemplateTag provides a default template tag - e.g. {{ .csrfField }} - for use
 // with the TemplateField function.
 var TemplateTag = "csrfField"
 
+// Failure reasons stored in the request context - see FailureReason. Requests
+// that fail validation have exactly one of these set, and callers can branch on
+// them with errors.Is.
 var (
-	// ErrNoReferer is returned when a HTTPS request provides an empty Referer
-	// header.
+	// ErrNoReferer is returned when a HTTPS request without an Origin header
+	// provides a Referer header that cannot be parsed. Requests that provide
+	// neither header fail with ErrNoOrigin, which wraps ErrNoReferer, so
+	// errors.Is(err, ErrNoReferer) reports both.
 	ErrNoReferer = errors.New("referer not supplied")
 	// ErrBadReferer is returned when the scheme & host in the URL do not match
 	// the supplied Referer header.
 	ErrBadReferer = errors.New("referer invalid")
+	// ErrNoOrigin is returned when a HTTPS request provides neither an Origin
+	// nor a Referer header. It wraps ErrNoReferer.
+	ErrNoOrigin = fmt.Errorf("%w: origin not supplied", ErrNoReferer)
+	// ErrBadOrigin is returned when the scheme & host in the URL do not match
+	// the supplied Origin header, or the Origin is "null" - see
+	// AllowNullOrigin.
+	ErrBadOrigin = errors.New("origin invalid")
+	// ErrNoCookie is returned if the request does not include the CSRF cookie
+	// (or other store reference).
+	ErrNoCookie = errors.New("CSRF cookie not found in request")
 	// ErrNoToken is returned if no CSRF token is supplied in the request.
 	ErrNoToken = errors.New("CSRF token not found in request")
 	// ErrBadToken is returned if the CSRF token in the request does not match
 	// the token in the session, or is otherwise malformed.
 	ErrBadToken = errors.New("CSRF token invalid")
+	// ErrTokenCookieMismatch is returned if a well-formed CSRF token in the
+	// request does not match the token in a valid session cookie - e.g. a token
+	// issued to another user. It wraps ErrBadToken, so errors.Is(err,
+	// ErrBadToken) still reports it.
+	ErrTokenCookieMismatch = fmt.Errorf("%w: token does not match the cookie", ErrBadToken)
+	// ErrDomainMismatch is returned when the configured cookie Domain does not
+	// match the host of a request that requires validation, and browsers would
+	// have discarded the cookie. Safe requests are served as usual.
+	ErrDomainMismatch = errors.New("cookie domain does not match the request host")
+	// ErrMultipleTokens is returned when the StrictMultipleTokens option is set
+	// and the request supplies conflicting tokens in different sources.
+	ErrMultipleTokens = errors.New("multiple conflicting CSRF tokens supplied")
 )
 
+// errNoMiddleware is returned by helpers that require the CSRF middleware when
+// it has not been applied to the request.
+var errNoMiddleware = errors.New(errorPrefix + "middleware not applied to request")
+
 type csrf struct {
 	c    *web.C
 	h    http.Handler
-	sc   *securecookie.SecureCookie
-	st   store
+	sc   []securecookie.Codec
+	st   Store
 	opts options
+	// keyFunc returns the current keys, newest first, in place of the
+	// authKey - see KeyFunc.
+	keyFunc func() ([][]byte, error)
+	// rand is the source of random bytes for tokens and their one-time-pads.
+	rand io.Reader
+	// now returns the current time. It defaults to time.Now.
+	now func() time.Time
+	// r is the current request, set on the per-request copy of the handler
+	// made by ServeHTTP.
+	r *http.Request
 }
 
 // options contains the optional settings for the CSRF middleware.
@@ -66,12 +127,82 @@ type options struct {
 	Path   string
 	// Note that the function and field names match the case of the associated
 	// http.Cookie field instead of the "correct" HTTPOnly name that golint suggests.
-	HttpOnly      bool
-	Secure        bool
-	RequestHeader string
-	FieldName     string
-	ErrorHandler  web.Handler
-	CookieName    string
+	HttpOnly       bool
+	Secure         bool
+	RequestHeaders []string
+	FieldName      string
+	ErrorHandler   web.Handler
+	CookieName     string
+	CookiePrefix   CookieNamePrefix
+	SameSite       SameSiteMode
+	SameSiteFunc   func(r *http.Request) http.SameSite
+	TokenLength    int
+	// TrustedOrigins are stored as normalised scheme://host[:port] strings, with
+	// a "*" label for wildcard origins.
+	TrustedOrigins []string
+	ExemptPaths    []string
+	TrustProxy     bool
+	RefererCheck   bool
+	StrictReferer  bool
+	RotationKeys   [][]byte
+	TokenTTL       time.Duration
+	OnFailure      func(c web.C, r *http.Request, reason error)
+	OnTokenEvent   func(evt TokenEvent)
+	OnNewToken     func(r *http.Request)
+	Partitioned    bool
+	CompressCookie bool
+	CookieWriter   func(w http.ResponseWriter, c *http.Cookie)
+	ResponseHeader string
+	// TokenHeader formats the token header set by TokenHeaderFormat.
+	TokenHeader func(token string) (name, value string)
+	// StrictMultipleTokens rejects requests supplying conflicting tokens.
+	StrictMultipleTokens bool
+	MultipartMaxMemory   int64
+	QueryParam           string
+	// BodyPath is the dot-separated path to the token in a JSON request body.
+	BodyPath  []string
+	Extractor Extractor
+	Mode      TokenMode
+	// RotateOnUse issues a new token after each successful validation.
+	RotateOnUse bool
+	LazyCookie  bool
+	Logger      *slog.Logger
+	// RefreshOnRender re-writes the cookie when safe requests render the token.
+	RefreshOnRender bool
+	// OnConfigWarning is called with each warning from configWarnings.
+	OnConfigWarning func(warning string)
+	// SafeContentTypes are stored as lowercase media types.
+	SafeContentTypes []string
+	TrailerToken     bool
+	FailureStatus    int
+	AuthScheme       string
+	Metrics          Metrics
+	NonceStore       NonceStore
+	PathPrefix       string
+	PathScoped       bool
+	CookieExtractor  func(r *http.Request) (string, error)
+	// LegacyCodec decodes cookies in the format being migrated from.
+	LegacyCodec Codec
+	// ValidateOnly never saves new tokens - see IssueCookie.
+	ValidateOnly bool
+	// Encoding is the encoding of masked tokens; nil for base64.StdEncoding.
+	Encoding           *base64.Encoding
+	SkipAfterPreflight bool
+	Debug              bool
+	DevelopmentMode    bool
+	BindMethod         bool
+	AllowNullOrigin    bool
+	SessionID          func(r *http.Request) string
+	IssueLimiter       TokenIssueLimiter
+	RejectLimited      bool
+	// NoVary omits the Vary: Cookie header - see SetVaryHeader.
+	NoVary bool
+	// InjectField is the JSON field set by InjectTokenInJSON.
+	InjectField string
+	// SafeMethods and NoIssueMethods are stored in upper case.
+	SafeMethods    []string
+	NoIssueMethods []string
+	MetaName       string
 }
 
 // Protect is HTTP middleware that provides Cross-Site Request Forgery
@@ -85,7 +216,13 @@ type options struct {
 // Requests that do not provide a matching token are served with a HTTP 403
 // 'Forbidden' error response.
 //
+// The authKey must be at least 32 bytes long: Protect panics if it is empty or
+// shorter, except for 16 and 24 byte keys, which are accepted for compatibility
+// but not recommended. Generate keys with crypto/rand. Protect also panics if
+// the options are invalid: use New to handle these errors instead.
+//
 // Example:
+//
 //	package main
 //
 //	import (
@@ -95,7 +232,7 @@ type options struct {
 //
 //	func main() {
 //	    // Add the middleware to your router.
-//	    goji.Use(csrf.Protect([]byte("32-byte-long-auth-key")))
+//	    goji.Use(csrf.Protect([]byte("9f86d081884c7d659a2feaa0c55ad015")))
 //	    goji.Get("/signup", GetSignupForm)
 //	    // POST requests without a valid token will return a HTTP 403 Forbidden.
 //	    goji.Post("/signup/post", PostSignupForm)
@@ -114,60 +251,133 @@ type options struct {
 //	    // This is useful if your sending JSON to clients or a front-end JavaScript
 //	    // framework.
 //	}
-//
 func Protect(authKey []byte, opts ...Option) func(*web.C, http.Handler) http.Handler {
-	return func(c *web.C, h http.Handler) http.Handler {
-		cs := parseOptions(h, opts...)
+	m, err := New(authKey, opts...)
+	if err != nil {
+		panic(err.Error())
+	}
 
-		// Set the defaults if no options have been specified
-		if cs.opts.ErrorHandler == nil {
-			cs.opts.ErrorHandler = web.HandlerFunc(unauthorizedHandler)
-		}
+	return m
+}
 
-		if cs.opts.MaxAge < 1 {
-			// Default of 12 hours
-			cs.opts.MaxAge = 3600 * 12
-		}
+// New returns the middleware provided by Protect, or an error if the authKey is
+// invalid - empty, or shorter than 32 bytes other than a 16 or 24 byte key (see
+// Protect) - or any of the options are invalid or conflict, rather than
+// panicking - e.g. for programs that configure the middleware at runtime.
+// Errors from invalid options can be inspected with errors.Is and errors.As.
+func New(authKey []byte, opts ...Option) (func(*web.C, http.Handler) http.Handler, error) {
+	cs, err := parseOptions(nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf(errorPrefix+"%w", err)
+	}
 
-		if cs.opts.FieldName == "" {
-			cs.opts.FieldName = fieldName
+	// Keys from a KeyFunc are checked as they are fetched, and custom codecs
+	// replace the key.
+	if cs.keyFunc == nil && cs.sc == nil {
+		if err := checkKey(authKey); err != nil {
+			return nil, fmt.Errorf(errorPrefix+"%w", err)
 		}
+	}
 
-		if cs.opts.CookieName == "" {
-			cs.opts.CookieName = cookieName
+	// Set the defaults if no options have been specified
+	if cs.opts.ErrorHandler == nil {
+		cs.opts.ErrorHandler = web.HandlerFunc(unauthorizedHandler)
+		if cs.opts.FailureStatus != 0 {
+			cs.opts.ErrorHandler = statusHandler(cs.opts.FailureStatus)
 		}
+	}
 
-		if cs.opts.RequestHeader == "" {
-			cs.opts.RequestHeader = headerName
-		}
+	if cs.opts.MaxAge < 1 {
+		// Default of 12 hours
+		cs.opts.MaxAge = 3600 * 12
+	}
 
-		// Create an authenticated securecookie instance.
-		if cs.sc == nil {
-			cs.sc = securecookie.New(authKey, nil)
-			// Use JSON serialization (faster than one-off gob encoding)
-			cs.sc.SetSerializer(securecookie.JSONEncoder{})
-			// Set the MaxAge of the underlying securecookie.
-			cs.sc.MaxAge(cs.opts.MaxAge)
-		}
+	if cs.opts.FieldName == "" {
+		cs.opts.FieldName = fieldName
+	}
 
-		if cs.st == nil {
-			// Default to the cookieStore
-			cs.st = &cookieStore{
-				name:     cs.opts.CookieName,
-				maxAge:   cs.opts.MaxAge,
-				secure:   cs.opts.Secure,
-				httpOnly: cs.opts.HttpOnly,
-				path:     cs.opts.Path,
-				domain:   cs.opts.Domain,
-				sc:       cs.sc,
-			}
+	if cs.opts.CookieName == "" {
+		cs.opts.CookieName = cookieName
+	}
+
+	if len(cs.opts.RequestHeaders) == 0 {
+		cs.opts.RequestHeaders = []string{headerName}
+	}
+
+	if cs.opts.TokenLength == 0 {
+		cs.opts.TokenLength = tokenLength
+	}
+
+	if cs.opts.MetaName == "" {
+		cs.opts.MetaName = metaName
+	}
+
+	if cs.opts.SafeMethods == nil {
+		cs.opts.SafeMethods = safeMethods
+	}
+
+	if cs.opts.NoIssueMethods == nil {
+		cs.opts.NoIssueMethods = noIssueMethods
+	}
+
+	if cs.opts.MultipartMaxMemory == 0 {
+		cs.opts.MultipartMaxMemory = multipartMaxMemory
+	}
+
+	// Create an authenticated securecookie instance for the current key and
+	// each of the (older) rotation keys.
+	if cs.sc == nil && cs.keyFunc == nil {
+		cs.sc = newCodecs(append([][]byte{authKey}, cs.opts.RotationKeys...))
+	}
+
+	// Keys provided by a KeyFunc are fetched (and cached) by the store.
+	var keys *keyRing
+	if cs.keyFunc != nil {
+		keys = &keyRing{fn: cs.keyFunc, now: cs.now}
+	}
+
+	// Double-submit cookies hold the plain token.
+	sc := cs.sc
+	if cs.opts.Mode == ModeDoubleSubmit {
+		sc = []securecookie.Codec{plainCodec{}}
+		keys = nil
+	}
+
+	if cs.st == nil {
+		// Default to the cookieStore
+		cs.st = &cookieStore{
+			name:        string(cs.opts.CookiePrefix) + cs.opts.CookieName,
+			maxAge:      cs.opts.MaxAge,
+			secure:      cs.opts.Secure,
+			httpOnly:    cs.opts.HttpOnly,
+			path:        cs.opts.Path,
+			domain:      cs.opts.Domain,
+			sameSite:    cs.opts.SameSite,
+			sameSiteFn:  cs.opts.SameSiteFunc,
+			partitioned: cs.opts.Partitioned,
+			compress:    cs.opts.CompressCookie,
+			write:       cs.opts.CookieWriter,
+			dev:         cs.opts.DevelopmentMode && cs.opts.CookiePrefix == "",
+			scoped:      cs.opts.PathScoped,
+			sc:          sc,
+			keys:        keys,
+			legacyCodec: cs.opts.LegacyCodec,
+			extract:     cs.opts.CookieExtractor,
+			ttl:         cs.tokenTTL(),
+			now:         cs.now,
 		}
+	}
 
+	// The configured middleware (and its store) is shared by each handler it
+	// wraps.
+	return func(c *web.C, h http.Handler) http.Handler {
+		handler := *cs
+		handler.h = h
 		// Initialize Goji's request context
-		cs.c = c
+		handler.c = c
 
-		return *cs
-	}
+		return handler
+	}, nil
 }
 
 // Implements http.Handler for the csrf type.
@@ -177,91 +387,381 @@ func (cs csrf) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		cs.c.Env = make(map[interface{}]interface{})
 	}
 
+	// Keep the current request for stores that implement SessionStore.
+	cs.r = r
+
 	// Retrieve the token from the session.
 	// An error represents either a cookie that failed HMAC validation
 	// or that doesn't exist.
-	realToken, err := cs.st.Get(cs.c, r)
-	if err != nil || len(realToken) != tokenLength {
+	realToken, err := cs.st.Get(r)
+	noCookie := errors.Is(err, http.ErrNoCookie)
+	stored := err == nil && len(realToken) == cs.opts.TokenLength
+	// With RefreshOnRender, safe requests only write the cookie if they render the
+	// token.
+	noIssue := !cs.issues(r)
+	onRender := cs.opts.RefreshOnRender && !cs.opts.ValidateOnly && !noIssue && !cs.protects(r)
+	var upgrade bool
+	if stored {
+		// Record when the existing token was issued, if the store knows.
+		if ts, ok := cs.st.(timestampStore); ok {
+			if issued, ok := ts.issued(r); ok {
+				cs.c.Env[issuedKey] = issued
+			}
+		}
+
+		// Upgrade legacy cookies once a state-changing request has validated.
+		if ls, ok := cs.st.(legacyStore); ok {
+			upgrade = !cs.opts.ValidateOnly && cs.protects(r) && ls.legacy(r)
+		}
+
+		// Re-write the existing token's cookie once it is rendered.
+		if onRender {
+			token := realToken
+			cs.c.Env[saveKey] = func() error {
+				return cs.save(token, w)
+			}
+		}
+	} else {
 		// If there was an error retrieving the token, the token doesn't exist
 		// yet, or it's the wrong length, generate a new token.
 		// Note that the new token will (correctly) fail validation downstream
 		// as it will no longer match the request token.
-		realToken, err = generateRandomBytes(tokenLength)
+		realToken, err = readRandomBytes(cs.rand, cs.opts.TokenLength)
 		if err != nil {
-			envError(cs.c, err)
-			cs.opts.ErrorHandler.ServeHTTPC(*cs.c, w, r)
+			cs.fail(w, r, err)
 			return
 		}
+		cs.c.Env[issuedKey] = cs.now()
 
-		// Save the new (real) token in the session store.
-		err = cs.st.Save(realToken, w)
-		if err != nil {
-			envError(cs.c, err)
-			cs.opts.ErrorHandler.ServeHTTPC(*cs.c, w, r)
+		// Clients denied by the issue limiter are not issued a cookie.
+		limited := !cs.opts.ValidateOnly && !noIssue && cs.opts.IssueLimiter != nil &&
+			!cs.opts.IssueLimiter.Allow(r)
+		if limited && cs.opts.RejectLimited {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 			return
 		}
+
+		// Save the new (real) token in the session store, or defer saving it
+		// until the token is first accessed. Validate-only deployments (and
+		// limited clients and NoIssueOnMethods requests) never save tokens.
+		switch {
+		case cs.opts.ValidateOnly, limited, noIssue:
+		case cs.opts.LazyCookie, onRender:
+			token := realToken
+			cs.c.Env[saveKey] = func() error {
+				return cs.save(token, w)
+			}
+			cs.recordIssued(r, noCookie)
+		default:
+			err = cs.save(realToken, w)
+			switch {
+			case errors.Is(err, ErrNoSession) && !cs.protects(r):
+				// Safe requests without a session (e.g. from anonymous
+				// visitors) are served without a saved token.
+			case err != nil:
+				cs.fail(w, r, err)
+				return
+			default:
+				cs.recordIssued(r, noCookie)
+			}
+		}
 	}
 
-	// Save the masked token to the request context
-	cs.c.Env[tokenKey] = mask(realToken, cs.c, r)
+	// Save the real and masked tokens to the request context
+	cs.c.Env[realKey] = realToken
+	cs.c.Env[tokenKey] = cs.mask(cs.bindToken(realToken, r, boundMethod))
 	// Save the field name to the request context
 	cs.c.Env[formKey] = cs.opts.FieldName
+	// Save the middleware to the request context for helpers that need its store
+	// and options.
+	cs.c.Env[handlerKey] = &cs
+
+	// Set the Vary: Cookie header to protect clients from caching the response,
+	// which may include the cookie or token.
+	if !cs.opts.NoVary {
+		addVary(w.Header(), "Cookie")
+	}
+
+	// Expose the token to clients that read it from a response header. This is
+	// set before the wrapped handler can write (and flush) the response.
+	if cs.opts.ResponseHeader != "" || cs.opts.TokenHeader != nil {
+		cs.setTokenHeaders(w, Token(*cs.c, r))
+	}
 
 	// HTTP methods not defined as idempotent ("safe") under RFC7231 require
-	// inspection.
-	if !contains(safeMethods, r.Method) {
-		// Enforce an origin check for HTTPS connections. As per the Django CSRF
-		// implementation (https://goo.gl/vKA7GE) the Referer header is almost
-		// always present for same-domain HTTP requests.
-		if r.URL.Scheme == "https" {
-			// Fetch the Referer value. Call the error handler if it's empty or
-			// otherwise fails to parse.
-			referer, err := url.Parse(r.Referer())
-			if err != nil || referer.String() == "" {
-				envError(cs.c, ErrNoReferer)
-				cs.opts.ErrorHandler.ServeHTTPC(*cs.c, w, r)
+	// inspection, unless the path has been exempted or the request flagged by
+	// UnsafeSkipCheck.
+	if cs.protects(r) {
+		if err := cs.verify(r, realToken, noCookie, stored); err != nil {
+			cs.fail(w, r, err)
+			return
+		}
+
+		if err := cs.consume(realToken); err != nil {
+			cs.fail(w, r, err)
+			return
+		}
+		cs.opts.Metrics.IncValidated()
+		cs.event(TokenValidated, r, nil)
+
+		// Issue a new token now that the current one has been used, or re-save a
+		// legacy cookie in the current format.
+		if cs.opts.RotateOnUse || cs.opts.NonceStore != nil {
+			if _, err := cs.rotate(w); err != nil {
+				cs.fail(w, r, err)
 				return
 			}
-
-			if sameOrigin(r.URL, referer) == false {
-				envError(cs.c, ErrBadReferer)
-				cs.opts.ErrorHandler.ServeHTTPC(*cs.c, w, r)
+		} else if upgrade {
+			if err := cs.save(realToken, w); err != nil {
+				cs.fail(w, r, err)
 				return
 			}
 		}
+	}
 
-		// If the token returned from the session store is nil for non-idempotent
-		// ("unsafe") methods, call the error handler.
-		if realToken == nil {
-			envError(cs.c, ErrNoToken)
-			cs.opts.ErrorHandler.ServeHTTPC(*cs.c, w, r)
-			return
+	// Insert the token into JSON object responses once the handler returns.
+	// Responses to HEAD requests have no body to insert it into.
+	if cs.opts.InjectField != "" && r.Method != "HEAD" {
+		ji := &jsonInjector{ResponseWriter: w}
+		cs.h.ServeHTTP(ji, r)
+		ji.finish(cs.opts.InjectField, Token(*cs.c, r))
+		return
+	}
+
+	// Call the wrapped handler/router on success
+	cs.h.ServeHTTP(w, r)
+}
+
+// tokenTTL returns how long tokens are valid for: as long as the cookie, unless
+// a TTL is set.
+func (cs *csrf) tokenTTL() time.Duration {
+	if cs.opts.TokenTTL > 0 {
+		return cs.opts.TokenTTL.Truncate(time.Second)
+	}
+
+	return time.Duration(cs.opts.MaxAge) * time.Second
+}
+
+// verify validates the origin and token of the request against the real token,
+// returning the failure reason (or nil). noCookie reports whether the request did
+// not include a token cookie, and stored whether realToken was read from a valid
+// cookie (or session) rather than newly generated.
+func (cs *csrf) verify(r *http.Request, realToken []byte, noCookie, stored bool) error {
+	// Browsers discard cookies for a Domain that does not match the host,
+	// leaving the request to fail validation: report the cause instead.
+	if host := cs.requestURL(r).Hostname(); cs.opts.Domain != "" && host != "" &&
+		!domainMatches(cs.opts.Domain, host) {
+		return fmt.Errorf("%w: domain %q, host %q", ErrDomainMismatch, cs.opts.Domain, host)
+	}
+
+	// Enforce an origin check for HTTPS connections. As per the Django CSRF
+	// implementation (https://goo.gl/vKA7GE) the Referer header is almost
+	// always present for same-domain HTTP requests.
+	if cs.opts.RefererCheck && !cs.preflighted(r) && !(cs.opts.DevelopmentMode && isLoopbackRequest(r)) {
+		// Browsers send an opaque ("null") Origin from sandboxed frames and
+		// privacy-sensitive contexts, over HTTP and HTTPS alike.
+		if u := cs.requestURL(r); r.Header.Get("Origin") == "null" {
+			if !cs.opts.AllowNullOrigin {
+				return ErrBadOrigin
+			}
+		} else if u.Scheme == "https" {
+			if err := cs.checkOrigin(r, u); err != nil {
+				return err
+			}
 		}
+	}
 
-		// Retrieve the combined token (pad + masked) token and unmask it.
-		requestToken := unmask(cs.requestToken(r))
+	// Requests with a safe content type only need to validate a token if they
+	// supply one.
+	relaxed := cs.isSafeContentType(r)
 
-		// Compare the request token against the real token
-		if !compareTokens(requestToken, realToken) {
-			envError(cs.c, ErrBadToken)
-			cs.opts.ErrorHandler.ServeHTTPC(*cs.c, w, r)
-			return
+	// If the request did not include a token cookie for non-idempotent
+	// ("unsafe") methods, call the error handler.
+	if noCookie && !relaxed {
+		return ErrNoCookie
+	}
+
+	// Retrieve the combined token (pad + masked) token and unmask it. A custom
+	// extractor replaces the built-in sources entirely.
+	var issued string
+	if cs.opts.Extractor != nil {
+		// Parse multipart bodies with the configured limit before extractors
+		// such as FromForm read them.
+		cs.parseMultipartForm(r)
+
+		var err error
+		if issued, err = cs.opts.Extractor(r); err != nil {
+			return err
+		}
+	} else {
+		// Reject conflicting tokens as tampering in strict mode.
+		if cs.opts.StrictMultipleTokens && len(cs.issuedTokens(r)) > 1 {
+			return ErrMultipleTokens
 		}
 
+		issued = cs.requestToken(r)
 	}
 
-	// Set the Vary: Cookie header to protect clients from caching the response.
-	w.Header().Add("Vary", "Cookie")
+	if issued == "" {
+		if relaxed {
+			return nil
+		}
+		return ErrNoToken
+	}
 
-	// Call the wrapped handler/router on success
-	cs.h.ServeHTTP(w, r)
+	if noCookie {
+		return ErrNoCookie
+	}
+	// Malformed tokens (invalid base64 or the wrong length) fail outright.
+	requestToken := unmaskToken(cs.encoding(), issued, cs.opts.TokenLength)
+	if requestToken == nil {
+		return ErrBadToken
+	}
+
+	// Compare the request token against the real token. This must remain a
+	// constant-time comparison.
+	if !compareTokens(requestToken, cs.bindToken(realToken, r, r.Method)) {
+		// A valid cookie paired with another (well-formed) token suggests the two
+		// were issued to different clients.
+		if stored {
+			return ErrTokenCookieMismatch
+		}
+		return ErrBadToken
+	}
+
+	return nil
+}
+
+// recordIssued records that a new token was issued for the request r, calling
+// the OnNewToken hook if the request had no token (fresh) rather than an invalid
+// one.
+func (cs *csrf) recordIssued(r *http.Request, fresh bool) {
+	cs.opts.Metrics.IncIssued()
+	cs.event(TokenIssued, r, nil)
+
+	if fresh && cs.opts.OnNewToken != nil {
+		cs.opts.OnNewToken(r)
+	}
+}
+
+// fail records the CSRF failure reason in the request context, calls the
+// OnFailure hook (if set) and then the error handler.
+func (cs *csrf) fail(w http.ResponseWriter, r *http.Request, reason error) {
+	envError(cs.c, reason)
+	cs.opts.Metrics.IncFailed(failureLabel(reason))
+	cs.event(TokenFailed, r, reason)
+
+	// Never log the token values themselves.
+	if cs.opts.Logger != nil {
+		cs.opts.Logger.LogAttrs(r.Context(), slog.LevelWarn, "CSRF validation failed",
+			slog.String("reason", reason.Error()),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("remote", r.RemoteAddr),
+		)
+	}
+
+	if cs.opts.OnFailure != nil {
+		cs.opts.OnFailure(*cs.c, r, reason)
+	}
+
+	cs.opts.ErrorHandler.ServeHTTPC(*cs.c, w, r)
+}
+
+// save saves the real token to the store, passing the current request to stores
+// that implement SessionStore.
+func (cs *csrf) save(realToken []byte, w http.ResponseWriter) error {
+	if ss, ok := cs.st.(SessionStore); ok {
+		return ss.SaveSession(cs.r, realToken, w)
+	}
+
+	return cs.st.Save(realToken, w)
+}
+
+// checkOrigin checks that the request originates from the same origin as the
+// (effective) request URL u, or a trusted origin. The Origin header is checked
+// first, as it survives referrer policies that strip the Referer, falling back
+// to the Referer header if no Origin is supplied.
+func (cs *csrf) checkOrigin(r *http.Request, u *url.URL) error {
+	if o := r.Header.Get("Origin"); o != "" {
+		origin, err := url.Parse(o)
+		if err != nil || (!sameOrigin(u, origin) && !cs.isTrustedOrigin(origin)) {
+			return ErrBadOrigin
+		}
+
+		return nil
+	}
+
+	if r.Referer() == "" {
+		return ErrNoOrigin
+	}
+
+	// Fetch the Referer value and check that it parses.
+	referer, err := url.Parse(r.Referer())
+	if err != nil {
+		return ErrNoReferer
+	}
+
+	if cs.isTrustedOrigin(referer) {
+		return nil
+	}
+
+	// Report which component of a mismatched Referer differs in strict mode.
+	if cs.opts.StrictReferer {
+		if mismatch := originMismatch(u, referer); mismatch != "" {
+			return fmt.Errorf("%w: %s", ErrBadReferer, mismatch)
+		}
+
+		return nil
+	}
+
+	if !sameOrigin(u, referer) {
+		return ErrBadReferer
+	}
+
+	return nil
 }
 
 // unauthorizedhandler sets a HTTP 403 Forbidden status and writes the
 // CSRF failure reason to the response.
 func unauthorizedHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-	http.Error(w, fmt.Sprintf("%s - %s",
-		http.StatusText(http.StatusForbidden), FailureReason(c, r)),
-		http.StatusForbidden)
-	return
+	statusHandler(http.StatusForbidden)(c, w, r)
+}
+
+// statusHandler returns the default error handler with the given status: it sets
+// the status and writes the CSRF failure reason to the response.
+func statusHandler(status int) web.HandlerFunc {
+	return func(c web.C, w http.ResponseWriter, r *http.Request) {
+		http.Error(w, fmt.Sprintf("%s - %s",
+			http.StatusText(status), FailureReason(c, r)),
+			status)
+	}
+}
+
+// JSONErrorHandler returns an error handler that serves a HTTP 403 Forbidden
+// status and a JSON body describing the CSRF failure reason, for clients that
+// expect JSON responses - e.g.
+//
+//	{"error":"CSRF token invalid","code":403}
+//
+// Use it with the ErrorHandler option: csrf.ErrorHandler(csrf.JSONErrorHandler())
+func JSONErrorHandler() web.Handler {
+	return web.HandlerFunc(jsonErrorHandler)
+}
+
+// jsonErrorHandler writes the CSRF failure reason (as per FailureReason) to the
+// response as a JSON object.
+func jsonErrorHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	reason := http.StatusText(http.StatusForbidden)
+	if err := FailureReason(c, r); err != nil {
+		reason = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+	}{reason, http.StatusForbidden})
 }
@@ -1,10 +1,17 @@
 package csrf
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/zenazn/goji/web"
 )
@@ -62,8 +69,9 @@ func TestMethods(t *testing.T) {
 				rr.Code, http.StatusOK)
 		}
 
-		if rr.Header().Get("Set-Cookie") == "" {
-			t.Fatalf("cookie not set: got %q", rr.Header().Get("Set-Cookie"))
+		// HEAD and OPTIONS requests are not issued a cookie by default.
+		if issued := rr.Header().Get("Set-Cookie") != ""; issued == contains(noIssueMethods, method) {
+			t.Fatalf("%s: cookie issued: got %v want %v", method, issued, !issued)
 		}
 	}
 
@@ -90,6 +98,41 @@ func TestMethods(t *testing.T) {
 
 }
 
+// TestSafeMethods tests that a GET configured as unsafe requires a token and a
+// POST configured as safe does not.
+func TestSafeMethods(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, SafeMethods("head", "OPTIONS", "post")))
+
+	s.Handle("/", testHandler)
+
+	var methodTests = []struct {
+		method   string
+		expected int
+	}{
+		{"GET", http.StatusForbidden},
+		{"PUT", http.StatusForbidden},
+		{"POST", http.StatusOK},
+		{"HEAD", http.StatusOK},
+		{"OPTIONS", http.StatusOK},
+	}
+
+	for _, mt := range methodTests {
+		r, err := http.NewRequest(mt.method, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != mt.expected {
+			t.Fatalf("%s: middleware returned the wrong status: got %v want %v",
+				mt.method, rr.Code, mt.expected)
+		}
+	}
+}
+
 // Tests for failure if the cookie containing the session is removed from the
 // request.
 func TestNoCookie(t *testing.T) {
@@ -163,6 +206,49 @@ func TestVaryHeader(t *testing.T) {
 	}
 }
 
+// TestVaryHeaderMerge tests that Cookie is merged into an existing Vary header
+// without duplicates, and omitted if disabled.
+func TestVaryHeaderMerge(t *testing.T) {
+	var varyTests = []struct {
+		existing []string
+		opts     []Option
+		expected []string
+	}{
+		{[]string{"Accept-Encoding"}, nil, []string{"Accept-Encoding", "Cookie"}},
+		{[]string{"Accept-Encoding, cookie"}, nil, []string{"Accept-Encoding, cookie"}},
+		{[]string{"*"}, nil, []string{"*"}},
+		{nil, []Option{SetVaryHeader(false)}, nil},
+		{[]string{"Accept-Encoding"}, []Option{SetVaryHeader(false)}, []string{"Accept-Encoding"}},
+	}
+
+	for _, vt := range varyTests {
+		s := web.New()
+		// An outer middleware - e.g. compression - sets its own Vary values.
+		s.Use(func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for _, v := range vt.existing {
+					w.Header().Add("Vary", v)
+				}
+				h.ServeHTTP(w, r)
+			})
+		})
+		s.Use(Protect(testKey, vt.opts...))
+		s.Get("/", testHandler)
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if vary := rr.Header().Values("Vary"); !reflect.DeepEqual(vary, vt.expected) {
+			t.Fatalf("vary header not merged: got %q want %q", vary, vt.expected)
+		}
+	}
+}
+
 // Requests with no Referer header should fail.
 func TestNoReferer(t *testing.T) {
 
@@ -184,6 +270,49 @@ func TestNoReferer(t *testing.T) {
 	}
 }
 
+// TestRefererCheck checks that a HTTPS request with a valid token and no Referer
+// succeeds only when the Referer check is disabled.
+func TestRefererCheck(t *testing.T) {
+	for _, check := range []bool{true, false} {
+		s := web.New()
+		s.Use(Protect(testKey, RefererCheck(check)))
+
+		var token string
+		s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			token = Token(c, r)
+		}))
+
+		r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		r, err = http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		expected := http.StatusOK
+		if check {
+			expected = http.StatusForbidden
+		}
+
+		if rr.Code != expected {
+			t.Fatalf("RefererCheck(%v): middleware returned the wrong status: got %v want %v",
+				check, rr.Code, expected)
+		}
+	}
+}
+
 // TestBadReferer checks that HTTPS requests with a Referer that does not
 // match the request URL correctly fail CSRF validation.
 func TestBadReferer(t *testing.T) {
@@ -227,6 +356,123 @@ func TestBadReferer(t *testing.T) {
 	}
 }
 
+// TestNullOrigin checks that requests with an opaque "null" Origin are rejected
+// over HTTP and HTTPS, unless AllowNullOrigin is set.
+func TestNullOrigin(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		var reason error
+		s := web.New()
+		s.Use(Protect(testKey, AllowNullOrigin(allow),
+			ErrorHandler(web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+				reason = FailureReason(c, r)
+				w.WriteHeader(http.StatusForbidden)
+			}))))
+
+		var token string
+		s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			token = Token(c, r)
+		}))
+
+		for _, scheme := range []string{"http", "https"} {
+			u := scheme + "://www.gorillatoolkit.org/"
+			r, err := http.NewRequest("GET", u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, r)
+
+			r, err = http.NewRequest("POST", u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			setCookie(rr, r)
+			r.Header.Set("X-CSRF-Token", token)
+			r.Header.Set("Origin", "null")
+
+			reason = nil
+			rr = httptest.NewRecorder()
+			s.ServeHTTP(rr, r)
+
+			if allow && rr.Code != http.StatusOK {
+				t.Fatalf("%s: null Origin rejected with AllowNullOrigin: got %v want %v (%v)",
+					scheme, rr.Code, http.StatusOK, reason)
+			}
+
+			if !allow && reason != ErrBadOrigin {
+				t.Fatalf("%s: null Origin failure reason incorrect: got %v want %v",
+					scheme, reason, ErrBadOrigin)
+			}
+		}
+	}
+}
+
+// TestStrictReferer checks that the scheme, host and port of the Referer are
+// each compared with the request URL in strict mode.
+func TestStrictReferer(t *testing.T) {
+	var testTable = []struct {
+		referer  string
+		mismatch string
+	}{
+		{"https://www.gorillatoolkit.org/", ""},
+		{"https://WWW.gorillatoolkit.org:443/form", ""},
+		{"http://www.gorillatoolkit.org/", "scheme"},
+		{"https://www.gorillatoolkit.org:8443/", "port"},
+		{"https://gorillatoolkit.org/", "host"},
+	}
+
+	var reason error
+	s := web.New()
+	s.Use(Protect(testKey, StrictReferer(true),
+		ErrorHandler(web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(c, r)
+			w.WriteHeader(http.StatusForbidden)
+		}))))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	for _, v := range testTable {
+		reason = nil
+		r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		r, err = http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		r.Header.Set("Referer", v.referer)
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if v.mismatch == "" {
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s: middleware rejected a matching Referer: got %v want %v (%v)",
+					v.referer, rr.Code, http.StatusOK, reason)
+			}
+			continue
+		}
+
+		if !errors.Is(reason, ErrBadReferer) || !strings.Contains(reason.Error(), v.mismatch) {
+			t.Fatalf("%s: bad failure reason: got %v want %v naming the %s",
+				v.referer, reason, ErrBadReferer, v.mismatch)
+		}
+	}
+}
+
 // Requests with a valid Referer should pass.
 func TestWithReferer(t *testing.T) {
 	s := web.New()
@@ -266,12 +512,1499 @@ func TestWithReferer(t *testing.T) {
 	}
 }
 
-// TestFormField tests that a token in the form field takes precedence over a
-// token in the HTTP header.
-func TestFormField(t *testing.T) {
+// TestOrigin checks the combinations of Origin and Referer headers on HTTPS
+// requests, and the failure reason reported for each.
+func TestOrigin(t *testing.T) {
+	s := web.New()
+	var reason error
+	s.Use(Protect(testKey, ErrorHandler(web.HandlerFunc(
+		func(c web.C, w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(c, r)
+			unauthorizedHandler(c, w, r)
+		}))))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	// Obtain a CSRF cookie via a GET request.
+	r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var originTests = []struct {
+		origin   string
+		referer  string
+		expected error
+	}{
+		{"https://www.gorillatoolkit.org", "", nil},
+		{"https://www.gorillatoolkit.org", "https://goji.io/", nil},
+		{"", "https://www.gorillatoolkit.org/", nil},
+		{"https://goji.io", "", ErrBadOrigin},
+		{"https://goji.io", "https://www.gorillatoolkit.org/", ErrBadOrigin},
+		{"null", "", ErrBadOrigin},
+		{"", "https://goji.io/", ErrBadReferer},
+		{"", "", ErrNoOrigin},
+	}
+
+	for _, ot := range originTests {
+		r, err := http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		if ot.origin != "" {
+			r.Header.Set("Origin", ot.origin)
+		}
+		if ot.referer != "" {
+			r.Header.Set("Referer", ot.referer)
+		}
+
+		reason = nil
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if reason != ot.expected {
+			t.Fatalf("Origin %q, Referer %q: got %v want %v",
+				ot.origin, ot.referer, reason, ot.expected)
+		}
 
+		if ot.expected == nil && resp.Code != http.StatusOK {
+			t.Fatalf("Origin %q, Referer %q: got %v want %v",
+				ot.origin, ot.referer, resp.Code, http.StatusOK)
+		}
+	}
 }
 
-func setCookie(rr *httptest.ResponseRecorder, r *http.Request) {
-	r.Header.Set("Cookie", rr.Header().Get("Set-Cookie"))
+// TestTrustProxyHeaders checks that X-Forwarded-Proto is only used to enforce
+// the origin check on proxied HTTPS requests when explicitly trusted.
+func TestTrustProxyHeaders(t *testing.T) {
+	var proxyTests = []struct {
+		trust    bool
+		referer  string
+		expected int
+	}{
+		{false, "", http.StatusOK},
+		{true, "https://www.gorillatoolkit.org/", http.StatusOK},
+		{true, "", http.StatusForbidden},
+		{true, "http://www.gorillatoolkit.org/", http.StatusForbidden},
+	}
+
+	for _, pt := range proxyTests {
+		s := web.New()
+		s.Use(Protect(testKey, TrustProxyHeaders(pt.trust)))
+
+		var token string
+		s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			token = Token(c, r)
+		}))
+
+		// Requests received via a proxy have no scheme or TLS state.
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Host = "www.gorillatoolkit.org"
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Host = "www.gorillatoolkit.org"
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		if pt.referer != "" {
+			r.Header.Set("Referer", pt.referer)
+		}
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != pt.expected {
+			t.Fatalf("trust %v, Referer %q: got %v want %v",
+				pt.trust, pt.referer, rr.Code, pt.expected)
+		}
+	}
+}
+
+// TestTrustedOrigins checks that HTTPS requests from a trusted origin pass the
+// origin check, and that untrusted look-alike origins do not.
+func TestTrustedOrigins(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, TrustedOrigins([]string{"https://app.gorillatoolkit.org"})))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	// Obtain a CSRF cookie via a GET request.
+	r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var originTests = []struct {
+		header   string
+		value    string
+		token    string
+		expected int
+	}{
+		{"Referer", "https://app.gorillatoolkit.org/signup", token, http.StatusOK},
+		{"Origin", "https://app.gorillatoolkit.org", token, http.StatusOK},
+		{"Origin", "https://app.gorillatoolkit.org", "", http.StatusForbidden},
+		{"Referer", "http://app.gorillatoolkit.org/", token, http.StatusForbidden},
+		{"Referer", "https://app.gorillatoolkit.org:8443/", token, http.StatusForbidden},
+		{"Referer", "https://evil-app.gorillatoolkit.org/", token, http.StatusForbidden},
+		{"Origin", "https://app.gorillatoolkit.org.evil.com", token, http.StatusForbidden},
+	}
+
+	for _, ot := range originTests {
+		r, err := http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", ot.token)
+		r.Header.Set(ot.header, ot.value)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != ot.expected {
+			t.Fatalf("%s %q: got %v want %v", ot.header, ot.value, resp.Code, ot.expected)
+		}
+	}
+}
+
+// TestTrustedWildcardOrigins tests that wildcard trusted origins match single
+// label subdomains only.
+func TestTrustedWildcardOrigins(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, TrustedOrigins([]string{"*.example.com", "https://*.goji.io:8443"})))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var originTests = []struct {
+		origin   string
+		expected int
+	}{
+		{"https://a.example.com", http.StatusOK},
+		{"https://A-1.Example.com", http.StatusOK},
+		{"https://example.com", http.StatusForbidden},
+		{"https://evil-example.com", http.StatusForbidden},
+		{"https://a.evil-example.com", http.StatusForbidden},
+		{"https://a.b.example.com", http.StatusForbidden},
+		{"https://.example.com", http.StatusForbidden},
+		{"https://a.example.com.evil.com", http.StatusForbidden},
+		{"https://a.example.com:8443", http.StatusForbidden},
+		{"http://a.example.com", http.StatusForbidden},
+		{"https://a.goji.io:8443", http.StatusOK},
+		{"https://a.goji.io", http.StatusForbidden},
+	}
+
+	for _, ot := range originTests {
+		r, err := http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		r.Header.Set("Origin", ot.origin)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != ot.expected {
+			t.Fatalf("Origin %q: got %v want %v", ot.origin, resp.Code, ot.expected)
+		}
+	}
+}
+
+// TestExemptPath checks that requests to exempt paths skip validation, and that
+// request paths are cleaned before matching.
+func TestExemptPath(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, ExemptPath("/webhook", "/hooks/*")))
+	s.Handle("/*", testHandler)
+
+	var exemptTests = []struct {
+		path     string
+		expected int
+	}{
+		{"/webhook", http.StatusOK},
+		{"/webhook/", http.StatusOK},
+		{"/webhook/extra", http.StatusForbidden},
+		{"/hooks/github", http.StatusOK},
+		{"/hooks/github/push", http.StatusOK},
+		{"/hooks", http.StatusForbidden},
+		{"/hooks/../admin", http.StatusForbidden},
+		{"/admin", http.StatusForbidden},
+	}
+
+	for _, et := range exemptTests {
+		r, err := http.NewRequest("POST", "http://www.gorillatoolkit.org"+et.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != et.expected {
+			t.Fatalf("POST %s: got %v want %v", et.path, rr.Code, et.expected)
+		}
+
+		if rr.Header().Get("Set-Cookie") == "" {
+			t.Fatalf("cookie not set for %s: got %q", et.path, rr.Header().Get("Set-Cookie"))
+		}
+	}
+}
+
+// TestRequestHeaders checks that a token supplied in any of the configured
+// request headers validates, and that other headers are ignored.
+func TestRequestHeaders(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, RequestHeaders("X-CSRF-Token", "X-XSRF-Token")))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var headerTests = []struct {
+		header   string
+		expected int
+	}{
+		{"X-CSRF-Token", http.StatusOK},
+		{"X-XSRF-Token", http.StatusOK},
+		{"X-Unknown-Token", http.StatusForbidden},
+	}
+
+	for _, ht := range headerTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set(ht.header, token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != ht.expected {
+			t.Fatalf("token in %s: got %v want %v", ht.header, resp.Code, ht.expected)
+		}
+	}
+}
+
+// TestJSONErrorHandler checks that the JSON error handler serves the failure
+// reason as a JSON object.
+func TestJSONErrorHandler(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, ErrorHandler(JSONErrorHandler())))
+	s.Handle("/", testHandler)
+
+	r, err := http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("middleware failed to reject the request: got %v want %v",
+			rr.Code, http.StatusForbidden)
+	}
+
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("content type not set: got %q want %q", ct, "application/json")
+	}
+
+	var body struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Error != ErrNoCookie.Error() || body.Code != http.StatusForbidden {
+		t.Fatalf("JSON error not set correctly: got %+v want %q/%v",
+			body, ErrNoCookie, http.StatusForbidden)
+	}
+}
+
+// TestTokenTTL checks that a token past its TTL fails validation on a POST but
+// is silently refreshed on a GET, while the cookie keeps its MaxAge.
+func TestTokenTTL(t *testing.T) {
+	clock := time.Now()
+	s := web.New()
+	s.Use(Protect(testKey, TokenTTL(time.Second), setClock(func() time.Time { return clock })))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if c := rr.Header().Get("Set-Cookie"); !strings.Contains(c, "Max-Age=43200") {
+		t.Fatalf("cookie MaxAge changed by TokenTTL: got %q", c)
+	}
+
+	// Advance past the TTL: securecookie timestamps have a resolution of one
+	// second.
+	clock = clock.Add(2100 * time.Millisecond)
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, r)
+
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("expired token passed validation: got %v want %v",
+			resp.Code, http.StatusForbidden)
+	}
+
+	r, err = http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, r)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expired token not refreshed: got %v want %v", resp.Code, http.StatusOK)
+	}
+
+	if c := resp.Header().Get("Set-Cookie"); c == "" {
+		t.Fatal("expired token not refreshed: no cookie set")
+	}
+}
+
+// TestDevelopmentMode checks that loopback requests get an insecure cookie and
+// skip the origin check in development mode, while other requests do not.
+func TestDevelopmentMode(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, DevelopmentMode(true)))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	var devTests = []struct {
+		name      string
+		host      string
+		remote    string
+		forwarded bool
+		dev       bool
+	}{
+		{"localhost", "localhost:8080", "127.0.0.1:5000", false, true},
+		{"loopback IPv6", "[::1]:8080", "[::1]:5000", false, true},
+		{"public host", "www.gorillatoolkit.org", "127.0.0.1:5000", false, false},
+		{"public client", "localhost:8080", "192.0.2.1:5000", false, false},
+		{"forwarded", "localhost:8080", "127.0.0.1:5000", true, false},
+	}
+
+	for _, dt := range devTests {
+		r := httptest.NewRequest("GET", "https://"+dt.host+"/", nil)
+		r.RemoteAddr = dt.remote
+		if dt.forwarded {
+			r.Header.Set("X-Forwarded-For", "192.0.2.1")
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Secure == dt.dev {
+			t.Fatalf("%s: cookie Secure incorrect: got %v want %v", dt.name, cookies, !dt.dev)
+		}
+
+		// POST the token back without an Origin or Referer.
+		r = httptest.NewRequest("POST", "https://"+dt.host+"/", nil)
+		r.RemoteAddr = dt.remote
+		if dt.forwarded {
+			r.Header.Set("X-Forwarded-For", "192.0.2.1")
+		}
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		expected := http.StatusForbidden
+		if dt.dev {
+			expected = http.StatusOK
+		}
+
+		if rr.Code != expected {
+			t.Fatalf("%s: origin check incorrect: got %v want %v", dt.name, rr.Code, expected)
+		}
+	}
+}
+
+// TestOnNewToken checks that the OnNewToken hook is only called for requests
+// without a token cookie.
+func TestOnNewToken(t *testing.T) {
+	var calls int
+	s := web.New()
+	s.Use(Protect(testKey, OnNewToken(func(r *http.Request) {
+		calls++
+	})))
+	s.Handle("/", testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if calls != 1 {
+		t.Fatalf("OnNewToken not called for a new visitor: got %d calls want 1", calls)
+	}
+
+	// Neither a valid nor an invalid cookie is a new visitor.
+	for _, cookie := range []string{rr.Header().Get("Set-Cookie"), cookieName + "=invalid"} {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Cookie", cookie)
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		if calls != 1 {
+			t.Fatalf("OnNewToken called for a request with a cookie (%s): got %d calls want 1",
+				cookie, calls)
+		}
+	}
+}
+
+// TestOnFailure checks that the OnFailure hook is called with the failure
+// reason for each class of failure, and that the request is still rejected.
+func TestOnFailure(t *testing.T) {
+	s := web.New()
+	var reasons []error
+	s.Use(Protect(testKey, OnFailure(func(c web.C, r *http.Request, reason error) {
+		reasons = append(reasons, reason)
+	})))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if len(reasons) != 0 {
+		t.Fatalf("OnFailure called for a valid request: got %v", reasons)
+	}
+
+	var failureTests = []struct {
+		referer  string
+		token    string
+		expected error
+	}{
+		{"", token, ErrNoOrigin},
+		{"https://goji.io/", token, ErrBadReferer},
+		{"https://www.gorillatoolkit.org/", "", ErrNoToken},
+		{"https://www.gorillatoolkit.org/", "bm90LWEtdG9rZW4=", ErrBadToken},
+	}
+
+	for _, ft := range failureTests {
+		r, err := http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", ft.token)
+		if ft.referer != "" {
+			r.Header.Set("Referer", ft.referer)
+		}
+
+		reasons = nil
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if len(reasons) != 1 || reasons[0] != ft.expected {
+			t.Fatalf("OnFailure reason incorrect: got %v want %v", reasons, ft.expected)
+		}
+
+		if resp.Code != http.StatusForbidden {
+			t.Fatalf("request not rejected: got %v want %v", resp.Code, http.StatusForbidden)
+		}
+	}
+}
+
+// TestResponseHeader checks that the token is written to the configured
+// response header and matches the token returned by Token.
+func TestResponseHeader(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, ResponseHeader("X-CSRF-Token")))
+
+	var token string
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+		// Flush the response before the handler returns.
+		w.Write([]byte("hello"))
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if h := rr.Header().Get("X-CSRF-Token"); h == "" || h != token {
+		t.Fatalf("response header not set: got %q want %q", h, token)
+	}
+}
+
+// TestTokenHeaderFormat checks that a custom formatter controls the name and
+// value of the token response header, and that invalid names are not written.
+func TestTokenHeaderFormat(t *testing.T) {
+	var formatTests = []struct {
+		name    string
+		written bool
+	}{
+		{"X-Edge-Token", true},
+		{"Bad Header", false},
+	}
+
+	for _, v := range formatTests {
+		s := web.New()
+		s.Use(Protect(testKey, TokenHeaderFormat(func(token string) (string, string) {
+			return v.name, "csrf=" + token
+		})))
+
+		var token string
+		s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			token = Token(c, r)
+		}))
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		want := ""
+		if v.written {
+			want = "csrf=" + token
+		}
+
+		if h := rr.Header().Get(v.name); h != want {
+			t.Fatalf("token header %q: got %q want %q", v.name, h, want)
+		}
+	}
+}
+
+// TestPathScoped tests that tokens issued in one section of the application are
+// only valid in that section, including when the section's cookie is replayed
+// under the name of another.
+func TestPathScoped(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, PathScoped(true)))
+
+	var token string
+	s.Handle("/*", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/shop/cart", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("cookie not set: got %d cookies want 1", len(cookies))
+	}
+
+	if c := cookies[0]; c.Name != cookieName+".shop" || c.Path != "/shop" {
+		t.Fatalf("bad cookie scope: got %s (path %q) want %s.shop (path %q)",
+			c.Name, c.Path, cookieName, "/shop")
+	}
+
+	var scopeTests = []struct {
+		path     string
+		name     string
+		expected int
+	}{
+		{"/shop/checkout", cookieName + ".shop", http.StatusOK},
+		{"/shop", cookieName + ".shop", http.StatusOK},
+		{"/admin/users", cookieName + ".shop", http.StatusForbidden},
+		// The shop cookie, renamed for the admin section.
+		{"/admin/users", cookieName + ".admin", http.StatusForbidden},
+		{"/", cookieName, http.StatusForbidden},
+	}
+
+	for _, v := range scopeTests {
+		r, err := http.NewRequest("POST", v.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.AddCookie(&http.Cookie{Name: v.name, Value: cookies[0].Value})
+		r.Header.Set("X-CSRF-Token", token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != v.expected {
+			t.Fatalf("%s token sent to %s as %s: got %v want %v",
+				"/shop", v.path, v.name, resp.Code, v.expected)
+		}
+	}
+}
+
+// TestNoIssueOnMethods tests that safe requests with the configured methods are
+// not issued a cookie, even when they render the token, and that validation is
+// unchanged.
+func TestNoIssueOnMethods(t *testing.T) {
+	var issueTests = []struct {
+		opts   []Option
+		method string
+		issued bool
+	}{
+		{nil, "OPTIONS", false},
+		{nil, "HEAD", false},
+		{nil, "GET", true},
+		{[]Option{LazyCookie(true)}, "OPTIONS", false},
+		{[]Option{NoIssueOnMethods("get")}, "GET", false},
+		{[]Option{NoIssueOnMethods("get")}, "OPTIONS", true},
+		{[]Option{NoIssueOnMethods()}, "HEAD", true},
+		// Validated requests are unaffected.
+		{[]Option{NoIssueOnMethods("POST")}, "POST", true},
+	}
+
+	for _, v := range issueTests {
+		s := web.New()
+		s.Use(Protect(testKey, v.opts...))
+		s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			Token(c, r)
+		}))
+
+		r, err := http.NewRequest(v.method, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if issued := rr.Header().Get("Set-Cookie") != ""; issued != v.issued {
+			t.Fatalf("%s with %d options: cookie issued: got %v want %v",
+				v.method, len(v.opts), issued, v.issued)
+		}
+	}
+
+	// HEAD requests are issued a cookie once HEAD is not configured, which
+	// validates as usual.
+	s := web.New()
+	s.Use(Protect(testKey, NoIssueOnMethods("GET", "OPTIONS")))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("HEAD", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, r)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("token from a HEAD request rejected: got %v want %v", resp.Code, http.StatusOK)
+	}
+}
+
+// TestStrictMultipleTokens checks that conflicting tokens in the header and
+// form field are only rejected in strict mode.
+func TestStrictMultipleTokens(t *testing.T) {
+	var reason error
+	s := web.New()
+	s.Use(Protect(testKey, StrictMultipleTokens(true), OnFailure(
+		func(c web.C, r *http.Request, err error) {
+			reason = err
+		})))
+
+	var tokens []string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, Token(c, r))
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	// Collect a second (differently masked) token for the same cookie.
+	r, err = http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	var strictTests = []struct {
+		header   string
+		field    string
+		expected error
+	}{
+		{tokens[0], "", nil},
+		{"", tokens[0], nil},
+		{tokens[0], tokens[0], nil},
+		{tokens[0], tokens[1], ErrMultipleTokens},
+	}
+
+	for _, st := range strictTests {
+		form := url.Values{}
+		if st.field != "" {
+			form.Set(fieldName, st.field)
+		}
+
+		r, err := http.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if st.header != "" {
+			r.Header.Set("X-CSRF-Token", st.header)
+		}
+
+		reason = nil
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if reason != st.expected {
+			t.Fatalf("header %t, field %t: got %v want %v",
+				st.header != "", st.field != "", reason, st.expected)
+		}
+	}
+}
+
+// TestFailureReasons checks that each failure path sets the matching sentinel
+// error as the failure reason.
+func TestFailureReasons(t *testing.T) {
+	var reason error
+	s := web.New()
+	s.Use(Protect(testKey, ErrorHandler(web.HandlerFunc(
+		func(c web.C, w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(c, r)
+		}))))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var reasonTests = []struct {
+		cookie   bool
+		referer  string
+		token    string
+		expected error
+	}{
+		{true, "", token, ErrNoOrigin},
+		// ErrNoOrigin wraps ErrNoReferer.
+		{true, "", token, ErrNoReferer},
+		{true, "%zz", token, ErrNoReferer},
+		{true, "https://goji.io/", token, ErrBadReferer},
+		{false, "https://www.gorillatoolkit.org/", token, ErrNoCookie},
+		{true, "https://www.gorillatoolkit.org/", "", ErrNoToken},
+		{true, "https://www.gorillatoolkit.org/", "not-base64!", ErrBadToken},
+	}
+
+	for _, rt := range reasonTests {
+		r, err := http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rt.cookie {
+			setCookie(rr, r)
+		}
+		r.Header.Set("X-CSRF-Token", rt.token)
+		if rt.referer != "" {
+			r.Header.Set("Referer", rt.referer)
+		}
+
+		reason = nil
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		if !errors.Is(reason, rt.expected) {
+			t.Fatalf("failure reason incorrect: got %v want %v", reason, rt.expected)
+		}
+	}
+}
+
+// TestFormField tests that a token in the form field takes precedence over a
+// token in the HTTP header.
+func TestFormField(t *testing.T) {
+
+}
+
+func setCookie(rr *httptest.ResponseRecorder, r *http.Request) {
+	r.Header.Set("Cookie", rr.Header().Get("Set-Cookie"))
+}
+
+// TestLazyCookie tests that the cookie is only issued once the token is
+// accessed.
+func TestLazyCookie(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, LazyCookie(true)))
+
+	var token string
+	s.Get("/api", testHandler)
+	s.Get("/form", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+		// Subsequent accesses issue the cookie once only.
+		TemplateField(c, r)
+	}))
+	s.Post("/form", testHandler)
+
+	r, err := http.NewRequest("GET", "/api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if c := rr.Header().Get("Set-Cookie"); c != "" {
+		t.Fatalf("cookie set without the token being accessed: got %q", c)
+	}
+
+	r, err = http.NewRequest("GET", "/form", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if n := len(rr.Header()["Set-Cookie"]); n != 1 {
+		t.Fatalf("cookie not issued when the token was accessed: got %d cookies want %d", n, 1)
+	}
+
+	r, err = http.NewRequest("POST", "/form", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("lazily issued token failed validation: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+}
+
+// TestRefreshOnRender tests that safe requests only write the cookie - for new
+// and existing tokens - when they render the token.
+func TestRefreshOnRender(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, RefreshOnRender(true)))
+
+	s.Get("/api", testHandler)
+	s.Get("/form", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		TemplateField(c, r)
+	}))
+
+	var cookie string
+	var renderTests = []struct {
+		path     string
+		rendered bool
+	}{
+		{"/api", false},
+		{"/form", true},
+		// The existing token's cookie is only re-written when rendered.
+		{"/api", false},
+		{"/form", true},
+	}
+
+	for i, rt := range renderTests {
+		r, err := http.NewRequest("GET", rt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		c := rr.Header().Get("Set-Cookie")
+		if rt.rendered != (c != "") {
+			t.Fatalf("request %d (%s): cookie set %v: want %v", i, rt.path, c != "", rt.rendered)
+		}
+
+		if c != "" {
+			cookie = c
+		}
+	}
+}
+
+// captureHandler is a slog.Handler that records log records.
+type captureHandler struct {
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *captureHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.records = append(h.records, r)
+	return nil
+}
+
+// TestLogger tests that failures are logged at WARN with the request attributes,
+// and that the token is never logged.
+func TestLogger(t *testing.T) {
+	h := &captureHandler{}
+	s := web.New()
+	s.Use(Protect(testKey, Logger(slog.New(h))))
+
+	var token string
+	s.Handle("/*", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if len(h.records) != 0 {
+		t.Fatalf("valid request logged: got %d records", len(h.records))
+	}
+
+	r, err = http.NewRequest("POST", "/forms/signup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-CSRF-Token", token[:len(token)-4]+"AAA=")
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(h.records) != 1 {
+		t.Fatalf("failure not logged: got %d records want %d", len(h.records), 1)
+	}
+
+	record := h.records[0]
+	if record.Level != slog.LevelWarn {
+		t.Fatalf("failure logged at the wrong level: got %v want %v", record.Level, slog.LevelWarn)
+	}
+
+	attrs := make(map[string]string)
+	record.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.String()
+		if strings.Contains(a.Value.String(), token[:16]) {
+			t.Fatalf("token logged in attribute %q", a.Key)
+		}
+		return true
+	})
+
+	expected := map[string]string{
+		"reason": ErrBadToken.Error(),
+		"method": "POST",
+		"path":   "/forms/signup",
+		"remote": "192.0.2.1:1234",
+	}
+	if !reflect.DeepEqual(attrs, expected) {
+		t.Fatalf("log attributes incorrect: got %v want %v", attrs, expected)
+	}
+}
+
+// TestTokenCookieMismatch tests that swapping the cookie and token between two
+// issued pairs fails with ErrTokenCookieMismatch, while a token without a valid
+// cookie fails with ErrBadToken.
+func TestTokenCookieMismatch(t *testing.T) {
+	var reason error
+	s := web.New()
+	s.Use(Protect(testKey, ErrorHandler(web.HandlerFunc(
+		func(c web.C, w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(c, r)
+		}))))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	// Issue a cookie and token to each of two clients.
+	var cookies, tokens [2]string
+	for i := range cookies {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+		cookies[i], tokens[i] = rr.Header().Get("Set-Cookie"), token
+	}
+
+	var mismatchTests = []struct {
+		cookie   string
+		token    string
+		expected error
+	}{
+		{cookies[0], tokens[0], nil},
+		{cookies[0], tokens[1], ErrTokenCookieMismatch},
+		{cookies[1], tokens[0], ErrTokenCookieMismatch},
+		{cookieName + "=invalid", tokens[0], ErrBadToken},
+	}
+
+	for _, mt := range mismatchTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Cookie", mt.cookie)
+		r.Header.Set("X-CSRF-Token", mt.token)
+
+		reason = nil
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		if reason != mt.expected {
+			t.Fatalf("failure reason incorrect: got %v want %v", reason, mt.expected)
+		}
+	}
+
+	if !errors.Is(ErrTokenCookieMismatch, ErrBadToken) {
+		t.Fatal("ErrTokenCookieMismatch does not wrap ErrBadToken")
+	}
+}
+
+// TestDomainMismatch tests that unsafe requests to a host the cookie domain does
+// not match fail with ErrDomainMismatch, and that safe requests are still
+// served.
+func TestDomainMismatch(t *testing.T) {
+	var reason error
+	s := web.New()
+	s.Use(Protect(testKey, Domain("goji.io"), ErrorHandler(web.HandlerFunc(
+		func(c web.C, w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(c, r)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))))
+	s.Handle("/", testHandler)
+
+	var domainTests = []struct {
+		method   string
+		url      string
+		expected error
+	}{
+		{"GET", "https://goji.io/", nil},
+		{"GET", "https://WWW.Goji.io:8443/", nil},
+		{"GET", "https://other.com/", nil},
+		{"HEAD", "https://notgoji.io/", nil},
+		{"POST", "https://other.com/", ErrDomainMismatch},
+		{"POST", "https://notgoji.io/", ErrDomainMismatch},
+	}
+
+	for _, dt := range domainTests {
+		r, err := http.NewRequest(dt.method, dt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reason = nil
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if !errors.Is(reason, dt.expected) || (dt.expected == nil && reason != nil) {
+			t.Fatalf("%s %s: failure reason incorrect: got %v want %v", dt.method, dt.url, reason, dt.expected)
+		}
+
+		if dt.expected == nil && rr.Code != http.StatusOK {
+			t.Fatalf("%s %s: request not served: got %v want %v", dt.method, dt.url, rr.Code, http.StatusOK)
+		}
+
+		if dt.method == "GET" && rr.Header().Get("Set-Cookie") == "" {
+			t.Fatalf("%s %s: cookie not set", dt.method, dt.url)
+		}
+	}
+}
+
+// TestSafeContentTypes tests that requests with a safe content type do not
+// require a token, but that supplied tokens must still validate.
+func TestSafeContentTypes(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, SafeContentTypes("application/json")))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var contentTypeTests = []struct {
+		contentType string
+		cookie      bool
+		token       string
+		expected    int
+	}{
+		{"application/json", false, "", http.StatusOK},
+		{"application/json; charset=utf-8", true, "", http.StatusOK},
+		{"application/json", true, token, http.StatusOK},
+		{"application/json", true, "bad", http.StatusForbidden},
+		{"application/json", false, token, http.StatusForbidden},
+		{"application/x-www-form-urlencoded", true, "", http.StatusForbidden},
+		{"application/x-www-form-urlencoded", true, token, http.StatusOK},
+		{"", true, "", http.StatusForbidden},
+	}
+
+	for _, ct := range contentTypeTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ct.cookie {
+			setCookie(rr, r)
+		}
+		r.Header.Set("Content-Type", ct.contentType)
+		r.Header.Set("X-CSRF-Token", ct.token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != ct.expected {
+			t.Fatalf("%q (cookie %v, token %q): middleware returned the wrong status: got %v want %v",
+				ct.contentType, ct.cookie, ct.token, resp.Code, ct.expected)
+		}
+	}
+}
+
+// TestFailureStatus tests that the default error handler serves the configured
+// status on token failure.
+func TestFailureStatus(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, FailureStatus(http.StatusUnprocessableEntity)))
+	s.Post("/", testHandler)
+
+	r, err := http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("configured failure status not served: got %v want %v",
+			rr.Code, http.StatusUnprocessableEntity)
+	}
+
+	if !strings.HasPrefix(rr.Body.String(), http.StatusText(http.StatusUnprocessableEntity)) {
+		t.Fatalf("failure body incorrect: got %q", rr.Body.String())
+	}
+}
+
+// TestIssueCookieDisabled tests that a validate-only middleware validates tokens
+// issued elsewhere, but never sets a cookie.
+func TestIssueCookieDisabled(t *testing.T) {
+	// The frontend issues the token and cookie.
+	frontend := web.New()
+	frontend.Use(Protect(testKey))
+
+	var token string
+	frontend.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	frontend.ServeHTTP(rr, r)
+
+	api := web.New()
+	api.Use(Protect(testKey, IssueCookie(false)))
+	api.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		Token(c, r)
+	}))
+
+	var issueTests = []struct {
+		method   string
+		cookie   bool
+		token    string
+		expected int
+	}{
+		{"GET", false, "", http.StatusOK},
+		{"POST", true, token, http.StatusOK},
+		{"POST", true, "", http.StatusForbidden},
+		{"POST", false, token, http.StatusForbidden},
+	}
+
+	for _, it := range issueTests {
+		r, err := http.NewRequest(it.method, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if it.cookie {
+			setCookie(rr, r)
+		}
+		r.Header.Set("X-CSRF-Token", it.token)
+
+		resp := httptest.NewRecorder()
+		api.ServeHTTP(resp, r)
+
+		if resp.Code != it.expected {
+			t.Fatalf("%s (cookie %v): middleware returned the wrong status: got %v want %v",
+				it.method, it.cookie, resp.Code, it.expected)
+		}
+
+		if c := resp.Header().Get("Set-Cookie"); c != "" {
+			t.Fatalf("%s (cookie %v): validate-only middleware set a cookie: got %q",
+				it.method, it.cookie, c)
+		}
+	}
+}
+
+// TestNew tests that New returns an error for each invalid key or option, and
+// that Protect panics with the same error.
+func TestNew(t *testing.T) {
+	var newTests = []struct {
+		name string
+		key  []byte
+		opts []Option
+	}{
+		{"nil key", nil, nil},
+		{"short key", []byte("short"), nil},
+		{"invalid option", testKey, []Option{TokenLength(8)}},
+		{"SameSite=None without Secure", testKey,
+			[]Option{SameSite(SameSiteNoneMode), Secure(false)}},
+		{"host prefix with domain", testKey,
+			[]Option{CookiePrefix(HostPrefix), Domain("example.com")}},
+		{"rotate without issuing", testKey,
+			[]Option{RotateOnUse(true), IssueCookie(false)}},
+	}
+
+	for _, nt := range newTests {
+		m, err := New(nt.key, nt.opts...)
+		if err == nil || m != nil {
+			t.Fatalf("%s: New did not return an error", nt.name)
+		}
+
+		if !strings.HasPrefix(err.Error(), errorPrefix) {
+			t.Fatalf("%s: error not prefixed: got %q", nt.name, err)
+		}
+
+		func() {
+			defer func() {
+				if r := recover(); r != err.Error() {
+					t.Fatalf("%s: Protect panicked with the wrong error: got %v want %v",
+						nt.name, r, err)
+				}
+			}()
+
+			Protect(nt.key, nt.opts...)
+		}()
+	}
+
+	m, err := New(testKey, MaxAge(60))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := web.New()
+	s.Use(m)
+	s.Handle("/", testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Set-Cookie") == "" {
+		t.Fatalf("middleware from New did not issue a cookie: got %v %q",
+			rr.Code, rr.Header().Get("Set-Cookie"))
+	}
+}
+
+// TestSkipAfterPreflight tests that the origin check is skipped for requests
+// supplying the token in a request header, which still require a valid token.
+func TestSkipAfterPreflight(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, SkipAfterPreflight(true),
+		TrustedOrigins([]string{"https://app.example.com"})))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "https://api.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var preflightTests = []struct {
+		name     string
+		header   string
+		form     string
+		expected int
+	}{
+		{"token header", token, "", http.StatusOK},
+		{"bad token header", "bad-token", "", http.StatusForbidden},
+		// Form submissions don't require a preflight, and are checked.
+		{"form token", "", token, http.StatusForbidden},
+	}
+
+	for _, pt := range preflightTests {
+		form := url.Values{}
+		if pt.form != "" {
+			form.Set(fieldName, pt.form)
+		}
+
+		r, err := http.NewRequest("POST", "https://api.example.com/", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "https://other.example.org")
+		if pt.header != "" {
+			r.Header.Set("X-CSRF-Token", pt.header)
+		}
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != pt.expected {
+			t.Fatalf("%s: middleware returned the wrong status: got %v want %v",
+				pt.name, resp.Code, pt.expected)
+		}
+	}
 }
@@ -0,0 +1,107 @@
+// Package csrfgrpc provides a gRPC unary server interceptor that validates CSRF
+// tokens issued by the goji/csrf middleware - e.g. for browser clients calling
+// gRPC methods through a HTTP gateway.
+//
+// The interceptor reads the token from the incoming request metadata
+// (x-csrf-token by default, or the header set by csrf.RequestHeader) and the
+// CSRF cookie from the "cookie" metadata entry, and validates them as the HTTP
+// middleware does. Calls are validated as POST requests to the full method
+// name, for the host in the :authority metadata entry. The Origin and Referer
+// check runs for calls over TLS, or - with csrf.TrustProxyHeaders - for calls
+// with an x-forwarded-proto entry of "https" (e.g. set by a gateway).
+package csrfgrpc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/goji/csrf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type resultKey struct{}
+
+// result records the outcome of validating a single call.
+type result struct {
+	ok  bool
+	err error
+}
+
+// UnaryServerInterceptor returns a gRPC unary server interceptor that rejects
+// calls without a valid CSRF token with codes.PermissionDenied. The authKey and
+// options are the same as those passed to csrf.Protect, and must match the
+// middleware that issued the token. Options that only affect the response (such
+// as the cookie attributes) have no effect, and csrf.ExemptPath matches against
+// the full method name - e.g. "/pkg.Service/Method".
+func UnaryServerInterceptor(authKey []byte, opts ...csrf.Option) grpc.UnaryServerInterceptor {
+	opts = append(opts, csrf.HTTPErrorHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			res := r.Context().Value(resultKey{}).(*result)
+			res.err = csrf.RequestFailureReason(r)
+		})))
+
+	validate := csrf.ProtectHTTP(authKey, opts...)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			res := r.Context().Value(resultKey{}).(*result)
+			res.ok = true
+		}))
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		res := &result{}
+		r, err := http.NewRequestWithContext(context.WithValue(ctx, resultKey{}, res),
+			"POST", info.FullMethod, nil)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		if authority := md.Get(":authority"); len(authority) > 0 {
+			r.Host = authority[0]
+		}
+
+		// Give the request a scheme for the origin check.
+		if p, ok := peer.FromContext(ctx); ok {
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+				r.TLS = &info.State
+			}
+		}
+
+		for key, vals := range md {
+			// Binary metadata can't be represented as a HTTP header, and
+			// pseudo-headers have been applied to the request above.
+			if strings.HasSuffix(key, "-bin") || strings.HasPrefix(key, ":") {
+				continue
+			}
+
+			for _, v := range vals {
+				r.Header.Add(key, v)
+			}
+		}
+
+		validate.ServeHTTP(discardWriter{}, r)
+		if !res.ok {
+			if res.err == nil {
+				res.err = csrf.ErrBadToken
+			}
+
+			return nil, status.Error(codes.PermissionDenied, res.err.Error())
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// discardWriter is a http.ResponseWriter that discards the response (e.g. a
+// newly issued cookie) written by the middleware.
+type discardWriter struct{}
+
+func (discardWriter) Header() http.Header         { return http.Header{} }
+func (discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardWriter) WriteHeader(int)             {}
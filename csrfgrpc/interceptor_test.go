@@ -0,0 +1,136 @@
+package csrfgrpc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goji/csrf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var testKey = []byte("keep-it-secret-keep-it-safe-----")
+
+var testInfo = &grpc.UnaryServerInfo{FullMethod: "/test.Service/Update"}
+
+// issueToken returns a CSRF cookie and token issued by the HTTP middleware.
+func issueToken(t *testing.T, opts ...csrf.Option) (cookie, token string) {
+	h := csrf.ProtectHTTP(testKey, opts...)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			token = csrf.RequestToken(r)
+		}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	return rr.Header().Get("Set-Cookie"), token
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	cookie, token := issueToken(t)
+	_, otherToken := issueToken(t)
+
+	var interceptorTests = []struct {
+		name string
+		md   metadata.MD
+		code codes.Code
+	}{
+		{"valid", metadata.Pairs("cookie", cookie, "x-csrf-token", token), codes.OK},
+		{"no metadata", nil, codes.PermissionDenied},
+		{"no cookie", metadata.Pairs("x-csrf-token", token), codes.PermissionDenied},
+		{"no token", metadata.Pairs("cookie", cookie), codes.PermissionDenied},
+		{"bad token", metadata.Pairs("cookie", cookie, "x-csrf-token", otherToken), codes.PermissionDenied},
+	}
+
+	interceptor := UnaryServerInterceptor(testKey)
+	for _, it := range interceptorTests {
+		ctx := context.Background()
+		if it.md != nil {
+			ctx = metadata.NewIncomingContext(ctx, it.md)
+		}
+
+		var called bool
+		_, err := interceptor(ctx, nil, testInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+			called = true
+			return nil, nil
+		})
+
+		if code := status.Code(err); code != it.code {
+			t.Fatalf("%s: code incorrect: got %v want %v", it.name, code, it.code)
+		}
+
+		if called != (it.code == codes.OK) {
+			t.Fatalf("%s: handler called incorrectly: got %v want %v", it.name, called, it.code == codes.OK)
+		}
+	}
+}
+
+// TestUnaryServerInterceptorHeader tests that the token is read from the
+// metadata key matching a custom request header.
+func TestUnaryServerInterceptorHeader(t *testing.T) {
+	cookie, token := issueToken(t)
+	interceptor := UnaryServerInterceptor(testKey, csrf.RequestHeader("Authenticity-Token"))
+
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs("cookie", cookie, "authenticity-token", token))
+	_, err := interceptor(ctx, nil, testInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+
+	if err != nil {
+		t.Fatalf("valid token rejected: got %v want %v", err, nil)
+	}
+}
+
+// TestUnaryServerInterceptorOrigin tests that the Origin is checked against the
+// :authority for calls over TLS, and for calls forwarded from HTTPS.
+func TestUnaryServerInterceptorOrigin(t *testing.T) {
+	cookie, token := issueToken(t)
+	tlsPeer := &peer.Peer{AuthInfo: credentials.TLSInfo{}}
+
+	var originTests = []struct {
+		name   string
+		peer   *peer.Peer
+		origin string
+		proto  string
+		code   codes.Code
+	}{
+		{"tls same origin", tlsPeer, "https://example.com", "", codes.OK},
+		{"tls cross origin", tlsPeer, "https://evil.example", "", codes.PermissionDenied},
+		{"forwarded cross origin", nil, "https://evil.example", "https", codes.PermissionDenied},
+		{"plaintext", nil, "https://evil.example", "", codes.OK},
+	}
+
+	interceptor := UnaryServerInterceptor(testKey, csrf.TrustProxyHeaders(true))
+	for _, ot := range originTests {
+		md := metadata.Pairs(":authority", "example.com", "cookie", cookie,
+			"x-csrf-token", token, "origin", ot.origin)
+		if ot.proto != "" {
+			md.Set("x-forwarded-proto", ot.proto)
+		}
+
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		if ot.peer != nil {
+			ctx = peer.NewContext(ctx, ot.peer)
+		}
+
+		_, err := interceptor(ctx, nil, testInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+
+		if code := status.Code(err); code != ot.code {
+			t.Fatalf("%s: code incorrect: got %v (%v) want %v", ot.name, code, err, ot.code)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Package csrftest provides utilities for testing handlers protected by the
+// csrf middleware, without issuing a token through a server first.
+package csrftest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goji/csrf"
+	"github.com/zenazn/goji/web"
+)
+
+// NewRequest returns a POST request to "/" that passes CSRF validation by the
+// middleware returned by csrf.Protect(authKey, opts...), along with the masked
+// token it carries. The request includes the token cookie, and the token in the
+// request header (see csrf.RequestHeader):
+//
+//	r, token := csrftest.NewRequest(t, authKey)
+//	rr := httptest.NewRecorder()
+//	csrf.Protect(authKey)(&c, handler).ServeHTTP(rr, r)
+//
+// The request's method, URL and body can be changed before use. Tests fail
+// immediately if the options are invalid or no token was issued.
+func NewRequest(t testing.TB, authKey []byte, opts ...csrf.Option) (*http.Request, string) {
+	t.Helper()
+
+	m, err := csrf.New(authKey, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var token, header string
+	s := web.New()
+	s.Use(m)
+	s.Handle("/*", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = csrf.Token(c, r)
+		header = csrf.HeaderName(c)
+	}))
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if token == "" {
+		t.Fatal("csrftest: no token was issued for the test request")
+	}
+
+	r := httptest.NewRequest("POST", "/", nil)
+	for _, cookie := range rr.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	r.Header.Set(header, token)
+
+	return r, token
+}
@@ -0,0 +1,64 @@
+package csrftest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goji/csrf"
+	"github.com/zenazn/goji/web"
+)
+
+var testKey = []byte("keep-it-secret-keep-it-safe-----")
+
+// TestNewRequest checks that the test request passes validation by a middleware
+// with the same options, and carries the token the handler sees.
+func TestNewRequest(t *testing.T) {
+	var testTable = []struct {
+		name string
+		opts []csrf.Option
+	}{
+		{"default", nil},
+		{"custom names", []csrf.Option{csrf.RequestHeader("X-Custom-Token"), csrf.CookieName("custom")}},
+	}
+
+	for _, v := range testTable {
+		r, token := NewRequest(t, testKey, v.opts...)
+
+		var got string
+		s := web.New()
+		s.Use(csrf.Protect(testKey, v.opts...))
+		s.Post("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			got = csrf.Token(c, r)
+		}))
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: test request failed validation: got %v want %v", v.name, rr.Code, http.StatusOK)
+		}
+
+		if got == "" || token == "" {
+			t.Fatalf("%s: no token: got %q (returned %q)", v.name, got, token)
+		}
+	}
+}
+
+// TestNewRequestKey checks that the test request fails validation by a
+// middleware with a different key.
+func TestNewRequestKey(t *testing.T) {
+	r, _ := NewRequest(t, testKey)
+
+	s := web.New()
+	s.Use(csrf.Protect([]byte("a-different-key-that-is-32-bytes")))
+	s.Post("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {}))
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("test request passed validation with another key: got %v want %v",
+			rr.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,40 @@
+package csrftest_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goji/csrf"
+	"github.com/goji/csrf/csrftest"
+	"github.com/zenazn/goji/web"
+)
+
+// exampleTB stands in for the *testing.T of a test in the example below.
+type exampleTB struct {
+	testing.TB
+}
+
+func (exampleTB) Helper()                   {}
+func (exampleTB) Fatal(args ...interface{}) { panic(fmt.Sprint(args...)) }
+
+var t testing.TB = exampleTB{}
+
+func ExampleNewRequest() {
+	authKey := []byte("9f86d081884c7d659a2feaa0c55ad015")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	})
+
+	r, _ := csrftest.NewRequest(t, authKey)
+	r.Method = "PUT"
+	r.URL.Path = "/items/1"
+
+	c := web.C{Env: map[interface{}]interface{}{}}
+	rr := httptest.NewRecorder()
+	csrf.Protect(authKey)(&c, handler).ServeHTTP(rr, r)
+
+	fmt.Println(rr.Code, rr.Body.String())
+	// Output: 200 PUT /items/1
+}
@@ -0,0 +1,102 @@
+package csrf
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+// debugInfo is the token state and configuration served by DebugHandler. It
+// must never include the authentication keys or the real token.
+type debugInfo struct {
+	Token          string   `json:"token"`
+	TokenAge       string   `json:"token_age,omitempty"`
+	CookieName     string   `json:"cookie_name"`
+	CookiePresent  bool     `json:"cookie_present"`
+	Validation     string   `json:"validation"`
+	FieldName      string   `json:"field_name"`
+	RequestHeaders []string `json:"request_headers"`
+	SafeMethods    []string `json:"safe_methods"`
+	Mode           string   `json:"mode"`
+	MaxAge         int      `json:"max_age"`
+	TokenTTL       string   `json:"token_ttl"`
+	Secure         bool     `json:"secure"`
+	HttpOnly       bool     `json:"http_only"`
+	SameSite       string   `json:"same_site"`
+	Path           string   `json:"path,omitempty"`
+	Domain         string   `json:"domain,omitempty"`
+	RefererCheck   bool     `json:"referer_check"`
+	TrustedOrigins []string `json:"trusted_origins,omitempty"`
+	ExemptPaths    []string `json:"exempt_paths,omitempty"`
+}
+
+// sameSiteNames are the attribute values of each SameSiteMode.
+var sameSiteNames = map[SameSiteMode]string{
+	SameSiteDefaultMode: "Default",
+	SameSiteLaxMode:     "Lax",
+	SameSiteStrictMode:  "Strict",
+	SameSiteNoneMode:    "None",
+}
+
+// DebugHandler serves the CSRF state of the request as JSON - the masked token
+// and its age, whether the request includes the cookie and would pass
+// validation, and the middleware's configuration - to help debug failing forms
+// during development. The authentication keys and the real token are never
+// included.
+//
+// The handler is inert unless the Debug option is set: it serves a 404 Not
+// Found otherwise, or if the middleware has not been applied. Route it on
+// development builds only.
+func DebugHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	cs, ok := c.Env[handlerKey].(*csrf)
+	if !ok || !cs.opts.Debug {
+		http.NotFound(w, r)
+		return
+	}
+
+	info := debugInfo{
+		Token:          Token(c, r),
+		CookieName:     string(cs.opts.CookiePrefix) + cs.opts.CookieName,
+		Validation:     "ok",
+		FieldName:      cs.opts.FieldName,
+		RequestHeaders: cs.opts.RequestHeaders,
+		SafeMethods:    cs.opts.SafeMethods,
+		Mode:           "synchronizer",
+		MaxAge:         cs.opts.MaxAge,
+		TokenTTL:       cs.tokenTTL().String(),
+		Secure:         cs.opts.Secure,
+		HttpOnly:       cs.opts.HttpOnly,
+		SameSite:       sameSiteNames[cs.opts.SameSite],
+		Path:           cs.opts.Path,
+		Domain:         cs.opts.Domain,
+		RefererCheck:   cs.opts.RefererCheck,
+		TrustedOrigins: cs.opts.TrustedOrigins,
+		ExemptPaths:    cs.opts.ExemptPaths,
+	}
+
+	if age, ok := TokenAge(c); ok {
+		info.TokenAge = age.String()
+	}
+
+	// The default store reads a path scoped (or extracted) cookie.
+	if st, ok := cs.st.(*cookieStore); ok {
+		info.CookieName, _ = st.scope(r)
+		_, err := st.value(r)
+		info.CookiePresent = err == nil
+	} else if _, err := r.Cookie(info.CookieName); err == nil {
+		info.CookiePresent = true
+	}
+
+	if err := ValidateRequest(c, r); err != nil {
+		info.Validation = err.Error()
+	}
+
+	if cs.opts.Mode == ModeDoubleSubmit {
+		info.Mode = "double-submit"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,140 @@
+package csrf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+// TestDebugHandler tests that DebugHandler is inert unless the Debug option is
+// set, and never exposes the real token or key.
+func TestDebugHandler(t *testing.T) {
+	var debugTests = []struct {
+		opts     []Option
+		expected int
+	}{
+		{nil, http.StatusNotFound},
+		{[]Option{Debug(false)}, http.StatusNotFound},
+		{[]Option{Debug(true)}, http.StatusOK},
+	}
+
+	for _, dt := range debugTests {
+		s := web.New()
+		s.Use(Protect(testKey, dt.opts...))
+
+		var realToken []byte
+		s.Get("/debug", func(c web.C, w http.ResponseWriter, r *http.Request) {
+			realToken, _ = RealToken(c)
+			DebugHandler(c, w, r)
+		})
+
+		r, err := http.NewRequest("GET", "/debug", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != dt.expected {
+			t.Fatalf("DebugHandler returned the wrong status: got %v want %v",
+				rr.Code, dt.expected)
+		}
+
+		if dt.expected != http.StatusOK {
+			if strings.Contains(rr.Body.String(), "cookie_name") {
+				t.Fatalf("inert DebugHandler served the CSRF state: got %q", rr.Body.String())
+			}
+			continue
+		}
+
+		var info map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+			t.Fatalf("DebugHandler did not serve valid JSON: %v", err)
+		}
+
+		if info["cookie_name"] != cookieName || info["token"] == "" {
+			t.Fatalf("DebugHandler served the wrong state: got %v", info)
+		}
+
+		for _, secret := range []string{string(testKey), string(realToken)} {
+			if strings.Contains(rr.Body.String(), secret) {
+				t.Fatalf("DebugHandler exposed a secret: got %q", rr.Body.String())
+			}
+		}
+	}
+
+	// Without the middleware.
+	rr := httptest.NewRecorder()
+	DebugHandler(web.C{}, rr, httptest.NewRequest("GET", "/debug", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("DebugHandler without the middleware: got %v want %v",
+			rr.Code, http.StatusNotFound)
+	}
+}
+
+// TestDebugHandlerCookie tests that the cookie is reported as present when it is
+// path scoped or read by a CookieExtractor.
+func TestDebugHandlerCookie(t *testing.T) {
+	fromHeader := CookieExtractor(func(r *http.Request) (string, error) {
+		return r.Header.Get("X-CSRF-Cookie"), nil
+	})
+
+	var cookieTests = []struct {
+		name   string
+		opts   []Option
+		path   string
+		header bool
+		cookie string
+	}{
+		{"default", nil, "/debug", false, cookieName},
+		{"path scoped", []Option{PathScoped(true)}, "/admin/debug", false, cookieName + ".admin"},
+		{"extractor", []Option{fromHeader}, "/debug", true, cookieName},
+	}
+
+	for _, ct := range cookieTests {
+		s := web.New()
+		s.Use(Protect(testKey, append(ct.opts, Debug(true))...))
+		s.Get("/*", DebugHandler)
+
+		r, err := http.NewRequest("GET", ct.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("%s: got %d cookies want 1", ct.name, len(cookies))
+		}
+
+		r, err = http.NewRequest("GET", ct.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ct.header {
+			r.Header.Set("X-CSRF-Cookie", cookies[0].Value)
+		} else {
+			r.AddCookie(cookies[0])
+		}
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		var info debugInfo
+		if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+			t.Fatalf("%s: DebugHandler did not serve valid JSON: %v", ct.name, err)
+		}
+
+		if !info.CookiePresent || info.CookieName != ct.cookie {
+			t.Fatalf("%s: cookie reported incorrectly: got %q (present %v) want %q (present true)",
+				ct.name, info.CookieName, info.CookiePresent, ct.cookie)
+		}
+	}
+}
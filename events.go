@@ -0,0 +1,69 @@
+package csrf
+
+import (
+	"net/http"
+	"time"
+)
+
+// TokenEventType is the type of a TokenEvent.
+type TokenEventType int
+
+// Token lifecycle events. See OnTokenEvent.
+const (
+	// TokenIssued is reported when a new token is issued to a client without
+	// one (or with an invalid one).
+	TokenIssued TokenEventType = iota + 1
+	// TokenRotated is reported when a token is replaced - by Rotate, or after
+	// use with RotateOnUse or OneTimeTokens.
+	TokenRotated
+	// TokenValidated is reported when an unsafe request passes validation.
+	TokenValidated
+	// TokenFailed is reported when a request fails, with the failure reason.
+	TokenFailed
+)
+
+var tokenEventNames = map[TokenEventType]string{
+	TokenIssued:    "issued",
+	TokenRotated:   "rotated",
+	TokenValidated: "validated",
+	TokenFailed:    "failed",
+}
+
+// String returns the lower case name of the event type, e.g. "issued".
+func (t TokenEventType) String() string {
+	if name, ok := tokenEventNames[t]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// TokenEvent describes a point in the lifecycle of a CSRF token, for audit
+// logging. It never includes the token itself.
+type TokenEvent struct {
+	Type TokenEventType
+	Time time.Time
+	// Method, Path and RemoteAddr are taken from the request.
+	Method     string
+	Path       string
+	RemoteAddr string
+	// Reason is the failure reason of TokenFailed events.
+	Reason error
+}
+
+// event reports a token event for the request r to the OnTokenEvent hook, if
+// set.
+func (cs *csrf) event(typ TokenEventType, r *http.Request, reason error) {
+	if cs.opts.OnTokenEvent == nil || r == nil {
+		return
+	}
+
+	cs.opts.OnTokenEvent(TokenEvent{
+		Type:       typ,
+		Time:       cs.now(),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		Reason:     reason,
+	})
+}
@@ -0,0 +1,92 @@
+package csrf
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+// TestOnTokenEvent checks the events reported for a GET-then-POST flow.
+func TestOnTokenEvent(t *testing.T) {
+	var events []TokenEvent
+	s := web.New()
+	s.Use(Protect(testKey, RotateOnUse(true), OnTokenEvent(func(evt TokenEvent) {
+		events = append(events, evt)
+	})))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+	r.RemoteAddr = "192.0.2.1:1234"
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	// A POST without a token fails.
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	var got []TokenEventType
+	for _, evt := range events {
+		got = append(got, evt.Type)
+	}
+
+	expected := []TokenEventType{TokenIssued, TokenValidated, TokenRotated, TokenFailed}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad event sequence: got %v want %v", got, expected)
+	}
+
+	if evt := events[1]; evt.Method != "POST" || evt.Path != "/" || evt.RemoteAddr != "192.0.2.1:1234" {
+		t.Fatalf("bad event metadata: got %+v", evt)
+	}
+
+	if evt := events[3]; !errors.Is(evt.Reason, ErrNoToken) {
+		t.Fatalf("bad failure reason: got %v want %v", evt.Reason, ErrNoToken)
+	}
+}
+
+// TestTokenEventTypeString checks the names of the event types.
+func TestTokenEventTypeString(t *testing.T) {
+	var testTable = []struct {
+		typ      TokenEventType
+		expected string
+	}{
+		{TokenIssued, "issued"},
+		{TokenRotated, "rotated"},
+		{TokenValidated, "validated"},
+		{TokenFailed, "failed"},
+		{TokenEventType(0), "unknown"},
+	}
+
+	for _, v := range testTable {
+		if got := v.typ.String(); got != v.expected {
+			t.Fatalf("bad event type name: got %q want %q", got, v.expected)
+		}
+	}
+}
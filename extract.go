@@ -0,0 +1,84 @@
+package csrf
+
+import "net/http"
+
+// Extractor returns the (masked) token from a request, or an empty string if the
+// request does not include one. A non-nil error fails validation with the error
+// as the failure reason.
+type Extractor func(r *http.Request) (string, error)
+
+// TokenExtractor replaces the built-in token sources - the request header(s),
+// form body, and any JSON body or query parameter - with a custom extractor.
+// The prebuilt extractors can be combined with FirstOf to customise the order:
+//
+//	csrf.TokenExtractor(csrf.FirstOf(
+//		csrf.FromHeader("X-CSRF-Token"),
+//		csrf.FromForm("csrf_token"),
+//	))
+//
+// The StrictMultipleTokens option has no effect when an extractor is set.
+func TokenExtractor(e Extractor) Option {
+	return func(cs *csrf) error {
+		cs.opts.Extractor = e
+		return nil
+	}
+}
+
+// CookieExtractor sets a function that returns the raw (encoded) value of the
+// CSRF cookie from a request, in place of the request's cookie with the
+// configured CookieName - e.g. where a bridge passes the cookie in a header. It
+// should return an empty string if the request does not include the cookie. It
+// is only used by the default cookie store: the cookie is still written to the
+// response as usual.
+func CookieExtractor(fn func(r *http.Request) (string, error)) Option {
+	return func(cs *csrf) error {
+		cs.opts.CookieExtractor = fn
+		return nil
+	}
+}
+
+// FromHeader returns an Extractor that reads the token from a request header.
+func FromHeader(header string) Extractor {
+	return func(r *http.Request) (string, error) {
+		return r.Header.Get(header), nil
+	}
+}
+
+// FromForm returns an Extractor that reads the token from a form field in the
+// request body - either application/x-www-form-urlencoded or
+// multipart/form-data. When used with TokenExtractor, multipart bodies are parsed
+// with the MultipartMaxMemory limit.
+func FromForm(field string) Extractor {
+	return func(r *http.Request) (string, error) {
+		return r.PostFormValue(field), nil
+	}
+}
+
+// FromQuery returns an Extractor that reads the token from a URL query
+// parameter. See TokenFromQuery for the risks of tokens in URLs.
+func FromQuery(param string) Extractor {
+	return func(r *http.Request) (string, error) {
+		return r.URL.Query().Get(param), nil
+	}
+}
+
+// FirstOf returns an Extractor that tries each of the extractors in order and
+// returns the first token found. If none of them find a token, the first error
+// (if any) is returned.
+func FirstOf(extractors ...Extractor) Extractor {
+	return func(r *http.Request) (string, error) {
+		var firstErr error
+		for _, e := range extractors {
+			token, err := e(r)
+			if token != "" {
+				return token, nil
+			}
+
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		return "", firstErr
+	}
+}
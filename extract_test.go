@@ -0,0 +1,250 @@
+package csrf
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+// TestTokenExtractor tests that a custom extractor replaces the built-in token
+// sources, and that its errors are used as the failure reason.
+func TestTokenExtractor(t *testing.T) {
+	errExtract := errors.New("no token for you")
+	var reason error
+
+	s := web.New()
+	s.Use(Protect(testKey,
+		TokenExtractor(func(r *http.Request) (string, error) {
+			if r.URL.Path == "/error" {
+				return "", errExtract
+			}
+			return r.Header.Get("X-Custom-Token"), nil
+		}),
+		ErrorHandler(web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(c, r)
+			w.WriteHeader(http.StatusForbidden)
+		})),
+	))
+
+	var token string
+	s.Handle("/*", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var extractorTests = []struct {
+		path     string
+		header   string
+		expected error
+	}{
+		{"/", "X-Custom-Token", nil},
+		// The default header is no longer inspected.
+		{"/", "X-CSRF-Token", ErrNoToken},
+		{"/error", "X-Custom-Token", errExtract},
+	}
+
+	for _, et := range extractorTests {
+		r, err := http.NewRequest("POST", et.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set(et.header, token)
+
+		reason = nil
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		if reason != et.expected {
+			t.Fatalf("%s %s: failure reason incorrect: got %v want %v",
+				et.path, et.header, reason, et.expected)
+		}
+	}
+}
+
+// TestFirstOf tests that FirstOf returns the first token found, falling back
+// through the extractors in order.
+func TestFirstOf(t *testing.T) {
+	errExtract := errors.New("extractor failed")
+	failing := func(r *http.Request) (string, error) {
+		return "", errExtract
+	}
+
+	e := FirstOf(failing, FromHeader("X-CSRF-Token"), FromForm("csrf_token"), FromQuery("csrf_token"))
+
+	var firstOfTests = []struct {
+		header   string
+		form     string
+		query    string
+		expected string
+		err      error
+	}{
+		{"header", "form", "query", "header", nil},
+		{"", "form", "query", "form", nil},
+		{"", "", "query", "query", nil},
+		{"", "", "", "", errExtract},
+	}
+
+	for _, ft := range firstOfTests {
+		form := url.Values{}
+		if ft.form != "" {
+			form.Set("csrf_token", ft.form)
+		}
+
+		r, err := http.NewRequest("POST", "/?csrf_token="+ft.query, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if ft.header != "" {
+			r.Header.Set("X-CSRF-Token", ft.header)
+		}
+
+		token, err := e(r)
+		if token != ft.expected || err != ft.err {
+			t.Fatalf("FirstOf returned the wrong token: got %q, %v want %q, %v",
+				token, err, ft.expected, ft.err)
+		}
+	}
+}
+
+// TestCookieExtractor tests that the cookie value is read from a custom source
+// in place of the request's cookies.
+func TestCookieExtractor(t *testing.T) {
+	var reason error
+	s := web.New()
+	s.Use(Protect(testKey,
+		CookieExtractor(func(r *http.Request) (string, error) {
+			return r.Header.Get("X-Bridge-Cookie"), nil
+		}),
+		OnFailure(func(c web.C, r *http.Request, err error) { reason = err }),
+	))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("cookie not issued: got %v cookies want %v", len(cookies), 1)
+	}
+
+	var cookieTests = []struct {
+		header   bool
+		cookie   bool
+		expected error
+	}{
+		{true, false, nil},
+		// The request's cookies are no longer inspected.
+		{false, true, ErrNoCookie},
+	}
+
+	for _, ct := range cookieTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ct.header {
+			r.Header.Set("X-Bridge-Cookie", cookies[0].Value)
+		}
+		if ct.cookie {
+			setCookie(rr, r)
+		}
+		r.Header.Set("X-CSRF-Token", token)
+
+		reason = nil
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		if reason != ct.expected {
+			t.Fatalf("header %v, cookie %v: failure reason incorrect: got %v want %v",
+				ct.header, ct.cookie, reason, ct.expected)
+		}
+	}
+}
+
+// TestFromFormMultipartMaxMemory tests that FromForm reads tokens from multipart
+// bodies parsed with the MultipartMaxMemory limit.
+func TestFromFormMultipartMaxMemory(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, TokenExtractor(FromForm("csrf_token")), MultipartMaxMemory(1)))
+
+	var token string
+	var onDisk bool
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+		if r.MultipartForm == nil || len(r.MultipartForm.File["upload"]) == 0 {
+			return
+		}
+
+		f, err := r.MultipartForm.File["upload"][0].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		_, onDisk = f.(*os.File)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("csrf_token", token)
+	fw, err := mw.CreateFormFile("upload", "upload.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(strings.Repeat("a", 1024)))
+	mw.Close()
+
+	r, err = http.NewRequest("POST", "/", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, r)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("multipart token rejected: got %v want %v", resp.Code, http.StatusOK)
+	}
+
+	if !onDisk {
+		t.Fatal("multipart body not parsed with the MultipartMaxMemory limit")
+	}
+}
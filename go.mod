@@ -0,0 +1,8 @@
+module github.com/goji/csrf
+
+go 1.23
+
+require (
+	github.com/gorilla/securecookie v1.1.2
+	github.com/zenazn/goji v1.0.1
+)
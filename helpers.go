@@ -1,13 +1,26 @@
 package csrf
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/zenazn/goji/web"
 )
@@ -15,14 +28,212 @@ import (
 // Token returns a masked CSRF token ready for passing into HTML template or
 // a JSON response body. An empty token will be returned if the middleware
 // has not been applied (which will fail subsequent validation).
+//
+// The token is masked once per request: every call to Token (and TemplateField,
+// MetaTag, etc.) within a request returns the same masked token, so pages that
+// render several forms embed identical values. Each request receives a
+// differently masked token.
 func Token(c web.C, r *http.Request) string {
 	if maskedToken, ok := c.Env[tokenKey].(string); ok {
+		issueCookie(c)
 		return maskedToken
 	}
 
 	return ""
 }
 
+// Tokens returns n distinctly masked CSRF tokens, each of which validates in
+// place of Token - e.g. for a single-page application to attach a fresh token to
+// each of several queued requests. It returns nil if n is not positive or the
+// middleware has not been applied.
+func Tokens(c web.C, n int) []string {
+	cs, ok := c.Env[handlerKey].(*csrf)
+	realToken, hasToken := c.Env[realKey].([]byte)
+	if !ok || !hasToken || n <= 0 {
+		return nil
+	}
+
+	issueCookie(c)
+
+	tokens := make([]string, n)
+	for i := range tokens {
+		tokens[i] = cs.mask(cs.bindToken(realToken, cs.r, boundMethod))
+	}
+
+	return tokens
+}
+
+// RealToken returns the real (unmasked) CSRF token for the current request.
+// Unlike the masked token returned by Token, it is the same for every call
+// within (and across) requests until the token is rotated - e.g. for comparison
+// against a value stored elsewhere.
+//
+// The real token must never be included in a response - HTML, headers or
+// otherwise - as it is not protected against BREACH: use Token instead.
+func RealToken(c web.C) ([]byte, error) {
+	realToken, ok := c.Env[realKey].([]byte)
+	if !ok {
+		return nil, errNoMiddleware
+	}
+
+	if err := issueCookie(c); err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), realToken...), nil
+}
+
+// Rotate generates a new CSRF token, saves it to the store (issuing a new
+// cookie) and returns the new masked token. Subsequent calls to Token and
+// TemplateField for the current request return the new token, and tokens issued
+// before the rotation no longer validate.
+//
+// Handlers should call Rotate immediately after a privilege change - e.g. a
+// successful login - to prevent session fixation using a known token.
+func Rotate(c web.C, w http.ResponseWriter) (string, error) {
+	cs, ok := c.Env[handlerKey].(*csrf)
+	if !ok {
+		return "", errNoMiddleware
+	}
+
+	return cs.rotate(w)
+}
+
+// rotate generates and saves a new token, and updates the request context (and
+// response header) with it.
+func (cs *csrf) rotate(w http.ResponseWriter) (string, error) {
+	if cs.opts.ValidateOnly {
+		return "", errors.New(errorPrefix + "tokens cannot be rotated without IssueCookie")
+	}
+
+	realToken, err := readRandomBytes(cs.rand, cs.opts.TokenLength)
+	if err != nil {
+		return "", err
+	}
+
+	if err := cs.save(realToken, w); err != nil {
+		return "", err
+	}
+	cs.opts.Metrics.IncIssued()
+	cs.event(TokenRotated, cs.r, nil)
+
+	// The new token replaces any token waiting to be saved.
+	delete(cs.c.Env, saveKey)
+
+	masked := cs.mask(cs.bindToken(realToken, cs.r, boundMethod))
+	cs.c.Env[issuedKey] = cs.now()
+	cs.c.Env[realKey] = realToken
+	cs.c.Env[tokenKey] = masked
+	cs.setTokenHeaders(w, masked)
+
+	return masked, nil
+}
+
+// setTokenHeaders writes the masked token to the response headers configured by
+// ResponseHeader and TokenHeaderFormat, if any. Formatted headers with an invalid
+// name are not written.
+func (cs *csrf) setTokenHeaders(w http.ResponseWriter, masked string) {
+	if cs.opts.ResponseHeader != "" {
+		w.Header().Set(cs.opts.ResponseHeader, masked)
+	}
+
+	if cs.opts.TokenHeader != nil {
+		if name, value := cs.opts.TokenHeader(masked); isToken(name) {
+			w.Header().Set(name, value)
+		}
+	}
+}
+
+// Issue creates a new CSRF token for the session sessionID outside of a request -
+// e.g. for a link in an email - saves it to the store and returns the masked
+// token. The token validates on a later request from the same session, as if it
+// had been issued by the middleware. It replaces any existing token for the
+// session.
+//
+// The store must implement KeyedStore (as InMemoryStore does). Pass the options
+// given to Protect, so that the token has the middleware's TokenLength and
+// TokenEncoding: tokens issued without them fail validation. With SessionIDFunc
+// or BindMethod, the token is bound to sessionID and to the method Token binds
+// to.
+func Issue(store Store, sessionID string, opts ...Option) (string, error) {
+	ks, ok := store.(KeyedStore)
+	if !ok {
+		return "", errors.New(errorPrefix + "store does not implement KeyedStore")
+	}
+
+	cs, err := parseOptions(nil, opts...)
+	if err != nil {
+		return "", fmt.Errorf(errorPrefix+"%w", err)
+	}
+	cs.rand = rand.Reader
+	if cs.opts.TokenLength == 0 {
+		cs.opts.TokenLength = tokenLength
+	}
+
+	realToken, err := readRandomBytes(cs.rand, cs.opts.TokenLength)
+	if err != nil {
+		return "", err
+	}
+
+	if err := ks.SaveKey(sessionID, realToken); err != nil {
+		return "", err
+	}
+
+	return cs.mask(cs.bindSession(realToken, boundMethod, sessionID)), nil
+}
+
+// Clear deletes the CSRF token for the current request from the store - e.g. on
+// logout - and, for the default cookie store, expires the cookie. It returns an
+// error if the middleware has not been applied or the store does not implement
+// ClearStore. A new token is issued on the next request.
+func Clear(c web.C, w http.ResponseWriter) error {
+	cs, ok := c.Env[handlerKey].(*csrf)
+	if !ok {
+		return errNoMiddleware
+	}
+
+	cl, ok := cs.st.(ClearStore)
+	if !ok {
+		return errors.New(errorPrefix + "store does not support clearing tokens")
+	}
+
+	// Don't issue a deferred cookie for the cleared token.
+	delete(c.Env, saveKey)
+
+	return cl.Clear(cs.r, w)
+}
+
+// issueCookie saves a new token whose cookie was deferred by the LazyCookie
+// option, the first time the token is accessed.
+func issueCookie(c web.C) error {
+	save, ok := c.Env[saveKey].(func() error)
+	if !ok {
+		return nil
+	}
+
+	delete(c.Env, saveKey)
+	return save()
+}
+
+// TokenAge returns how long ago the real token for the current request was
+// issued - e.g. to prompt users to re-authenticate before a stale token
+// expires. It returns false if the middleware has not been applied or the store
+// does not record when tokens were issued (only the default cookie store in the
+// synchronizer mode does), with second precision.
+func TokenAge(c web.C) (time.Duration, bool) {
+	cs, ok := c.Env[handlerKey].(*csrf)
+	if !ok {
+		return 0, false
+	}
+
+	issued, ok := c.Env[issuedKey].(time.Time)
+	if !ok {
+		return 0, false
+	}
+
+	return cs.now().Sub(issued), true
+}
+
 // FailureReason makes CSRF validation errors available in Goji's request
 // context.
 // This is useful when you want to log the cause of the error or report it to
@@ -35,82 +246,488 @@ func FailureReason(c web.C, r *http.Request) error {
 	return nil
 }
 
+// ValidateRequest runs the same origin and token validation as the middleware
+// against the request, regardless of its method, and returns the failure reason
+// (or nil). It does not write a response or call the error handler. With
+// OneTimeTokens, a valid token is recorded as used, and later requests with it
+// fail with ErrTokenReused.
+//
+// This is useful for WebSocket handshakes: the upgrade is a GET request (which
+// the middleware does not validate) and browsers cannot set custom headers on
+// it, so the token is typically sent as a query parameter - see TokenFromQuery.
+//
+//	func Upgrade(c web.C, w http.ResponseWriter, r *http.Request) {
+//		if err := csrf.ValidateRequest(c, r); err != nil {
+//			http.Error(w, err.Error(), http.StatusForbidden)
+//			return
+//		}
+//		// ... accept the WebSocket connection.
+//	}
+func ValidateRequest(c web.C, r *http.Request) error {
+	cs, ok := c.Env[handlerKey].(*csrf)
+	if !ok {
+		return errNoMiddleware
+	}
+
+	realToken, err := RealToken(c)
+	if err != nil {
+		return err
+	}
+
+	// The real token was only read from the request if the store still reads it.
+	stored, err := cs.st.Get(r)
+	if err := cs.verify(r, realToken, errors.Is(err, http.ErrNoCookie),
+		err == nil && compareTokens(stored, realToken)); err != nil {
+		return err
+	}
+
+	return cs.consume(realToken)
+}
+
+// VerifyToken reports whether token - a masked token as returned by Token -
+// matches the real token for the current request, using a constant-time
+// comparison. Unlike ValidateRequest, it does not extract the token from, or
+// check the origin of, the request. Malformed tokens and requests without the
+// middleware return false.
+//
+// r may be nil - e.g. in a background job holding only the request context - in
+// which case the request the middleware handled is used for SessionIDFunc. With
+// BindMethod, tokens are verified as returned by Token, regardless of the
+// method of r.
+func VerifyToken(c web.C, r *http.Request, token string) bool {
+	cs, ok := c.Env[handlerKey].(*csrf)
+	realToken, hasToken := c.Env[realKey].([]byte)
+	if !ok || !hasToken || len(realToken) == 0 {
+		return false
+	}
+
+	if r == nil {
+		r = cs.r
+	}
+
+	return compareTokens(unmaskToken(cs.encoding(), token, len(realToken)),
+		cs.bindToken(realToken, r, boundMethod))
+}
+
+// UnsafeSkipCheck returns a shallow copy of r flagged to skip CSRF validation.
+// The middleware still issues a token (so Token and TemplateField work as
+// normal), but does not check the origin or token of the flagged request. It
+// must be called before the request reaches the middleware - e.g. from a
+// preceding middleware that recognises a webhook route:
+//
+//	func webhooks(h http.Handler) http.Handler {
+//		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//			if strings.HasPrefix(r.URL.Path, "/webhooks/") {
+//				r = csrf.UnsafeSkipCheck(r)
+//			}
+//			h.ServeHTTP(w, r)
+//		})
+//	}
+//
+// WARNING: this disables CSRF protection for the request entirely. Only flag
+// requests that are authenticated by other means (such as a signed webhook
+// payload) and never based on anything a browser can be made to send. Prefer
+// ExemptPath where the routes are fixed.
+func UnsafeSkipCheck(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), skipCheckKey, true))
+}
+
+// skipCheck reports whether the request has been flagged by UnsafeSkipCheck.
+func skipCheck(r *http.Request) bool {
+	skip, _ := r.Context().Value(skipCheckKey).(bool)
+	return skip
+}
+
+// IsProtected reports whether the middleware validated the request: that is,
+// whether it uses an unsafe method (see SafeMethods) and was neither exempted
+// (see ExemptPath) nor flagged by UnsafeSkipCheck. It returns false if the
+// middleware has not been applied.
+func IsProtected(c web.C, r *http.Request) bool {
+	cs, ok := c.Env[handlerKey].(*csrf)
+	return ok && cs.protects(r)
+}
+
+// protects reports whether the request must pass validation.
+func (cs *csrf) protects(r *http.Request) bool {
+	return !contains(cs.opts.SafeMethods, strings.ToUpper(r.Method)) && !cs.isExempt(r) &&
+		!skipCheck(r)
+}
+
+// issues reports whether the middleware writes a token cookie for the request r:
+// safe requests with a NoIssueOnMethods method are never issued one.
+func (cs *csrf) issues(r *http.Request) bool {
+	return cs.protects(r) || !contains(cs.opts.NoIssueMethods, strings.ToUpper(r.Method))
+}
+
 // TemplateField is a template helper for html/template that provides an <input> field
 // populated with a CSRF token.
 //
 // Example:
 //
-//      // The following tag in our form.tmpl template:
-//      {{ .csrfField }}
-//
-//      // ... becomes:
-//      <input type="hidden" name="goji.csrf.Token" value="<token>">
+//	// The following tag in our form.tmpl template:
+//	{{ .csrfField }}
 //
+//	// ... becomes:
+//	<input type="hidden" name="goji.csrf.Token" value="<token>">
 func TemplateField(c web.C, r *http.Request) template.HTML {
+	name, _ := c.Env[formKey].(string)
+	return TemplateFieldName(c, name)
+}
+
+// TemplateFieldName is a template helper for html/template that provides an
+// <input> field with the given name, populated with the CSRF token for the
+// current request. This is useful when a page renders forms that submit to
+// handlers expecting different field names - see also the FieldName option.
+func TemplateFieldName(c web.C, name string) template.HTML {
 	fragment := fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
-		c.Env[formKey], Token(c, r))
+		template.HTMLEscapeString(name), Token(c, nil))
 
 	return template.HTML(fragment)
 }
 
+// TemplateData adds the masked CSRF token and the hidden <input> field provided
+// by TemplateField to data, under the "csrfToken" and TemplateTag keys, and
+// returns it - e.g. for frameworks that pass a data map to every template:
+//
+//	t.ExecuteTemplate(w, "form.tmpl", csrf.TemplateData(c, map[string]interface{}{
+//	    "title": "Sign up",
+//	}))
+//
+// A new map is returned if data is nil. Both values are empty if the middleware
+// has not been applied.
+func TemplateData(c web.C, data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		data = make(map[string]interface{}, 2)
+	}
+
+	data["csrfToken"] = Token(c, nil)
+	data[TemplateTag] = TemplateField(c, nil)
+	return data
+}
+
+// WriteFormField writes the hidden <input> field provided by TemplateField to
+// w, without allocating an intermediate string - e.g. when streaming a large
+// page. It returns the number of bytes written and any write error.
+func WriteFormField(c web.C, w io.Writer) (int, error) {
+	name, _ := c.Env[formKey].(string)
+
+	var written int
+	for _, s := range []string{
+		`<input type="hidden" name="`, template.HTMLEscapeString(name),
+		`" value="`, Token(c, nil), `">`,
+	} {
+		n, err := io.WriteString(w, s)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// MetaTag is a template helper for html/template that provides a <meta> tag
+// populated with a CSRF token, for JavaScript clients that read the token from
+// the page - e.g. document.querySelector('meta[name="csrf-token"]').content.
+// The name can be changed with the MetaName option.
+//
+// Example:
+//
+//	// The following tag in the <head> of our template:
+//	{{ .csrfMeta }}
+//
+//	// ... becomes:
+//	<meta name="csrf-token" content="<token>">
+func MetaTag(c web.C) template.HTML {
+	name := metaName
+	if cs, ok := c.Env[handlerKey].(*csrf); ok {
+		name = cs.opts.MetaName
+	}
+
+	fragment := fmt.Sprintf(`<meta name="%s" content="%s">`,
+		template.HTMLEscapeString(name), Token(c, nil))
+
+	return template.HTML(fragment)
+}
+
+// HeaderName returns the request header that clients should send the token in
+// (the first set by RequestHeader or RequestHeaders) - e.g. for a configuration
+// endpoint to advertise to single-page applications. It returns the default,
+// "X-CSRF-Token", if the middleware has not been applied.
+func HeaderName(c web.C) string {
+	if cs, ok := c.Env[handlerKey].(*csrf); ok {
+		return cs.opts.RequestHeaders[0]
+	}
+
+	return headerName
+}
+
+// FieldNameFor returns the form field that clients should send the token in (see
+// FieldName). It returns the default if the middleware has not been applied.
+func FieldNameFor(c web.C) string {
+	if name, ok := c.Env[formKey].(string); ok {
+		return name
+	}
+
+	return fieldName
+}
+
+// HXHeaders is a template helper for html/template that provides an hx-headers
+// attribute, for HTMX applications that send the token in a request header with
+// every request - e.g. <body {{ .csrfHX }}>. The attribute holds a JSON object
+// mapping the request header (see RequestHeader) to the CSRF token.
+func HXHeaders(c web.C) template.HTMLAttr {
+	// The JSON is HTML-safe, other than a quote in the header name.
+	b, err := json.Marshal(map[string]string{HeaderName(c): Token(c, nil)})
+	if err != nil {
+		return ""
+	}
+
+	return template.HTMLAttr(`hx-headers='` + strings.ReplaceAll(string(b), "'", `\u0027`) + `'`)
+}
+
+// Nonce returns a random nonce for the request - e.g. for the nonce-source of a
+// Content-Security-Policy header, and the nonce attribute of each inline script.
+// The nonce is generated on first use and cached in the request context, so each
+// call for the same request returns the same nonce. It is unrelated to the CSRF
+// token, from which it cannot be derived.
+//
+// Nonce returns an empty string if the request context has not been initialised
+// (e.g. by the middleware), or no random bytes could be read.
+func Nonce(c web.C) string {
+	if n, ok := c.Env[nonceKey].(string); ok {
+		return n
+	}
+
+	if c.Env == nil {
+		return ""
+	}
+
+	src := rand.Reader
+	if cs, ok := c.Env[handlerKey].(*csrf); ok && cs.rand != nil {
+		src = cs.rand
+	}
+
+	b, err := readRandomBytes(src, 16)
+	if err != nil {
+		return ""
+	}
+
+	n := base64.StdEncoding.EncodeToString(b)
+	c.Env[nonceKey] = n
+	return n
+}
+
+// TemplateNonce is a template helper for html/template that provides a nonce
+// attribute with the request's Nonce - e.g. <script {{ .cspNonce }}>.
+func TemplateNonce(c web.C) template.HTMLAttr {
+	return template.HTMLAttr(fmt.Sprintf(`nonce="%s"`, Nonce(c)))
+}
+
+// TokenForMethod returns a masked CSRF token for requests with the given HTTP
+// method. With BindMethod, tokens only validate for the method they were issued
+// for, and Token (and the template helpers) return tokens for POST requests:
+// use TokenForMethod for forms or requests that use another method, such as PUT
+// or DELETE. Without BindMethod, it is equivalent to Token.
+func TokenForMethod(c web.C, method string) string {
+	cs, ok := c.Env[handlerKey].(*csrf)
+	realToken, hasToken := c.Env[realKey].([]byte)
+	if !ok || !hasToken {
+		return ""
+	}
+
+	issueCookie(c)
+	return cs.mask(cs.bindToken(realToken, cs.r, method))
+}
+
+// bindToken returns the token that requests with the given method must carry
+// for the real token: the real token itself, or - with BindMethod or
+// SessionIDFunc - a token of the same length derived from the real token, the
+// (upper case) method and the session ID of the request r with HMAC-SHA256.
+func (cs *csrf) bindToken(realToken []byte, r *http.Request, method string) []byte {
+	var session string
+	if cs.opts.SessionID != nil && r != nil {
+		session = cs.opts.SessionID(r)
+	}
+
+	return cs.bindSession(realToken, method, session)
+}
+
+// bindSession returns the token bound to the method and session ID for the real
+// token, as for bindToken.
+func (cs *csrf) bindSession(realToken []byte, method, session string) []byte {
+	if !cs.opts.BindMethod && cs.opts.SessionID == nil {
+		return realToken
+	}
+
+	if !cs.opts.BindMethod {
+		method = ""
+	}
+
+	if cs.opts.SessionID == nil {
+		session = ""
+	}
+
+	// Methods are tokens, so cannot contain the separating NUL.
+	bound := make([]byte, 0, len(realToken)+sha256.Size)
+	for i := byte(0); len(bound) < len(realToken); i++ {
+		mac := hmac.New(sha256.New, realToken)
+		mac.Write([]byte{i})
+		mac.Write([]byte(strings.ToUpper(method)))
+		mac.Write([]byte{0})
+		mac.Write([]byte(session))
+		bound = mac.Sum(bound)
+	}
+
+	return bound[:len(realToken)]
+}
+
 // mask returns a unique-per-request token to mitigate the BREACH attack
 // as per http://breachattack.com/#mitigations
 //
 // The token is generated by XOR'ing a one-time-pad and the base (session) CSRF
-// token and returning them together as a 64-byte slice. This effectively
-// randomises the token on a per-request basis without breaking multiple browser
-// tabs/windows.
-func mask(realToken []byte, c *web.C, r *http.Request) string {
-	otp, err := generateRandomBytes(tokenLength)
-	if err != nil {
+// token and returning them together as a slice twice the length of the real
+// token. This effectively randomises the token on a per-request basis without
+// breaking multiple browser tabs/windows.
+//
+// The one-time-pad is read from the handler's random source.
+func (cs *csrf) mask(realToken []byte) string {
+	n := len(realToken)
+	enc := cs.encoding()
+	buf := getBuffer(2*n + enc.EncodedLen(2*n))
+	defer putBuffer(buf)
+
+	// The buffer holds the OTP, the masked token and the encoded result.
+	b := *buf
+	combined, encoded := b[:2*n], b[2*n:]
+	otp, masked := combined[:n], combined[n:]
+	if _, err := io.ReadFull(cs.rand, otp); err != nil {
 		return ""
 	}
 
 	// XOR the OTP with the real token to generate a masked token. Append the
 	// OTP to the front of the masked token to allow unmasking in the subsequent
 	// request.
-	return base64.StdEncoding.EncodeToString(append(otp, xorToken(otp, realToken)...))
+	for i := range masked {
+		masked[i] = otp[i] ^ realToken[i]
+	}
+
+	enc.Encode(encoded, combined)
+	return string(encoded)
+}
+
+// encoding returns the encoding of masked tokens, defaulting to standard
+// (padded) base64.
+func (cs *csrf) encoding() *base64.Encoding {
+	if cs.opts.Encoding == nil {
+		return base64.StdEncoding
+	}
+
+	return cs.opts.Encoding
+}
+
+// bufferPool holds scratch buffers for masking tokens, to avoid allocations for
+// each rendered token.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4*tokenLength+base64.StdEncoding.EncodedLen(2*tokenLength))
+		return &b
+	},
+}
+
+// getBuffer returns a buffer of length n from the pool.
+func getBuffer(n int) *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+
+	*buf = (*buf)[:n]
+	return buf
+}
+
+// putBuffer zeroes the buffer - so that token material never outlives the
+// request that used it - and returns it to the pool.
+func putBuffer(buf *[]byte) {
+	clear(*buf)
+	bufferPool.Put(buf)
 }
 
 // unmask splits the issued token (one-time-pad + masked token) and returns the
-// unmasked request token for comparison.
-func unmask(issued []byte) []byte {
+// unmasked request token for comparison. length is the length of the real
+// token.
+func unmask(issued []byte, length int) []byte {
 	// Issued tokens are always masked and combined with the pad.
-	if len(issued) != tokenLength*2 {
+	if length <= 0 || len(issued) != length*2 {
 		return nil
 	}
 
 	// We now know the length of the byte slice.
-	otp := issued[tokenLength:]
-	masked := issued[:tokenLength]
+	otp := issued[length:]
+	masked := issued[:length]
 
 	// Unmask the token by XOR'ing it against the OTP used to mask it.
 	return xorToken(otp, masked)
 }
 
-// requestToken returns the issued token (pad + masked token) from the HTTP POST
-// body or HTTP header. It will return nil if the token fails to decode.
-func (cs *csrf) requestToken(r *http.Request) []byte {
-	// 1. Check the HTTP header first.
-	issued := r.Header.Get(cs.opts.RequestHeader)
+// requestToken returns the encoded issued token (pad + masked token) from the
+// HTTP header or POST body. It will return an empty string if the request does
+// not include a token.
+func (cs *csrf) requestToken(r *http.Request) string {
+	// 1. Check the HTTP header(s) first.
+	var issued string
+	for _, header := range cs.opts.RequestHeaders {
+		if issued = r.Header.Get(header); issued != "" {
+			break
+		}
+	}
 
-	// 2. Fall back to the POST (form) value.
-	if issued == "" {
-		issued = r.PostFormValue(cs.opts.FieldName)
+	// The Authorization header (if a scheme is configured) is another header.
+	if issued == "" && cs.opts.AuthScheme != "" {
+		issued = cs.authorizationToken(r)
 	}
 
-	// 3. Finally, fall back to the multipart form (if set).
-	if issued == "" && r.MultipartForm != nil {
-		vals := r.MultipartForm.Value[cs.opts.FieldName]
+	// Headers may also be sent as a trailer after a streamed body (if enabled).
+	if issued == "" && cs.opts.TrailerToken {
+		issued = cs.trailerToken(r)
+	}
 
-		if len(vals) > 0 {
+	// 2. Fall back to the POST (form or multipart form) value.
+	if issued == "" {
+		if vals := cs.formTokens(r); len(vals) > 0 {
 			issued = vals[0]
 		}
 	}
 
-	// Decode the "issued" (pad + masked) token sent in the request. Return a
-	// nil byte slice on a decoding error (this will fail upstream).
-	decoded, err := base64.StdEncoding.DecodeString(issued)
+	// 3. Fall back to the JSON body (if configured).
+	if issued == "" && cs.opts.BodyPath != nil {
+		issued = cs.bodyToken(r)
+	}
+
+	// 4. Finally, fall back to the query parameter (if configured).
+	if issued == "" && cs.opts.QueryParam != "" {
+		issued = r.URL.Query().Get(cs.opts.QueryParam)
+	}
+
+	return issued
+}
+
+// unmaskToken decodes and unmasks the encoded issued token sent in the request,
+// returning nil if it is malformed: not valid base64, or not the encoded length
+// of a masked token of the given length. The length is checked before decoding,
+// so that oversized input is never decoded.
+func unmaskToken(enc *base64.Encoding, issued string, length int) []byte {
+	if length <= 0 || len(issued) != enc.EncodedLen(length*2) {
+		return nil
+	}
+
+	return unmask(decodeToken(enc, issued), length)
+}
+
+// decodeToken decodes the "issued" (pad + masked) token sent in the request. It
+// returns a nil byte slice on a decoding error (this will fail upstream).
+func decodeToken(enc *base64.Encoding, issued string) []byte {
+	decoded, err := enc.DecodeString(issued)
 	if err != nil {
 		return nil
 	}
@@ -118,19 +735,202 @@ func (cs *csrf) requestToken(r *http.Request) []byte {
 	return decoded
 }
 
+// issuedTokens returns the distinct (encoded) tokens supplied across all of the
+// token sources inspected by requestToken. Unlike requestToken this always
+// parses the request body.
+func (cs *csrf) issuedTokens(r *http.Request) []string {
+	var tokens []string
+	add := func(t string) {
+		if t != "" && !contains(tokens, t) {
+			tokens = append(tokens, t)
+		}
+	}
+
+	for _, header := range cs.opts.RequestHeaders {
+		add(r.Header.Get(header))
+	}
+
+	if cs.opts.AuthScheme != "" {
+		add(cs.authorizationToken(r))
+	}
+
+	if cs.opts.TrailerToken {
+		add(cs.trailerToken(r))
+	}
+
+	for _, v := range cs.formTokens(r) {
+		add(v)
+	}
+
+	if cs.opts.BodyPath != nil {
+		add(cs.bodyToken(r))
+	}
+
+	if cs.opts.QueryParam != "" {
+		for _, v := range r.URL.Query()[cs.opts.QueryParam] {
+			add(v)
+		}
+	}
+
+	return tokens
+}
+
+// formTokens returns the values of the token field in the request's form (or
+// multipart form) body. Forms already parsed upstream - e.g. by middleware that
+// called ParseForm or ParseMultipartForm - are used as is, as their body has
+// been read: the body is only parsed here if it has not been.
+func (cs *csrf) formTokens(r *http.Request) []string {
+	if r.PostForm == nil {
+		cs.parseMultipartForm(r)
+		// Errors leave the form empty, and fail validation upstream.
+		r.ParseForm()
+	}
+
+	vals := append([]string(nil), r.PostForm[cs.opts.FieldName]...)
+	if r.MultipartForm != nil {
+		for _, v := range r.MultipartForm.Value[cs.opts.FieldName] {
+			if !contains(vals, v) {
+				vals = append(vals, v)
+			}
+		}
+	}
+
+	return vals
+}
+
+// parseMultipartForm parses a multipart/form-data request body using the
+// configured maximum memory, if it has not already been parsed. Other bodies
+// are left for ParseForm to parse.
+func (cs *csrf) parseMultipartForm(r *http.Request) {
+	if r.MultipartForm != nil {
+		return
+	}
+
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && mt == "multipart/form-data" {
+		// Errors leave the form empty, and fail validation upstream.
+		r.ParseMultipartForm(cs.opts.MultipartMaxMemory)
+	}
+}
+
+// bodyToken returns the token at the configured path in a JSON request body, or
+// an empty string if the body is not JSON or does not include the token. The
+// body read is restored for downstream handlers.
+func (cs *csrf) bodyToken(r *http.Request) string {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || r.Body == nil ||
+		(mt != "application/json" && !strings.HasSuffix(mt, "+json")) {
+		return ""
+	}
+
+	buf, err := cs.bufferBody(r)
+	if err != nil {
+		return ""
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return ""
+	}
+
+	for _, key := range cs.opts.BodyPath {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = obj[key]
+	}
+
+	token, _ := v.(string)
+	return token
+}
+
+// authorizationToken returns the credentials of the Authorization header if it
+// uses the configured scheme - e.g. "CSRF <token>" - or an empty string.
+func (cs *csrf) authorizationToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, cs.opts.AuthScheme) {
+		return ""
+	}
+
+	return strings.TrimSpace(token)
+}
+
+// trailerToken returns the token from the request trailer, if the request
+// declares one of the configured headers as a trailer. The body is buffered (and
+// restored) to read the trailer, which is only available once the body has been
+// read in full.
+func (cs *csrf) trailerToken(r *http.Request) string {
+	var declared bool
+	for _, header := range cs.opts.RequestHeaders {
+		if _, ok := r.Trailer[http.CanonicalHeaderKey(header)]; ok {
+			declared = true
+			break
+		}
+	}
+
+	if !declared || r.Body == nil {
+		return ""
+	}
+
+	if _, err := cs.bufferBody(r); err != nil {
+		return ""
+	}
+
+	for _, header := range cs.opts.RequestHeaders {
+		if token := r.Trailer.Get(header); token != "" {
+			return token
+		}
+	}
+
+	return ""
+}
+
+// bufferBody reads no more than the MultipartMaxMemory limit of the request body
+// into memory, and puts what was read back in front of the remainder of the
+// body for downstream handlers.
+func (cs *csrf) bufferBody(r *http.Request) ([]byte, error) {
+	buf, err := io.ReadAll(io.LimitReader(r.Body, cs.opts.MultipartMaxMemory))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+
+	return buf, err
+}
+
+// readCloser combines a Reader with the Closer of the original request body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// isSafeContentType returns true if the media type of the request body matches
+// one of the safe content types.
+func (cs *csrf) isSafeContentType(r *http.Request) bool {
+	if len(cs.opts.SafeContentTypes) == 0 {
+		return false
+	}
+
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && contains(cs.opts.SafeContentTypes, mt)
+}
+
 // generateRandomBytes returns securely generated random bytes.
 // It will return an error if the system's secure random number generator
 // fails to function correctly.
 func generateRandomBytes(n int) ([]byte, error) {
+	return readRandomBytes(rand.Reader, n)
+}
+
+// readRandomBytes returns n bytes read from the random source r. It will return
+// an error if fewer than n bytes could be read.
+func readRandomBytes(r io.Reader, n int) ([]byte, error) {
 	b := make([]byte, n)
-	_, err := rand.Read(b)
+	_, err := io.ReadFull(r, b)
 	// err == nil only if len(b) == n
 	if err != nil {
 		return nil, err
 	}
 
 	return b, nil
-
 }
 
 // sameOrigin returns true if URLs a and b share the same origin. The same
@@ -139,9 +939,174 @@ func sameOrigin(a, b *url.URL) bool {
 	return (a.Scheme == b.Scheme && a.Host == b.Host)
 }
 
-// compare securely (constant-time) compares the unmasked token from the request
-// against the real token from the session.
+// originMismatch describes the first of the scheme, host and (effective) port
+// of b that does not match a, or returns an empty string if they all match.
+// Schemes and hosts are compared case-insensitively.
+func originMismatch(a, b *url.URL) string {
+	switch {
+	case !strings.EqualFold(a.Scheme, b.Scheme):
+		return fmt.Sprintf("scheme %q does not match %q", b.Scheme, a.Scheme)
+	case !strings.EqualFold(a.Hostname(), b.Hostname()):
+		return fmt.Sprintf("host %q does not match %q", b.Hostname(), a.Hostname())
+	case effectivePort(a) != effectivePort(b):
+		return fmt.Sprintf("port %q does not match %q", effectivePort(b), effectivePort(a))
+	}
+
+	return ""
+}
+
+// effectivePort returns the port of a URL, or the default port for its scheme if
+// it does not include one.
+func effectivePort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+
+	return ""
+}
+
+// originOf returns the serialized origin (scheme://host[:port]) of a URL,
+// normalised to lowercase.
+func originOf(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// isTrustedOrigin returns true if the origin of the supplied URL exactly matches
+// one of the trusted origins, or a wildcard trusted origin.
+func (cs *csrf) isTrustedOrigin(u *url.URL) bool {
+	if u == nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+
+	origin := originOf(u)
+	for _, trusted := range cs.opts.TrustedOrigins {
+		if trusted == origin || matchWildcard(trusted, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchWildcard returns true if origin matches the wildcard origin pattern -
+// e.g. "https://*.example.com" - with a single (valid) label in place of the
+// '*'. The label is matched up to the '.' boundary, so the pattern cannot match
+// "https://evil-example.com" or "https://a.b.example.com".
+func matchWildcard(pattern, origin string) bool {
+	prefix, suffix, ok := strings.Cut(pattern, "*")
+	if !ok {
+		return false
+	}
+
+	rest, ok := strings.CutPrefix(origin, prefix)
+	if !ok {
+		return false
+	}
+
+	label, ok := strings.CutSuffix(rest, suffix)
+	return ok && !strings.Contains(label, ".") && isHostname(label)
+}
+
+// addVary adds field to the Vary header of h unless it is already listed (or
+// the header is "*"), preserving any existing values.
+func addVary(h http.Header, field string) {
+	for _, value := range h.Values("Vary") {
+		for _, f := range strings.Split(value, ",") {
+			if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+
+	h.Add("Vary", field)
+}
+
+// corsSafelistedHeaders are the request headers browsers send cross-origin
+// without a CORS preflight, as per the Fetch standard.
+var corsSafelistedHeaders = []string{"Accept", "Accept-Language", "Content-Language", "Content-Type"}
+
+// preflighted returns true if the SkipAfterPreflight option is set and the
+// request supplies a token in a request header that browsers only send
+// cross-origin after a CORS preflight.
+func (cs *csrf) preflighted(r *http.Request) bool {
+	if !cs.opts.SkipAfterPreflight {
+		return false
+	}
+
+	for _, header := range cs.opts.RequestHeaders {
+		header = http.CanonicalHeaderKey(header)
+		if r.Header.Get(header) != "" && !contains(corsSafelistedHeaders, header) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestURL returns the effective URL of the request for the purposes of the
+// origin check. The scheme is taken from the request URL - or r.TLS if the URL
+// does not include one - and the host falls back to r.Host. The scheme from the
+// X-Forwarded-Proto header is only used when the TrustProxyHeaders option is
+// set, as it can otherwise be spoofed by clients.
+func (cs *csrf) requestURL(r *http.Request) *url.URL {
+	u := *r.URL
+	if u.Scheme == "" && r.TLS != nil {
+		u.Scheme = "https"
+	}
+
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+
+	if cs.opts.TrustProxy {
+		// Proxies may append to the header: the first value is the client
+		// facing scheme.
+		proto := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto != "" {
+			u.Scheme = proto
+		}
+	}
+
+	return &u
+}
+
+// isExempt returns true if the (cleaned) request path matches one of the exempt
+// paths.
+func (cs *csrf) isExempt(r *http.Request) bool {
+	if len(cs.opts.ExemptPaths) == 0 {
+		return false
+	}
+
+	p := path.Clean("/" + r.URL.Path)
+	for _, exempt := range cs.opts.ExemptPaths {
+		if prefix := strings.TrimSuffix(exempt, "*"); prefix != exempt {
+			if strings.HasPrefix(p, prefix) {
+				return true
+			}
+		} else if p == exempt {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compareTokens securely (constant-time) compares the unmasked token from the
+// request against the real token from the session, so that the time taken does
+// not reveal how many leading bytes of a forged token are correct. Tokens of
+// differing lengths, and empty tokens, never match.
 func compareTokens(a, b []byte) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+
 	if subtle.ConstantTimeCompare(a, b) == 1 {
 		return true
 	}
@@ -180,6 +1145,98 @@ func contains(vals []string, s string) bool {
 	return false
 }
 
+// isHostname reports whether s is a non-empty hostname: dot-separated labels of
+// letters, digits, hyphens and underscores.
+func isHostname(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, label := range strings.Split(s, ".") {
+		if label == "" {
+			return false
+		}
+
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+				c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// forwardedHeaders are set by proxies on the requests they forward.
+var forwardedHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// isLoopbackRequest reports whether the request was made to a loopback host
+// (localhost or a loopback IP) from a loopback address, and was not forwarded by
+// a proxy - see DevelopmentMode.
+func isLoopbackRequest(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+
+	for _, header := range forwardedHeaders {
+		if r.Header.Get(header) != "" {
+			return false
+		}
+	}
+
+	return isLoopbackHost(r.Host) && isLoopbackHost(r.RemoteAddr)
+}
+
+// isLoopbackHost reports whether the host (with or without a port) is localhost,
+// a subdomain of localhost, or a loopback IP address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// domainMatches reports whether a cookie with the given Domain attribute is
+// accepted for host, as per RFC6265 section 5.1.3: the host must equal the
+// domain or be a subdomain of it.
+func domainMatches(domain, host string) bool {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	host = strings.ToLower(host)
+
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// isToken reports whether s is a non-empty RFC2616 token, as required for cookie
+// names (RFC6265 section 4.1.1) and header field names.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		// Reject control characters, whitespace, DEL and non-ASCII bytes.
+		if c <= ' ' || c >= 0x7f {
+			return false
+		}
+
+		if strings.IndexByte(`()<>@,;:\"/[]?={}`, c) != -1 {
+			return false
+		}
+	}
+
+	return true
+}
+
 // envError stores a CSRF error in the request context.
 func envError(c *web.C, err error) {
 	c.Env[errorKey] = err
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -13,6 +15,7 @@ import (
 	"strings"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/zenazn/goji/web"
 )
@@ -66,6 +69,60 @@ func TestFormToken(t *testing.T) {
 	}
 }
 
+// TestTemplateData tests that the token and hidden field are added to a template
+// data map, and that the rendered token validates.
+func TestTemplateData(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey))
+
+	var data map[string]interface{}
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		data = TemplateData(c, map[string]interface{}{"title": "Sign up"})
+		t := template.Must(template.New("base").Parse(`{{ .csrfToken }}|{{ .csrfField }}`))
+		t.Execute(w, data)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	token, _ := data["csrfToken"].(string)
+	if len(token) != base64.StdEncoding.EncodedLen(tokenLength*2) {
+		t.Fatalf("token length invalid: got %v want %v", len(token), base64.StdEncoding.EncodedLen(tokenLength*2))
+	}
+
+	field := fmt.Sprintf(testTemplateField, fieldName, token)
+	if got := rr.Body.String(); got != token+"|"+field {
+		t.Fatalf("template data not rendered: got %q want %q", got, token+"|"+field)
+	}
+
+	if data["title"] != "Sign up" {
+		t.Fatalf("existing template data not kept: got %v want %v", data["title"], "Sign up")
+	}
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, r)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("token from template data rejected: got %v want %v", resp.Code, http.StatusOK)
+	}
+
+	if data := TemplateData(web.C{}, nil); data["csrfToken"] != "" || data[TemplateTag] == nil {
+		t.Fatalf("TemplateData without the middleware: got %v", data)
+	}
+}
+
 // Test that we can extract a CSRF token from a multipart form.
 func TestMultipartFormToken(t *testing.T) {
 	s := web.New()
@@ -124,6 +181,133 @@ func TestMultipartFormToken(t *testing.T) {
 	}
 }
 
+// TestPreParsedForm tests that the token field is found in a form body that was
+// parsed (and so consumed) by upstream middleware.
+func TestPreParsedForm(t *testing.T) {
+	var testTable = []struct {
+		name  string
+		parse func(r *http.Request, token string)
+	}{
+		{"ParseForm", func(r *http.Request, token string) {
+			r.Body = io.NopCloser(strings.NewReader(url.Values{fieldName: {token}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.ParseForm()
+		}},
+		{"ParseMultipartForm", func(r *http.Request, token string) {
+			var b bytes.Buffer
+			mp := multipart.NewWriter(&b)
+			mp.WriteField(fieldName, token)
+			mp.Close()
+
+			r.Body = io.NopCloser(&b)
+			r.Header.Set("Content-Type", mp.FormDataContentType())
+			r.ParseMultipartForm(1024)
+		}},
+		{"populated PostForm", func(r *http.Request, token string) {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.PostForm = url.Values{fieldName: {token}}
+		}},
+	}
+
+	for _, v := range testTable {
+		var token string
+		s := web.New()
+		// The upstream middleware parses the form from the issued token.
+		s.Use(func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "POST" {
+					v.parse(r, token)
+				}
+				h.ServeHTTP(w, r)
+			})
+		})
+		s.Use(Protect(testKey))
+		s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			token = Token(c, r)
+		}))
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: token not found in the pre-parsed form: got %v want %v",
+				v.name, rr.Code, http.StatusOK)
+		}
+	}
+}
+
+// TestMultipartMaxMemory tests that a multipart upload larger than the
+// configured maximum memory is parsed for the token field.
+func TestMultipartMaxMemory(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, MultipartMaxMemory(1024)))
+
+	var token string
+	var form *multipart.Form
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+		form = r.MultipartForm
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	// Set up our multipart form with a file larger than the max memory.
+	var b bytes.Buffer
+	mp := multipart.NewWriter(&b)
+	fw, err := mp.CreateFormFile("upload", "upload.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(bytes.Repeat([]byte("a"), 64*1024))
+
+	if err := mp.WriteField(fieldName, token); err != nil {
+		t.Fatal(err)
+	}
+	mp.Close()
+
+	r, err = http.NewRequest("POST", "/", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set("Content-Type", mp.FormDataContentType())
+	setCookie(rr, r)
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+
+	if form == nil || len(form.File["upload"]) != 1 {
+		t.Fatal("multipart form not available to the next handler")
+	}
+	form.RemoveAll()
+}
+
 // TestMaskUnmaskTokens tests that a token traversing the mask -> unmask process
 // is correctly unmasked to the original 'real' token.
 func TestMaskUnmaskTokens(t *testing.T) {
@@ -134,18 +318,38 @@ func TestMaskUnmaskTokens(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	issued := mask(realToken, nil, nil)
+	cs := &csrf{rand: rand.Reader}
+	issued := cs.mask(realToken)
 	decoded, err := base64.StdEncoding.DecodeString(issued)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	unmasked := unmask(decoded)
+	unmasked := unmask(decoded, tokenLength)
 	if !compareTokens(unmasked, realToken) {
 		t.Fatalf("tokens do not match: got %x want %x", unmasked, realToken)
 	}
 }
 
+// TestMaskGolden tests the format of masked tokens against a golden value,
+// using a deterministic random source.
+func TestMaskGolden(t *testing.T) {
+	realToken := make([]byte, tokenLength)
+	for i := range realToken {
+		realToken[i] = byte(i)
+	}
+
+	cs, err := parseOptions(nil, setRandReader(bytes.NewReader(bytes.Repeat([]byte{0xa5}, tokenLength))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "paWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpKemoaCjoq2sr66pqKuqtbS3trGws7K9vL++ubi7ug=="
+	if issued := cs.mask(realToken); issued != expected {
+		t.Fatalf("masked token format changed: got %q want %q", issued, expected)
+	}
+}
+
 // Tests domains that should (or should not) return true for a
 // same-origin check.
 func TestSameOrigin(t *testing.T) {
@@ -178,6 +382,152 @@ func TestSameOrigin(t *testing.T) {
 	}
 }
 
+// TestCompareTokens tests that tokens differing only in their last byte, or in
+// length, do not match.
+func TestCompareTokens(t *testing.T) {
+	a, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := append([]byte(nil), a...)
+	if !compareTokens(a, b) {
+		t.Fatal("identical tokens do not match")
+	}
+
+	b[len(b)-1] ^= 0x01
+	if compareTokens(a, b) {
+		t.Fatal("tokens differing in the last byte match")
+	}
+
+	if compareTokens(a, a[:len(a)-1]) {
+		t.Fatal("tokens of differing lengths match")
+	}
+
+	if compareTokens(a, nil) {
+		t.Fatal("token matches a nil token")
+	}
+
+	if compareTokens(nil, []byte{}) {
+		t.Fatal("empty tokens match")
+	}
+}
+
+// TestMalformedTokens tests that truncated, over-long and non-base64 tokens fail
+// validation with ErrBadToken, and never unmask.
+func TestMalformedTokens(t *testing.T) {
+	var reason error
+	s := web.New()
+	s.Use(Protect(testKey, ErrorHandler(web.HandlerFunc(
+		func(c web.C, w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(c, r)
+		}))))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var malformed = []string{
+		"A",
+		"====",
+		token[:len(token)-1],
+		token[:len(token)/2],
+		token + "A",
+		token + token,
+		strings.Repeat("A", 1<<16),
+		strings.Replace(token, token[:1], "!", 1),
+		base64.URLEncoding.EncodeToString(bytes.Repeat([]byte{0xfb}, 2*tokenLength)),
+		base64.StdEncoding.EncodeToString(decoded[:2*tokenLength-1]),
+		base64.RawStdEncoding.EncodeToString(decoded),
+		" " + token[1:],
+		"\x00" + token[1:],
+	}
+
+	for _, m := range malformed {
+		if unmaskToken(base64.StdEncoding, m, tokenLength) != nil {
+			t.Fatalf("malformed token unmasked: %q", m)
+		}
+
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", m)
+
+		reason = nil
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		if reason != ErrBadToken {
+			t.Fatalf("malformed token %q: failure reason incorrect: got %v want %v",
+				m, reason, ErrBadToken)
+		}
+	}
+
+	if unmaskToken(base64.StdEncoding, token, tokenLength) == nil {
+		t.Fatal("valid token did not unmask")
+	}
+}
+
+// TestLastByteToken tests that the middleware rejects a request token that
+// differs from the real token only in its last byte.
+func TestLastByteToken(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	// Flipping the last byte of the masked half flips the last byte of the
+	// unmasked token.
+	issued, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued[len(issued)-1] ^= 0x01
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", base64.StdEncoding.EncodeToString(issued))
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("token differing in the last byte passed validation: got %v want %v",
+			rr.Code, http.StatusForbidden)
+	}
+}
+
 func TestXOR(t *testing.T) {
 	testTokens := []struct {
 		a        []byte
@@ -253,3 +603,1423 @@ func TestTemplateField(t *testing.T) {
 			customTemplateField, expectedTemplateField)
 	}
 }
+
+// TestTokenLength tests that tokens of a configured length are issued and
+// validated by the middleware.
+func TestTokenLength(t *testing.T) {
+	for _, length := range []int{32, 48, 64} {
+		s := web.New()
+		s.Use(Protect(testKey, TokenLength(length)))
+
+		var token string
+		s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			token = Token(c, r)
+		}))
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if len(token) != base64.StdEncoding.EncodedLen(length*2) {
+			t.Fatalf("token length invalid: got %v want %v",
+				len(token), base64.StdEncoding.EncodedLen(length*2))
+		}
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%d byte token failed validation: got %v want %v",
+				length, rr.Code, http.StatusOK)
+		}
+	}
+}
+
+// TestRotate tests that rotating the token issues a new cookie and that tokens
+// issued before the rotation no longer validate.
+func TestRotate(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey))
+
+	var token, rotated string
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+	s.Post("/login", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		var err error
+		rotated, err = Rotate(c, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if Token(c, r) != rotated {
+			t.Fatalf("Token does not return the rotated token: got %q want %q",
+				Token(c, r), rotated)
+		}
+	}))
+	s.Post("/", testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+	original := rr.Header().Get("Set-Cookie")
+
+	r, err = http.NewRequest("POST", "/login", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login failed: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if c := rr.Header().Get("Set-Cookie"); c == "" || c == original {
+		t.Fatalf("cookie not rotated: got %q", c)
+	}
+
+	for _, tt := range []struct {
+		token    string
+		expected int
+	}{
+		{token, http.StatusForbidden},
+		{rotated, http.StatusOK},
+	} {
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", tt.token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != tt.expected {
+			t.Fatalf("token validation after rotation failed: got %v want %v",
+				resp.Code, tt.expected)
+		}
+	}
+}
+
+// TestRotateOnUse tests that a new token is issued after a successful POST, and
+// that the old token is rejected on the subsequent request.
+func TestRotateOnUse(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, RotateOnUse(true)))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+	original, originalCookie := token, rr.Header().Get("Set-Cookie")
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", original)
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("valid token rejected: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if c := rr.Header().Get("Set-Cookie"); c == "" || c == originalCookie {
+		t.Fatalf("cookie not rotated: got %q", c)
+	}
+
+	if token == original {
+		t.Fatal("Token does not return the rotated token")
+	}
+
+	for _, tt := range []struct {
+		token    string
+		expected int
+	}{
+		{original, http.StatusForbidden},
+		{token, http.StatusOK},
+	} {
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", tt.token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != tt.expected {
+			t.Fatalf("token validation after rotation failed: got %v want %v",
+				resp.Code, tt.expected)
+		}
+	}
+}
+
+// TestRotateNoMiddleware tests that Rotate returns an error when the
+// middleware has not been applied.
+func TestRotateNoMiddleware(t *testing.T) {
+	if _, err := Rotate(web.C{}, httptest.NewRecorder()); err == nil {
+		t.Fatal("Rotate did not return an error without the middleware")
+	}
+}
+
+// TestTemplateFieldName tests that a field with a caller-specified name is
+// populated with a token that validates.
+func TestTemplateFieldName(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey))
+
+	var token string
+	var field string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+		field = string(TemplateFieldName(c, "authenticity_token"))
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	expected := fmt.Sprintf(testTemplateField, "authenticity_token", token)
+	if field != expected {
+		t.Fatalf("templateField not set correctly: got %v want %v", field, expected)
+	}
+
+	// Submit the token from the rendered field.
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", strings.Split(field, `value="`)[1][:len(token)])
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token from the field failed validation: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+}
+
+// TestRealToken tests that the real token is stable across requests while the
+// masked token is not, and that it matches the unmasked token.
+func TestRealToken(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey))
+
+	var tokens []string
+	var realTokens [][]byte
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		realToken, err := RealToken(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tokens = append(tokens, Token(c, r))
+		realTokens = append(realTokens, realToken)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	r, err = http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	if tokens[0] == tokens[1] {
+		t.Fatalf("masked tokens match: got %q", tokens[0])
+	}
+
+	if !bytes.Equal(realTokens[0], realTokens[1]) {
+		t.Fatalf("real token not stable: got %x want %x", realTokens[1], realTokens[0])
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(tokens[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(unmask(decoded, tokenLength), realTokens[1]) {
+		t.Fatal("real token does not match the unmasked token")
+	}
+
+	if _, err := RealToken(web.C{}); err == nil {
+		t.Fatal("RealToken did not return an error without the middleware")
+	}
+}
+
+// TestValidateRequest tests that ValidateRequest validates a WebSocket-style
+// GET request carrying the token in a query parameter.
+func TestValidateRequest(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, TokenFromQuery("csrf_token")))
+
+	var token string
+	var validateErr error
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+	s.Get("/ws", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		validateErr = ValidateRequest(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var validateTests = []struct {
+		cookie   bool
+		query    string
+		expected error
+	}{
+		{true, "?csrf_token=" + url.QueryEscape(token), nil},
+		{true, "", ErrNoToken},
+		{true, "?csrf_token=bad", ErrBadToken},
+		{false, "?csrf_token=" + url.QueryEscape(token), ErrNoCookie},
+	}
+
+	for _, vt := range validateTests {
+		r, err := http.NewRequest("GET", "/ws"+vt.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if vt.cookie {
+			setCookie(rr, r)
+		}
+
+		validateErr = errors.New("not called")
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		if validateErr != vt.expected {
+			t.Fatalf("ValidateRequest(%q) incorrect: got %v want %v", vt.query, validateErr, vt.expected)
+		}
+	}
+
+	if err := ValidateRequest(web.C{}, r); err == nil {
+		t.Fatal("ValidateRequest did not return an error without the middleware")
+	}
+}
+
+// TestQueryTokenUnsafeGET tests that a query parameter token is validated for
+// GET requests once GET is no longer a safe method - e.g. for download links
+// that change state.
+func TestQueryTokenUnsafeGET(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, TokenFromQuery("csrf"), SafeMethods("HEAD", "OPTIONS"),
+		NoIssueOnMethods()))
+
+	var token string
+	s.Handle("/*", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	// Obtain a token with a (still safe) HEAD request.
+	r, err := http.NewRequest("HEAD", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var queryTests = []struct {
+		query    string
+		expected int
+	}{
+		{"?csrf=" + url.QueryEscape(token), http.StatusOK},
+		{"?csrf=bad", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+
+	for _, qt := range queryTests {
+		r, err := http.NewRequest("GET", "/download"+qt.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != qt.expected {
+			t.Fatalf("GET %q incorrect: got %v want %v", qt.query, resp.Code, qt.expected)
+		}
+	}
+}
+
+// TestUnsafeSkipCheck tests that a flagged POST without a token is allowed
+// through, while still being issued a token.
+func TestUnsafeSkipCheck(t *testing.T) {
+	var token string
+	h := ProtectHTTP(testKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = RequestToken(r)
+	}))
+
+	r, err := http.NewRequest("POST", "/webhooks/payment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, UnsafeSkipCheck(r))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("flagged request was rejected: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if token == "" || rr.Header().Get("Set-Cookie") == "" {
+		t.Fatalf("token not issued for a flagged request: got %q", token)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("unflagged request was not rejected: got %v want %v",
+			rr.Code, http.StatusForbidden)
+	}
+}
+
+// TestMetaTag tests that the <meta> tag uses the configured name and is
+// populated with a token that validates.
+func TestMetaTag(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, MetaName("x-csrf")))
+
+	var tag string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		tag = string(MetaTag(c))
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if !strings.HasPrefix(tag, `<meta name="x-csrf" content="`) {
+		t.Fatalf("meta tag name not set correctly: got %v", tag)
+	}
+
+	// Submit the token from the rendered tag.
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", strings.TrimSuffix(strings.Split(tag, `content="`)[1], `">`))
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token from the meta tag failed validation: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+
+	if tag := string(MetaTag(web.C{})); tag != `<meta name="csrf-token" content="">` {
+		t.Fatalf("meta tag without the middleware incorrect: got %v", tag)
+	}
+}
+
+// TestBodyToken tests that a token in a JSON body validates, and that the body
+// is restored for the wrapped handler.
+func TestBodyToken(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, TokenFromBody("meta.csrf_token")))
+
+	var token string
+	var body string
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+	s.Post("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = string(b)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var bodyTests = []struct {
+		contentType string
+		body        string
+		expected    int
+	}{
+		{"application/json", fmt.Sprintf(`{"meta": {"csrf_token": %q}, "name": "goji"}`, token), http.StatusOK},
+		{"application/vnd.api+json; charset=utf-8", fmt.Sprintf(`{"meta": {"csrf_token": %q}}`, token), http.StatusOK},
+		{"text/plain", fmt.Sprintf(`{"meta": {"csrf_token": %q}}`, token), http.StatusForbidden},
+		{"application/json", fmt.Sprintf(`{"csrf_token": %q}`, token), http.StatusForbidden},
+		{"application/json", `{"meta": {"csrf_token": 1}}`, http.StatusForbidden},
+		{"application/json", `{"meta": `, http.StatusForbidden},
+	}
+
+	for _, bt := range bodyTests {
+		r, err := http.NewRequest("POST", "/", strings.NewReader(bt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("Content-Type", bt.contentType)
+
+		body = ""
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+
+		if rec.Code != bt.expected {
+			t.Fatalf("%s %s: middleware returned the wrong status: got %v want %v",
+				bt.contentType, bt.body, rec.Code, bt.expected)
+		}
+
+		if bt.expected == http.StatusOK && body != bt.body {
+			t.Fatalf("body not restored: got %q want %q", body, bt.body)
+		}
+	}
+}
+
+// benchmarkRender serves GET requests carrying a valid cookie to a protected
+// handler that renders the token with render.
+func benchmarkRender(b *testing.B, render func(c web.C, r *http.Request)) {
+	s := web.New()
+	s.Use(Protect(testKey))
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		render(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+	setCookie(rr, r)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
+
+func BenchmarkToken(b *testing.B) {
+	benchmarkRender(b, func(c web.C, r *http.Request) {
+		Token(c, r)
+	})
+}
+
+func BenchmarkFormField(b *testing.B) {
+	benchmarkRender(b, func(c web.C, r *http.Request) {
+		TemplateField(c, r)
+	})
+}
+
+func BenchmarkWriteFormField(b *testing.B) {
+	benchmarkRender(b, func(c web.C, r *http.Request) {
+		WriteFormField(c, io.Discard)
+	})
+}
+
+func BenchmarkMask(b *testing.B) {
+	realToken, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cs := &csrf{rand: rand.Reader}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cs.mask(realToken)
+	}
+}
+
+func BenchmarkUnmask(b *testing.B) {
+	realToken, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cs := &csrf{rand: rand.Reader}
+	issued := cs.mask(realToken)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		unmaskToken(base64.StdEncoding, issued, tokenLength)
+	}
+}
+
+// TestVerifyToken tests that VerifyToken accepts tokens for the current real
+// token only, and rejects malformed tokens.
+func TestVerifyToken(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey))
+
+	var token string
+	var results []bool
+	var candidates []string
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+		results = results[:0]
+		for _, candidate := range candidates {
+			results = append(results, VerifyToken(c, r, candidate))
+		}
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherToken := (&csrf{rand: rand.Reader}).mask(bytes.Repeat([]byte("x"), tokenLength))
+
+	var verifyTests = []struct {
+		token    string
+		expected bool
+	}{
+		{token, true},
+		{otherToken, false},
+		{"", false},
+		{"not base64!", false},
+		{token[:len(token)-4], false},
+		{base64.StdEncoding.EncodeToString(decoded[:tokenLength]), false},
+		{base64.StdEncoding.EncodeToString(append(decoded, decoded...)), false},
+	}
+
+	for _, vt := range verifyTests {
+		candidates = append(candidates, vt.token)
+	}
+
+	r, err = http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	for i, vt := range verifyTests {
+		if results[i] != vt.expected {
+			t.Fatalf("VerifyToken(%q) incorrect: got %v want %v", vt.token, results[i], vt.expected)
+		}
+	}
+
+	if VerifyToken(web.C{}, r, token) {
+		t.Fatal("VerifyToken returned true without the middleware")
+	}
+}
+
+// TestVerifyTokenBindMethod tests that VerifyToken accepts the token returned by
+// Token under a GET request with BindMethod, and without a request.
+func TestVerifyTokenBindMethod(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, BindMethod(true)))
+
+	var results []bool
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token := Token(c, r)
+		results = []bool{
+			VerifyToken(c, r, token),
+			VerifyToken(c, nil, token),
+			VerifyToken(c, nil, TokenForMethod(c, "DELETE")),
+		}
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	for i, expected := range []bool{true, true, false} {
+		if results[i] != expected {
+			t.Fatalf("VerifyToken %d incorrect: got %v want %v", i, results[i], expected)
+		}
+	}
+}
+
+// FuzzMaskUnmask tests that any token survives the mask -> unmask round-trip.
+func FuzzMaskUnmask(f *testing.F) {
+	f.Add(bytes.Repeat([]byte{0x00}, tokenLength))
+	f.Add(bytes.Repeat([]byte{0xff}, tokenLength))
+	f.Add([]byte("a-token-of-another-length"))
+
+	cs := &csrf{rand: rand.Reader}
+	f.Fuzz(func(t *testing.T, realToken []byte) {
+		if len(realToken) == 0 {
+			t.Skip()
+		}
+
+		issued := cs.mask(realToken)
+		if unmasked := unmaskToken(base64.StdEncoding, issued, len(realToken)); !bytes.Equal(unmasked, realToken) {
+			t.Fatalf("round-trip failed: got %x want %x", unmasked, realToken)
+		}
+	})
+}
+
+// FuzzUnmaskToken tests that arbitrary input never panics, and only unmasks to
+// a token of the expected length.
+func FuzzUnmaskToken(f *testing.F) {
+	f.Add("")
+	f.Add("not base64!")
+	f.Add((&csrf{rand: rand.Reader}).mask(bytes.Repeat([]byte{0x01}, tokenLength)))
+
+	f.Fuzz(func(t *testing.T, issued string) {
+		if unmasked := unmaskToken(base64.StdEncoding, issued, tokenLength); unmasked != nil && len(unmasked) != tokenLength {
+			t.Fatalf("unmasked token has the wrong length: got %d want %d", len(unmasked), tokenLength)
+		}
+	})
+}
+
+// TestTrailerToken tests that a token sent as a trailer after a chunked body
+// validates, and that the body is restored for the handler.
+func TestTrailerToken(t *testing.T) {
+	var token string
+	var body string
+	h := ProtectHTTP(testKey, Secure(false), TokenFromTrailer(true))(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			token = RequestToken(r)
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = string(b)
+		}))
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cookies := resp.Cookies()
+
+	for _, tt := range []struct {
+		trailer  string
+		expected int
+	}{
+		{token, http.StatusOK},
+		{"", http.StatusForbidden},
+	} {
+		// An io.Pipe body has no known length, and so is sent chunked.
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte("streamed "))
+			pw.Write([]byte("upload"))
+			pw.Close()
+		}()
+
+		req, err := http.NewRequest("POST", srv.URL, pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		req.Trailer = http.Header{"X-Csrf-Token": {tt.trailer}}
+
+		body = ""
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.expected {
+			t.Fatalf("trailer %q: middleware returned the wrong status: got %v want %v",
+				tt.trailer, resp.StatusCode, tt.expected)
+		}
+
+		if tt.expected == http.StatusOK && body != "streamed upload" {
+			t.Fatalf("body not restored: got %q want %q", body, "streamed upload")
+		}
+	}
+}
+
+// TestTokenAge tests that the age of new tokens is zero and that the age of an
+// existing token is measured from the cookie's timestamp.
+func TestTokenAge(t *testing.T) {
+	clock := time.Now()
+	s := web.New()
+	s.Use(Protect(testKey, setClock(func() time.Time { return clock })))
+
+	var age time.Duration
+	var ok bool
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		age, ok = TokenAge(c)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if !ok || age != 0 {
+		t.Fatalf("age of a new token incorrect: got %v, %v want %v, %v", age, ok, 0, true)
+	}
+
+	// The cookie timestamp has second precision.
+	clock = clock.Add(10 * time.Minute)
+	r, err = http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	if !ok || age < 10*time.Minute-time.Second || age > 10*time.Minute+time.Second {
+		t.Fatalf("age of an existing token incorrect: got %v, %v want %v, %v",
+			age, ok, 10*time.Minute, true)
+	}
+
+	if _, ok := TokenAge(web.C{}); ok {
+		t.Fatal("TokenAge returned an age without the middleware")
+	}
+}
+
+// TestAuthorizationToken tests that the token is read from the Authorization
+// header only when the scheme matches.
+func TestAuthorizationToken(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, TokenFromAuthorization("CSRF")))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	var authTests = []struct {
+		authorization string
+		header        string
+		expected      int
+	}{
+		{"CSRF " + token, "", http.StatusOK},
+		{"csrf  " + token, "", http.StatusOK},
+		{"Bearer " + token, "", http.StatusForbidden},
+		{"CSRF", "", http.StatusForbidden},
+		{"", "", http.StatusForbidden},
+		// The header and form sources are still inspected.
+		{"Bearer abc", token, http.StatusOK},
+	}
+
+	for _, at := range authTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		if at.authorization != "" {
+			r.Header.Set("Authorization", at.authorization)
+		}
+		if at.header != "" {
+			r.Header.Set("X-CSRF-Token", at.header)
+		}
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != at.expected {
+			t.Fatalf("Authorization %q: middleware returned the wrong status: got %v want %v",
+				at.authorization, resp.Code, at.expected)
+		}
+	}
+}
+
+// TestTokenStablePerRequest tests that every call to Token within a request
+// returns the same masked token.
+func TestTokenStablePerRequest(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey))
+
+	var tokens []string
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, Token(c, r), Token(c, r))
+		if field := TemplateField(c, r); !strings.Contains(string(field), tokens[0]) {
+			t.Fatalf("TemplateField did not use the request token: got %q want %q",
+				field, tokens[0])
+		}
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	if tokens[0] != tokens[1] {
+		t.Fatalf("masked token changed within a request: got %q want %q",
+			tokens[1], tokens[0])
+	}
+}
+
+// TestWriteFormField tests that WriteFormField writes the same field as
+// TemplateField.
+func TestWriteFormField(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey))
+
+	var field string
+	var buf bytes.Buffer
+	var n int
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		field = string(TemplateField(c, r))
+
+		var err error
+		if n, err = WriteFormField(c, &buf); err != nil {
+			t.Fatal(err)
+		}
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	if buf.String() != field {
+		t.Fatalf("WriteFormField wrote the wrong field: got %q want %q", buf.String(), field)
+	}
+
+	if n != len(field) {
+		t.Fatalf("WriteFormField returned the wrong length: got %v want %v", n, len(field))
+	}
+}
+
+// TestHXHeaders tests that the hx-headers attribute holds valid JSON mapping the
+// configured request header to the token.
+func TestHXHeaders(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, RequestHeader("X-Token")))
+
+	var token, attr string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+		attr = string(HXHeaders(c))
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	value, ok := strings.CutPrefix(attr, `hx-headers='`)
+	if !ok || !strings.HasSuffix(value, `'`) {
+		t.Fatalf("hx-headers attribute not rendered correctly: got %v", attr)
+	}
+
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(strings.TrimSuffix(value, `'`)), &headers); err != nil {
+		t.Fatalf("hx-headers attribute is not valid JSON: %v", err)
+	}
+
+	if len(headers) != 1 || headers["X-Token"] != token {
+		t.Fatalf("hx-headers has the wrong header or token: got %v want %v",
+			headers, map[string]string{"X-Token": token})
+	}
+
+	if attr := string(HXHeaders(web.C{})); attr != `hx-headers='{"X-CSRF-Token":""}'` {
+		t.Fatalf("hx-headers without the middleware incorrect: got %v", attr)
+	}
+}
+
+// TestNonce tests that the nonce is stable within a request, unique across
+// requests, and distinct from the token.
+func TestNonce(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey))
+
+	var nonces []string
+	var token, attr string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		n := Nonce(c)
+		if again := Nonce(c); again != n {
+			t.Fatalf("nonce changed within a request: got %v want %v", again, n)
+		}
+		nonces = append(nonces, n)
+		token = Token(c, r)
+		attr = string(TemplateNonce(c))
+	}))
+
+	for i := 0; i < 2; i++ {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	if len(nonces) != 2 || nonces[0] == "" || nonces[0] == nonces[1] {
+		t.Fatalf("nonces not unique across requests: got %v", nonces)
+	}
+
+	if b, err := base64.StdEncoding.DecodeString(nonces[1]); err != nil || len(b) != 16 {
+		t.Fatalf("nonce is not 16 base64-encoded bytes: got %v (%v)", nonces[1], err)
+	}
+
+	if nonces[1] == token {
+		t.Fatal("nonce matches the CSRF token")
+	}
+
+	if expected := `nonce="` + nonces[1] + `"`; attr != expected {
+		t.Fatalf("nonce attribute incorrect: got %v want %v", attr, expected)
+	}
+
+	if n := Nonce(web.C{}); n != "" {
+		t.Fatalf("nonce without a request context: got %v want empty", n)
+	}
+}
+
+// TestIsProtected tests that IsProtected reflects whether the middleware
+// validated the request.
+func TestIsProtected(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, ExemptPath("/webhook")))
+
+	var token string
+	var protected bool
+	s.Handle("/*", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+		protected = IsProtected(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if protected {
+		t.Fatal("IsProtected true for a GET request")
+	}
+
+	var protectedTests = []struct {
+		path     string
+		expected bool
+	}{
+		{"/form", true},
+		{"/webhook", false},
+	}
+
+	for _, pt := range protectedTests {
+		r, err := http.NewRequest("POST", pt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		protected = !pt.expected
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		if protected != pt.expected {
+			t.Fatalf("IsProtected for a POST to %s incorrect: got %v want %v",
+				pt.path, protected, pt.expected)
+		}
+	}
+
+	if IsProtected(web.C{}, r) {
+		t.Fatal("IsProtected true without the middleware")
+	}
+}
+
+// TestHeaderName tests that HeaderName and FieldNameFor reflect the configured
+// request header and form field.
+func TestHeaderName(t *testing.T) {
+	var nameTests = []struct {
+		opts   []Option
+		header string
+		field  string
+	}{
+		{nil, headerName, fieldName},
+		{[]Option{RequestHeader("X-Token"), FieldName("token")}, "X-Token", "token"},
+		{[]Option{RequestHeaders("X-First", "X-Second")}, "X-First", fieldName},
+	}
+
+	for _, nt := range nameTests {
+		s := web.New()
+		s.Use(Protect(testKey, nt.opts...))
+
+		var header, field string
+		s.Handle("/config", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			header, field = HeaderName(c), FieldNameFor(c)
+		}))
+
+		r, err := http.NewRequest("GET", "/config", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		if header != nt.header || field != nt.field {
+			t.Fatalf("names incorrect: got %q, %q want %q, %q", header, field, nt.header, nt.field)
+		}
+	}
+
+	if header, field := HeaderName(web.C{}), FieldNameFor(web.C{}); header != headerName || field != fieldName {
+		t.Fatalf("names without the middleware incorrect: got %q, %q", header, field)
+	}
+}
+
+// TestIsLoopbackHost tests that only localhost and loopback IPs are loopback
+// hosts.
+func TestIsLoopbackHost(t *testing.T) {
+	var hostTests = []struct {
+		host     string
+		expected bool
+	}{
+		{"localhost", true},
+		{"LOCALHOST:8080", true},
+		{"app.localhost", true},
+		{"127.0.0.1", true},
+		{"127.1.2.3:5000", true},
+		{"[::1]:8080", true},
+		{"::1", true},
+		{"", false},
+		{"example.com", false},
+		{"localhost.example.com", false},
+		{"127.0.0.1.example.com", false},
+		{"192.0.2.1:5000", false},
+	}
+
+	for _, ht := range hostTests {
+		if got := isLoopbackHost(ht.host); got != ht.expected {
+			t.Fatalf("isLoopbackHost(%q) incorrect: got %v want %v", ht.host, got, ht.expected)
+		}
+	}
+}
+
+// TestBindMethod tests that method-bound tokens only validate for the method
+// they were issued for.
+func TestBindMethod(t *testing.T) {
+	for _, bind := range []bool{true, false} {
+		s := web.New()
+		s.Use(Protect(testKey, BindMethod(bind)))
+
+		var tokens map[string]string
+		s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			tokens = map[string]string{
+				"POST":   Token(c, r),
+				"DELETE": TokenForMethod(c, "delete"),
+			}
+		}))
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		for issued, token := range tokens {
+			for _, method := range []string{"POST", "DELETE"} {
+				r, err := http.NewRequest(method, "/", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				setCookie(rr, r)
+				r.Header.Set("X-CSRF-Token", token)
+
+				resp := httptest.NewRecorder()
+				s.ServeHTTP(resp, r)
+
+				expected := http.StatusOK
+				if bind && issued != method {
+					expected = http.StatusForbidden
+				}
+
+				if resp.Code != expected {
+					t.Fatalf("BindMethod(%v): %s token sent with %s: got %v want %v",
+						bind, issued, method, resp.Code, expected)
+				}
+			}
+		}
+	}
+
+	if token := TokenForMethod(web.C{}, "PUT"); token != "" {
+		t.Fatalf("TokenForMethod without the middleware: got %q want empty", token)
+	}
+}
+
+// TestSessionIDFunc tests that tokens only validate for the session they were
+// issued to.
+func TestSessionIDFunc(t *testing.T) {
+	sessionID := func(r *http.Request) string {
+		return r.Header.Get("X-Session")
+	}
+
+	var reason error
+	s := web.New()
+	s.Use(Protect(testKey, SessionIDFunc(sessionID),
+		ErrorHandler(web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(c, r)
+			w.WriteHeader(http.StatusForbidden)
+		}))))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	var sessionTests = []struct {
+		issued    string
+		validated string
+		expected  error
+	}{
+		{"alice", "alice", nil},
+		{"alice", "mallory", ErrTokenCookieMismatch},
+		{"alice", "", ErrTokenCookieMismatch},
+		// A token issued before login does not validate after it.
+		{"", "alice", ErrTokenCookieMismatch},
+		{"", "", nil},
+	}
+
+	for _, st := range sessionTests {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Session", st.issued)
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-Session", st.validated)
+		r.Header.Set("X-CSRF-Token", token)
+
+		reason = nil
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		if reason != st.expected {
+			t.Fatalf("token issued to %q, validated for %q: got %v want %v",
+				st.issued, st.validated, reason, st.expected)
+		}
+	}
+}
+
+// TestTokens tests that Tokens returns distinct masks that each validate.
+func TestTokens(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey))
+
+	var tokens []string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			tokens = Tokens(c, 5)
+		}
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if len(tokens) != 5 {
+		t.Fatalf("wrong number of tokens: got %v want %v", len(tokens), 5)
+	}
+
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		if seen[token] {
+			t.Fatalf("masked tokens are not distinct: got %q twice", token)
+		}
+		seen[token] = true
+
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("token %q failed validation: got %v want %v",
+				token, resp.Code, http.StatusOK)
+		}
+	}
+
+	if tokens := Tokens(web.C{}, 5); tokens != nil {
+		t.Fatalf("tokens returned without the middleware: got %v", tokens)
+	}
+}
+
+// TestTokenEncoding tests that tokens round-trip under a custom encoding,
+// including in a URL query parameter.
+func TestTokenEncoding(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, TokenEncoding(base64.RawURLEncoding), TokenFromQuery("csrf")))
+
+	var token string
+	var verified bool
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+		verified = VerifyToken(c, r, token)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if len(token) != base64.RawURLEncoding.EncodedLen(tokenLength*2) || strings.ContainsAny(token, "+/=") {
+		t.Fatalf("token not encoded with the custom encoding: got %q", token)
+	}
+
+	if !verified {
+		t.Fatal("VerifyToken rejected a token in the custom encoding")
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var encodingTests = []struct {
+		token    string
+		expected int
+	}{
+		{token, http.StatusOK},
+		// Tokens in the default encoding no longer validate.
+		{base64.StdEncoding.EncodeToString(decoded), http.StatusForbidden},
+	}
+
+	for _, et := range encodingTests {
+		r, err := http.NewRequest("POST", "/?csrf="+et.token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != et.expected {
+			t.Fatalf("token %q: middleware returned the wrong status: got %v want %v",
+				et.token, resp.Code, et.expected)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package csrf
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// maxInjectSize is the largest JSON response body that InjectTokenInJSON
+// buffers to insert the token into. Larger responses are written unmodified.
+const maxInjectSize = 1 << 20
+
+// jsonInjector is a http.ResponseWriter that buffers application/json
+// responses, so that the token can be inserted into a top-level JSON object once
+// the handler returns. Other responses are written through unmodified.
+type jsonInjector struct {
+	http.ResponseWriter
+	status int
+	// buffering is true while the response is buffered, and decided is true
+	// once the status and headers have been seen.
+	buffering bool
+	decided   bool
+	buf       bytes.Buffer
+}
+
+// WriteHeader buffers the status of JSON responses, and writes the status of
+// other responses through. Informational (1xx) responses - e.g. 103 Early
+// Hints - are written through, and the final status is decided later.
+func (ji *jsonInjector) WriteHeader(status int) {
+	if ji.decided {
+		return
+	}
+
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		ji.ResponseWriter.WriteHeader(status)
+		return
+	}
+	ji.decided = true
+	ji.status = status
+
+	mediaType, _, _ := mime.ParseMediaType(ji.Header().Get("Content-Type"))
+	ji.buffering = mediaType == "application/json" && ji.Header().Get("Content-Encoding") == "" &&
+		status != http.StatusNoContent && status != http.StatusNotModified
+	if !ji.buffering {
+		ji.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// Write buffers the body of JSON responses, up to maxInjectSize.
+func (ji *jsonInjector) Write(b []byte) (int, error) {
+	if !ji.decided {
+		ji.WriteHeader(http.StatusOK)
+	}
+
+	if !ji.buffering {
+		return ji.ResponseWriter.Write(b)
+	}
+
+	if ji.buf.Len()+len(b) > maxInjectSize {
+		if err := ji.passthrough(); err != nil {
+			return 0, err
+		}
+
+		return ji.ResponseWriter.Write(b)
+	}
+
+	return ji.buf.Write(b)
+}
+
+// Flush writes the buffered response unmodified - as it can no longer be
+// rewritten - and flushes the underlying writer.
+func (ji *jsonInjector) Flush() {
+	if ji.buffering {
+		ji.passthrough()
+	}
+
+	if f, ok := ji.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (ji *jsonInjector) Unwrap() http.ResponseWriter {
+	return ji.ResponseWriter
+}
+
+// passthrough stops buffering, writing the buffered response unmodified.
+func (ji *jsonInjector) passthrough() error {
+	ji.buffering = false
+	ji.ResponseWriter.WriteHeader(ji.status)
+	_, err := ji.buf.WriteTo(ji.ResponseWriter)
+	return err
+}
+
+// finish writes the buffered response, with the field set to token if the body
+// is a JSON object.
+func (ji *jsonInjector) finish(field, token string) error {
+	if !ji.buffering {
+		return nil
+	}
+
+	body := injectField(ji.buf.Bytes(), field, token)
+	ji.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	ji.ResponseWriter.WriteHeader(ji.status)
+	_, err := ji.ResponseWriter.Write(body)
+	return err
+}
+
+// injectField returns body with a field member set to value, if body is a JSON
+// object. Existing field members are replaced. Other bodies (including arrays
+// and invalid JSON) are returned as is.
+func injectField(body []byte, field, value string) []byte {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(trimmed) {
+		return body
+	}
+
+	member, err := json.Marshal(map[string]string{field: value})
+	if err != nil {
+		return body
+	}
+
+	// Insert the member - without its enclosing braces - at the start of the
+	// object, followed by the existing members other than field.
+	out := make([]byte, 0, len(trimmed)+len(member))
+	out = append(out, member[:len(member)-1]...)
+
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	if _, err := dec.Token(); err != nil {
+		return body
+	}
+
+	for dec.More() {
+		start := dec.InputOffset()
+		key, err := dec.Token()
+		if err != nil {
+			return body
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return body
+		}
+
+		if key == field {
+			continue
+		}
+
+		// The member's bytes, without the separator from the previous member.
+		out = append(out, ',')
+		out = append(out, bytes.TrimLeft(trimmed[start:dec.InputOffset()], ", \t\r\n")...)
+	}
+
+	return append(out, '}')
+}
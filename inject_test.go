@@ -0,0 +1,180 @@
+package csrf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+// TestInjectTokenInJSON checks that the token is inserted into JSON object
+// responses only.
+func TestInjectTokenInJSON(t *testing.T) {
+	var testTable = []struct {
+		name        string
+		contentType string
+		body        string
+		injected    bool
+	}{
+		{"object", "application/json", `{"name": "gopher"}`, true},
+		{"empty object", "application/json; charset=utf-8", ` { } `, true},
+		{"existing field", "application/json", `{"csrf_token": "stale", "name": "gopher"}`, true},
+		{"array", "application/json", `[{"name": "gopher"}]`, false},
+		{"invalid JSON", "application/json", `{"name": `, false},
+		{"not JSON", "text/html", `{"name": "gopher"}`, false},
+	}
+
+	for _, v := range testTable {
+		var token string
+		s := web.New()
+		s.Use(Protect(testKey, InjectTokenInJSON("csrf_token")))
+		s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			token = Token(c, r)
+			w.Header().Set("Content-Type", v.contentType)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(v.body))
+		}))
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("%s: middleware failed to pass through the status: got %v want %v",
+				v.name, rr.Code, http.StatusCreated)
+		}
+
+		if !v.injected {
+			if rr.Body.String() != v.body {
+				t.Fatalf("%s: body was modified: got %q want %q", v.name, rr.Body.String(), v.body)
+			}
+			continue
+		}
+
+		var got map[string]string
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: injected body is not valid JSON: %v (%q)", v.name, err, rr.Body.String())
+		}
+
+		if got["csrf_token"] != token {
+			t.Fatalf("%s: token not injected: got %q want %q", v.name, got["csrf_token"], token)
+		}
+
+		if n := strings.Count(rr.Body.String(), `"csrf_token"`); n != 1 {
+			t.Fatalf("%s: field injected incorrectly: got %d fields want 1 (%q)", v.name, n, rr.Body.String())
+		}
+
+		if cl := rr.Header().Get("Content-Length"); cl != strconv.Itoa(rr.Body.Len()) {
+			t.Fatalf("%s: bad Content-Length: got %v want %v", v.name, cl, rr.Body.Len())
+		}
+	}
+}
+
+// TestInjectTokenInJSONLimit checks that responses larger than maxInjectSize
+// are written unmodified.
+func TestInjectTokenInJSONLimit(t *testing.T) {
+	body := `{"data": "` + strings.Repeat("a", maxInjectSize) + `"}`
+
+	s := web.New()
+	s.Use(Protect(testKey, InjectTokenInJSON("csrf_token")))
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body[:len(body)/2]))
+		w.Write([]byte(body[len(body)/2:]))
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Body.String() != body {
+		t.Fatalf("large body was modified: got %d bytes want %d bytes", rr.Body.Len(), len(body))
+	}
+}
+
+// informationalRecorder is a ResponseRecorder that records informational (1xx)
+// statuses separately from the final status.
+type informationalRecorder struct {
+	*httptest.ResponseRecorder
+	informational []int
+}
+
+func (ir *informationalRecorder) WriteHeader(status int) {
+	if status >= 100 && status < 200 {
+		ir.informational = append(ir.informational, status)
+		return
+	}
+
+	ir.ResponseRecorder.WriteHeader(status)
+}
+
+// TestInjectTokenInJSONInformational checks that informational responses are
+// written through, and the token inserted into the final response.
+func TestInjectTokenInJSONInformational(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, InjectTokenInJSON("csrf_token")))
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</app.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"name": "gopher"}`))
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := &informationalRecorder{ResponseRecorder: httptest.NewRecorder()}
+	s.ServeHTTP(rr, r)
+
+	if len(rr.informational) != 1 || rr.informational[0] != http.StatusEarlyHints {
+		t.Fatalf("informational status not written: got %v want [%v]",
+			rr.informational, http.StatusEarlyHints)
+	}
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("final status not written: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	if !strings.Contains(rr.Body.String(), `"csrf_token"`) {
+		t.Fatalf("token not injected: got %q", rr.Body.String())
+	}
+}
+
+// TestInjectTokenInJSONHead checks that responses to HEAD requests are written
+// unmodified.
+func TestInjectTokenInJSONHead(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, InjectTokenInJSON("csrf_token")))
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "18")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	r, err := http.NewRequest("HEAD", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if cl := rr.Header().Get("Content-Length"); cl != "18" {
+		t.Fatalf("HEAD Content-Length modified: got %q want %q", cl, "18")
+	}
+}
@@ -0,0 +1,112 @@
+package csrf
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// keyCacheTTL is how long the key set returned by a KeyFunc is cached for.
+const keyCacheTTL = time.Minute
+
+// errNoKeys is returned when a KeyFunc returns an empty key set.
+var errNoKeys = errors.New("KeyFunc returned no keys")
+
+// minKeyLength is the minimum recommended length of an authentication key.
+const minKeyLength = 32
+
+// checkKey returns an error if key is too short to be used as an authentication
+// key. Keys of 16 and 24 bytes are accepted for compatibility with existing
+// deployments, but at least 32 bytes are recommended.
+func checkKey(key []byte) error {
+	switch n := len(key); {
+	case n == 0:
+		return errors.New("authentication key cannot be empty")
+	case n >= minKeyLength, n == 16, n == 24:
+		return nil
+	default:
+		return fmt.Errorf("authentication key is %d bytes: it must be at least %d bytes",
+			n, minKeyLength)
+	}
+}
+
+// Codec encodes and decodes the value of the CSRF cookie - see WithCodec. It has
+// the same method set as securecookie.Codec, so a *securecookie.SecureCookie is
+// a Codec.
+type Codec interface {
+	// Encode returns the authenticated cookie value for the named cookie's
+	// value, a []byte token.
+	Encode(name string, value interface{}) (string, error)
+	// Decode authenticates the named cookie's value and decodes it into dst, a
+	// *[]byte. It returns an error if the value cannot be authenticated.
+	Decode(name, value string, dst interface{}) error
+}
+
+// newCodecs returns an authenticated securecookie codec for each of the keys,
+// in the same order.
+func newCodecs(keys [][]byte) []securecookie.Codec {
+	codecs := make([]securecookie.Codec, 0, len(keys))
+	for _, key := range keys {
+		sc := securecookie.New(key, nil)
+		// Use JSON serialization (faster than one-off gob encoding)
+		sc.SetSerializer(securecookie.JSONEncoder{})
+		// The cookieStore enforces the MaxAge against its own clock, in
+		// place of the underlying securecookie.
+		sc.MaxAge(0)
+		// The cookieStore enforces the length limit against the full
+		// cookie, with a descriptive error.
+		sc.MaxLength(0)
+		codecs = append(codecs, sc)
+	}
+
+	return codecs
+}
+
+// keyRing caches the codecs for the key set returned by a KeyFunc, fetching
+// the keys again once the cache expires.
+type keyRing struct {
+	fn  func() ([][]byte, error)
+	now func() time.Time
+
+	mu      sync.Mutex
+	codecs  []securecookie.Codec
+	fetched time.Time
+}
+
+// get returns the codecs for the current key set, newest first. If the key set
+// cannot be refreshed, the previous key set continues to be used until the next
+// attempt so that a KMS outage doesn't invalidate every token.
+func (kr *keyRing) get() ([]securecookie.Codec, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	now := kr.now()
+	if kr.codecs != nil && now.Sub(kr.fetched) < keyCacheTTL {
+		return kr.codecs, nil
+	}
+
+	keys, err := kr.fn()
+	if err == nil && len(keys) == 0 {
+		err = errNoKeys
+	}
+	for _, key := range keys {
+		if err == nil {
+			err = checkKey(key)
+		}
+	}
+	if err != nil {
+		if kr.codecs != nil {
+			kr.fetched = now
+			return kr.codecs, nil
+		}
+
+		return nil, err
+	}
+
+	kr.codecs = newCodecs(keys)
+	kr.fetched = now
+	return kr.codecs, nil
+}
@@ -0,0 +1,362 @@
+package csrf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// TestKeyFunc tests that keys from a KeyFunc are refreshed once the cache
+// expires, allowing keys to be rotated without restarting.
+func TestKeyFunc(t *testing.T) {
+	clock := time.Now()
+	oldKey := []byte("keep-it-secret-keep-it-safe-----")
+	newKey := []byte("a-brand-new-key-from-the-kms----")
+
+	var calls int
+	keys := [][]byte{oldKey}
+	keyFunc := func() ([][]byte, error) {
+		calls++
+		return keys, nil
+	}
+
+	s := web.New()
+	s.Use(Protect(nil, KeyFunc(keyFunc), setClock(func() time.Time { return clock })))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	post := func() int {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+		return resp.Code
+	}
+
+	var keyTests = []struct {
+		keys     [][]byte
+		advance  time.Duration
+		expected int
+		calls    int
+	}{
+		// Cached: the KMS is not called again.
+		{[][]byte{newKey}, time.Second, http.StatusOK, 1},
+		// Rotated, with the old key still accepted.
+		{[][]byte{newKey, oldKey}, keyCacheTTL, http.StatusOK, 2},
+		// The old key has been retired.
+		{[][]byte{newKey}, keyCacheTTL, http.StatusForbidden, 3},
+	}
+
+	for i, kt := range keyTests {
+		keys = kt.keys
+		clock = clock.Add(kt.advance)
+
+		if code := post(); code != kt.expected {
+			t.Fatalf("#%d: middleware returned the wrong status: got %v want %v",
+				i, code, kt.expected)
+		}
+
+		if calls != kt.calls {
+			t.Fatalf("#%d: KeyFunc called the wrong number of times: got %v want %v",
+				i, calls, kt.calls)
+		}
+	}
+}
+
+// TestKeyFuncError tests that the previous keys are used if the KeyFunc fails.
+func TestKeyFuncError(t *testing.T) {
+	var clock time.Time
+	kr := &keyRing{now: func() time.Time { return clock }}
+
+	kr.fn = func() ([][]byte, error) { return nil, errors.New("kms unavailable") }
+	if _, err := kr.get(); err == nil {
+		t.Fatal("keyRing did not return an error without any keys")
+	}
+
+	kr.fn = func() ([][]byte, error) { return [][]byte{testKey}, nil }
+	codecs, err := kr.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fn := range []func() ([][]byte, error){
+		func() ([][]byte, error) { return nil, errors.New("kms unavailable") },
+		func() ([][]byte, error) { return nil, nil },
+	} {
+		kr.fn = fn
+		clock = clock.Add(keyCacheTTL)
+		stale, err := kr.get()
+		if err != nil {
+			t.Fatalf("keyRing did not fall back to the previous keys: %v", err)
+		}
+
+		if len(stale) != 1 || stale[0] != codecs[0] {
+			t.Fatalf("keyRing returned the wrong keys: got %v want %v", stale, codecs)
+		}
+	}
+}
+
+// TestProtectKeyLength tests that Protect rejects empty and short keys.
+func TestProtectKeyLength(t *testing.T) {
+	var keyTests = []struct {
+		length int
+		valid  bool
+	}{
+		{0, false},
+		{8, false},
+		{16, true},
+		{20, false},
+		{24, true},
+		{31, false},
+		{32, true},
+		{64, true},
+	}
+
+	for _, kt := range keyTests {
+		var key []byte
+		if kt.length > 0 {
+			key = bytes.Repeat([]byte("k"), kt.length)
+		}
+
+		func() {
+			defer func() {
+				if r := recover(); (r == nil) != kt.valid {
+					t.Errorf("%d byte key: got panic %v, want valid %v", kt.length, r, kt.valid)
+				}
+			}()
+
+			s := web.New()
+			s.Use(Protect(key))
+			s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+
+	for _, key := range [][]byte{nil, []byte("short")} {
+		if _, err := parseOptions(nil, RotationKeys([][]byte{key})); err == nil {
+			t.Errorf("parseOptions did not reject rotation key %q", key)
+		}
+	}
+}
+
+// TestDocumentedKeys tests that the example keys in the README and package docs
+// are accepted by New, so that copied examples do not panic.
+func TestDocumentedKeys(t *testing.T) {
+	example := regexp.MustCompile(`(?:Protect(?:HTTP)?|Interceptor)\(\[\]byte\("([^"]*)"\)`)
+	for _, file := range []string{"README.md", "csrf.go", "nethttp.go"} {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matches := example.FindAllSubmatch(b, -1)
+		if len(matches) == 0 {
+			t.Fatalf("%s: no example keys found", file)
+		}
+
+		for _, m := range matches {
+			if _, err := New(m[1]); err != nil {
+				t.Errorf("%s: example key %q rejected: %v", file, m[1], err)
+			}
+		}
+	}
+}
+
+// memoryCodec is a Codec that stores values in memory, keyed by an opaque ID.
+type memoryCodec struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (mc *memoryCodec) Encode(name string, value interface{}) (string, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	id := fmt.Sprintf("%s-%d", name, len(mc.values))
+	mc.values[id] = append([]byte(nil), value.([]byte)...)
+	return id, nil
+}
+
+func (mc *memoryCodec) Decode(name, value string, dst interface{}) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	token, ok := mc.values[value]
+	if !ok {
+		return errors.New("unknown cookie value")
+	}
+
+	*dst.(*[]byte) = token
+	return nil
+}
+
+// TestWithCodec tests that a custom codec encodes and decodes the cookie.
+func TestWithCodec(t *testing.T) {
+	mc := &memoryCodec{values: make(map[string][]byte)}
+	s := web.New()
+	s.Use(Protect(nil, WithCodec(mc)))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != cookieName+"-0" {
+		t.Fatalf("cookie not encoded with the custom codec: got %v", cookies)
+	}
+
+	var codecTests = []struct {
+		cookie   string
+		expected int
+	}{
+		{cookies[0].Value, http.StatusOK},
+		{"tampered", http.StatusForbidden},
+	}
+
+	for _, ct := range codecTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.AddCookie(&http.Cookie{Name: cookieName, Value: ct.cookie})
+		r.Header.Set("X-CSRF-Token", token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != ct.expected {
+			t.Fatalf("cookie %q: middleware returned the wrong status: got %v want %v",
+				ct.cookie, resp.Code, ct.expected)
+		}
+	}
+
+	for _, opts := range [][]Option{
+		{WithCodec()},
+		{WithCodec(nil)},
+		{WithCodec(mc), Mode(ModeDoubleSubmit)},
+		{WithCodec(mc), KeyFunc(func() ([][]byte, error) { return nil, nil })},
+	} {
+		if _, err := New(nil, opts...); err == nil {
+			t.Errorf("New did not reject invalid codec options %v", opts)
+		}
+	}
+}
+
+// TestLegacyCodec tests that tokens in legacy cookies validate, and that their
+// cookie is re-saved in the current format by state-changing requests.
+func TestLegacyCodec(t *testing.T) {
+	realToken, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc := &memoryCodec{values: map[string][]byte{"legacy": realToken}}
+	s := web.New()
+	s.Use(Protect(testKey, LegacyCodec(mc)))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddCookie(&http.Cookie{Name: cookieName, Value: "legacy"})
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if cookie := rr.Header().Get("Set-Cookie"); cookie != "" {
+		t.Fatalf("legacy cookie re-saved by a safe request: got %q", cookie)
+	}
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddCookie(&http.Cookie{Name: cookieName, Value: "legacy"})
+	r.Header.Set("X-CSRF-Token", token)
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("legacy token rejected: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("legacy cookie not upgraded: got %d cookies want 1", len(cookies))
+	}
+
+	var upgraded []byte
+	if err := newCodecs([][]byte{testKey})[0].Decode(cookieName, cookies[0].Value, &upgraded); err != nil {
+		t.Fatalf("upgraded cookie not in the current format: %v", err)
+	}
+
+	if !bytes.Equal(upgraded, realToken) {
+		t.Fatalf("upgraded cookie has the wrong token: got %x want %x", upgraded, realToken)
+	}
+
+	// The upgraded cookie validates without the legacy codec, and is not
+	// re-saved again.
+	s = web.New()
+	s.Use(Protect(testKey))
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {}))
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddCookie(cookies[0])
+	r.Header.Set("X-CSRF-Token", token)
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("upgraded token: got %v (cookie %q) want %v (no cookie)",
+			rr.Code, rr.Header().Get("Set-Cookie"), http.StatusOK)
+	}
+
+	if _, err := New(testKey, LegacyCodec(nil)); err == nil {
+		t.Fatal("New did not reject a nil legacy codec")
+	}
+}
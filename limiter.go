@@ -0,0 +1,106 @@
+package csrf
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TokenIssueLimiter decides whether a request may be issued a new token - see
+// WithIssueLimiter. Implementations must be safe for concurrent use.
+type TokenIssueLimiter interface {
+	// Allow reports whether a new token may be issued to the request.
+	Allow(r *http.Request) bool
+}
+
+// IPLimiter is a TokenIssueLimiter that allows each client IP address a burst of
+// new tokens, refilled at a steady rate (a token bucket).
+//
+// The client IP is taken from the request's RemoteAddr: behind a reverse proxy,
+// set RemoteAddr from the proxy's headers before the middleware.
+type IPLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	// sweep is when idle buckets are next removed.
+	sweep time.Time
+}
+
+// bucket holds the tokens remaining for an IP address, as of last.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewIPLimiter returns an IPLimiter that allows each IP address up to burst new
+// tokens at once, refilling at rate tokens per second. It panics if rate or
+// burst is not positive, as such a limiter would deny every request.
+func NewIPLimiter(rate float64, burst int) *IPLimiter {
+	if !(rate > 0) {
+		panic("IPLimiter rate must be positive")
+	}
+
+	if burst <= 0 {
+		panic("IPLimiter burst must be positive")
+	}
+
+	return &IPLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow reports whether the request's IP address has a token remaining, and
+// takes it if so. It implements TokenIssueLimiter.
+func (l *IPLimiter) Allow(r *http.Request) bool {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Remove buckets that have refilled - which are equivalent to a new bucket -
+	// at most once a minute.
+	if now.After(l.sweep) {
+		for key, b := range l.buckets {
+			if l.refill(b, now) >= l.burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.sweep = now.Add(time.Minute)
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+
+	b.tokens, b.last = l.refill(b, now), now
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// refill returns the tokens in bucket b as of now, up to the burst.
+func (l *IPLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		return l.burst
+	}
+
+	return tokens
+}
@@ -0,0 +1,140 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Check TokenIssueLimiter implementations
+var _ TokenIssueLimiter = &IPLimiter{}
+
+// countLimiter allows the first n calls.
+type countLimiter struct {
+	n     int
+	calls int
+}
+
+func (l *countLimiter) Allow(r *http.Request) bool {
+	l.calls++
+	return l.calls <= l.n
+}
+
+// TestIssueLimiter tests that new tokens are not issued once the limiter denies
+// them, and that denied requests are rejected if configured.
+func TestIssueLimiter(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		limiter := &countLimiter{n: 2}
+		s := web.New()
+		s.Use(Protect(testKey, WithIssueLimiter(limiter, reject)))
+		s.Handle("/", testHandler)
+
+		var rr *httptest.ResponseRecorder
+		for i, allowed := range []bool{true, true, false} {
+			r, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, r)
+
+			expected := http.StatusOK
+			if !allowed && reject {
+				expected = http.StatusTooManyRequests
+			}
+
+			if resp.Code != expected {
+				t.Fatalf("reject %v, request #%d: got %v want %v", reject, i, resp.Code, expected)
+			}
+
+			if issued := resp.Header().Get("Set-Cookie") != ""; issued != allowed {
+				t.Fatalf("reject %v, request #%d: cookie issued %v want %v", reject, i, issued, allowed)
+			}
+
+			if allowed {
+				rr = resp
+			}
+		}
+
+		// Requests with a valid cookie don't consult the limiter.
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != http.StatusOK || limiter.calls != 3 {
+			t.Fatalf("reject %v: limited a request with a valid cookie: got %v (%d calls)",
+				reject, resp.Code, limiter.calls)
+		}
+	}
+}
+
+// TestIPLimiter tests that each IP address is allowed a burst of tokens,
+// refilled over time.
+func TestIPLimiter(t *testing.T) {
+	clock := time.Now()
+	l := NewIPLimiter(1, 2)
+	l.now = func() time.Time { return clock }
+
+	allow := func(addr string) bool {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		return l.Allow(r)
+	}
+
+	var limitTests = []struct {
+		addr     string
+		advance  time.Duration
+		expected bool
+	}{
+		{"192.0.2.1:1234", 0, true},
+		{"192.0.2.1:5678", 0, true},
+		{"192.0.2.1:1234", 0, false},
+		// Other addresses have their own bucket.
+		{"192.0.2.2:1234", 0, true},
+		{"192.0.2.1:1234", 500 * time.Millisecond, false},
+		{"192.0.2.1:1234", 500 * time.Millisecond, true},
+		{"192.0.2.1:1234", 0, false},
+	}
+
+	for i, lt := range limitTests {
+		clock = clock.Add(lt.advance)
+		if allowed := allow(lt.addr); allowed != lt.expected {
+			t.Fatalf("#%d: Allow(%s): got %v want %v", i, lt.addr, allowed, lt.expected)
+		}
+	}
+}
+
+// TestIPLimiterInvalid tests that NewIPLimiter rejects rates and bursts that
+// would deny every request.
+func TestIPLimiterInvalid(t *testing.T) {
+	var invalidTests = []struct {
+		rate  float64
+		burst int
+	}{
+		{0, 1},
+		{-1, 1},
+		{1, 0},
+		{1, -1},
+	}
+
+	for _, it := range invalidTests {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("NewIPLimiter(%v, %v) did not panic", it.rate, it.burst)
+				}
+			}()
+
+			NewIPLimiter(it.rate, it.burst)
+		}()
+	}
+}
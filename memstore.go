@@ -0,0 +1,152 @@
+package csrf
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoSession is returned by the InMemoryStore when a request does not
+	// have a session ID. The middleware serves safe requests without a session
+	// without saving a token, and fails unsafe requests with ErrNoSession.
+	ErrNoSession = errors.New("session ID not found in request")
+	// errTokenNotFound is returned when a session does not have a (current)
+	// token.
+	errTokenNotFound = errors.New("token not found for session")
+)
+
+// InMemoryStore is a server-side Store that keeps tokens in memory, keyed by a
+// session ID supplied by the caller - e.g. the ID of the user's existing
+// session. Unlike the default cookie store, tokens can be revoked explicitly.
+//
+// Note that tokens are not shared between processes, and are lost on restart.
+// Requests without a session ID fail CSRF validation.
+type InMemoryStore struct {
+	sessionID func(r *http.Request) string
+	ttl       time.Duration
+	done      chan struct{}
+	once      sync.Once
+
+	mu     sync.RWMutex
+	tokens map[string]memoryToken
+}
+
+// memoryToken is a token stored in an InMemoryStore.
+type memoryToken struct {
+	token   []byte
+	expires time.Time
+}
+
+// NewInMemoryStore returns an InMemoryStore that keys tokens by the session ID
+// returned by sessionID. Tokens expire after ttl (defaulting to 12 hours), and a
+// background goroutine removes expired tokens at the same interval: call Close
+// to stop it.
+func NewInMemoryStore(ttl time.Duration, sessionID func(r *http.Request) string) *InMemoryStore {
+	if ttl <= 0 {
+		ttl = 12 * time.Hour
+	}
+
+	ms := &InMemoryStore{
+		sessionID: sessionID,
+		ttl:       ttl,
+		done:      make(chan struct{}),
+		tokens:    make(map[string]memoryToken),
+	}
+
+	go ms.sweep()
+
+	return ms
+}
+
+// Get returns the token for the request's session.
+func (ms *InMemoryStore) Get(r *http.Request) ([]byte, error) {
+	id := ms.sessionID(r)
+	if id == "" {
+		return nil, ErrNoSession
+	}
+
+	ms.mu.RLock()
+	t, ok := ms.tokens[id]
+	ms.mu.RUnlock()
+
+	if !ok || time.Now().After(t.expires) {
+		return nil, errTokenNotFound
+	}
+
+	return t.token, nil
+}
+
+// Save always returns ErrNoSession, as tokens must be saved against a session:
+// the middleware calls SaveSession instead.
+func (ms *InMemoryStore) Save(token []byte, w http.ResponseWriter) error {
+	return ErrNoSession
+}
+
+// SaveSession stores the token against the request's session, replacing any
+// existing token.
+func (ms *InMemoryStore) SaveSession(r *http.Request, token []byte, w http.ResponseWriter) error {
+	return ms.SaveKey(ms.sessionID(r), token)
+}
+
+// SaveKey stores the token against the given session, replacing any existing
+// token. It implements KeyedStore.
+func (ms *InMemoryStore) SaveKey(sessionID string, token []byte) error {
+	if sessionID == "" {
+		return ErrNoSession
+	}
+
+	ms.mu.Lock()
+	ms.tokens[sessionID] = memoryToken{token: token, expires: time.Now().Add(ms.ttl)}
+	ms.mu.Unlock()
+
+	return nil
+}
+
+// Revoke deletes the token for the given session - e.g. on logout. A new token
+// is issued on the session's next request.
+func (ms *InMemoryStore) Revoke(sessionID string) {
+	ms.mu.Lock()
+	delete(ms.tokens, sessionID)
+	ms.mu.Unlock()
+}
+
+// Clear deletes the token for the request's session. It implements ClearStore.
+func (ms *InMemoryStore) Clear(r *http.Request, w http.ResponseWriter) error {
+	id := ms.sessionID(r)
+	if id == "" {
+		return ErrNoSession
+	}
+
+	ms.Revoke(id)
+	return nil
+}
+
+// Close stops the background goroutine that removes expired tokens.
+func (ms *InMemoryStore) Close() {
+	ms.once.Do(func() {
+		close(ms.done)
+	})
+}
+
+// sweep periodically removes expired tokens until the store is closed.
+func (ms *InMemoryStore) sweep() {
+	ticker := time.NewTicker(ms.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ms.done:
+			return
+		case now := <-ticker.C:
+			ms.mu.Lock()
+			for id, t := range ms.tokens {
+				if now.After(t.expires) {
+					delete(ms.tokens, id)
+				}
+			}
+			ms.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package csrf
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Check SessionStore implementations
+var _ SessionStore = &InMemoryStore{}
+var _ ClearStore = &InMemoryStore{}
+var _ KeyedStore = &InMemoryStore{}
+
+// testSessionID returns the session ID from the "session" cookie.
+func testSessionID(r *http.Request) string {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+// newSessionRequest returns a request with the given session ID.
+func newSessionRequest(t testing.TB, method string, id string) *http.Request {
+	r, err := http.NewRequest(method, "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddCookie(&http.Cookie{Name: "session", Value: id})
+	return r
+}
+
+// TestInMemoryStore tests that tokens are saved against the session, validate
+// and can be revoked.
+func TestInMemoryStore(t *testing.T) {
+	ms := NewInMemoryStore(time.Hour, testSessionID)
+	defer ms.Close()
+
+	s := web.New()
+	s.Use(Protect(testKey, SetStore(ms)))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, newSessionRequest(t, "GET", "alice"))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+
+	if c := rr.Header().Get("Set-Cookie"); c != "" {
+		t.Fatalf("in-memory store set a cookie: got %q", c)
+	}
+
+	// post submits the token for the given session and returns the status.
+	post := func(id string) int {
+		r := newSessionRequest(t, "POST", id)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	if code := post("alice"); code != http.StatusOK {
+		t.Fatalf("token failed validation: got %v want %v", code, http.StatusOK)
+	}
+
+	if code := post("mallory"); code != http.StatusForbidden {
+		t.Fatalf("token validated for another session: got %v want %v",
+			code, http.StatusForbidden)
+	}
+
+	ms.Revoke("alice")
+	if code := post("alice"); code != http.StatusForbidden {
+		t.Fatalf("revoked token passed validation: got %v want %v",
+			code, http.StatusForbidden)
+	}
+}
+
+// TestInMemoryStoreNoSession tests that requests without a session ID fail.
+func TestInMemoryStoreNoSession(t *testing.T) {
+	ms := NewInMemoryStore(time.Hour, testSessionID)
+	defer ms.Close()
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ms.Get(r); err != ErrNoSession {
+		t.Fatalf("Get without a session: got %v want %v", err, ErrNoSession)
+	}
+
+	if err := ms.SaveSession(r, []byte("token"), httptest.NewRecorder()); err != ErrNoSession {
+		t.Fatalf("SaveSession without a session: got %v want %v", err, ErrNoSession)
+	}
+}
+
+// TestInMemoryStoreExpiry tests that tokens expire after the TTL and are
+// removed by the background sweep.
+func TestInMemoryStoreExpiry(t *testing.T) {
+	ttl := 10 * time.Millisecond
+	ms := NewInMemoryStore(ttl, testSessionID)
+	defer ms.Close()
+
+	r := newSessionRequest(t, "GET", "alice")
+	if err := ms.SaveSession(r, []byte("token"), httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ms.Get(r); err != nil {
+		t.Fatalf("token not found before expiry: %v", err)
+	}
+
+	time.Sleep(ttl * 5)
+
+	if _, err := ms.Get(r); err == nil {
+		t.Fatal("token found after expiry")
+	}
+
+	ms.mu.RLock()
+	n := len(ms.tokens)
+	ms.mu.RUnlock()
+
+	if n != 0 {
+		t.Fatalf("expired tokens not swept: got %d tokens want %d", n, 0)
+	}
+}
+
+// TestInMemoryStoreConcurrent tests concurrent calls to Get and SaveSession.
+func TestInMemoryStoreConcurrent(t *testing.T) {
+	ms := NewInMemoryStore(time.Hour, testSessionID)
+	defer ms.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			r := newSessionRequest(t, "GET", fmt.Sprintf("session-%d", i%10))
+			token := []byte(fmt.Sprintf("token-%d", i%10))
+			if err := ms.SaveSession(r, token, httptest.NewRecorder()); err != nil {
+				t.Error(err)
+				return
+			}
+
+			got, err := ms.Get(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if string(got) != string(token) {
+				t.Errorf("token for session mismatched: got %q want %q", got, token)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func BenchmarkInMemoryStoreGet(b *testing.B) {
+	ms := NewInMemoryStore(time.Hour, testSessionID)
+	defer ms.Close()
+
+	r := newSessionRequest(b, "GET", "alice")
+	if err := ms.SaveSession(r, []byte("token"), nil); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := ms.Get(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkInMemoryStoreSave(b *testing.B) {
+	ms := NewInMemoryStore(time.Hour, testSessionID)
+	defer ms.Close()
+
+	r := newSessionRequest(b, "GET", "alice")
+	token := []byte("token")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := ms.SaveSession(r, token, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestInMemoryStoreAnonymous tests that safe requests without a session are
+// served without a token, and that unsafe requests without one fail.
+func TestInMemoryStoreAnonymous(t *testing.T) {
+	ms := NewInMemoryStore(time.Hour, testSessionID)
+	defer ms.Close()
+
+	var reason error
+	s := web.New()
+	s.Use(Protect(testKey, SetStore(ms), OnFailure(
+		func(c web.C, r *http.Request, err error) { reason = err })))
+	s.Handle("/", testHandler)
+
+	var anonymousTests = []struct {
+		method   string
+		expected int
+	}{
+		{"GET", http.StatusOK},
+		{"POST", http.StatusForbidden},
+	}
+
+	for _, at := range anonymousTests {
+		r, err := http.NewRequest(at.method, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reason = nil
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != at.expected {
+			t.Fatalf("anonymous %s: got %v (%v) want %v", at.method, rr.Code, reason, at.expected)
+		}
+	}
+}
+
+// TestIssue tests that a token issued outside of a request validates on a later
+// request from the same session.
+func TestIssue(t *testing.T) {
+	ms := NewInMemoryStore(time.Hour, testSessionID)
+	defer ms.Close()
+
+	token, err := Issue(ms, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := web.New()
+	s.Use(Protect(testKey, SetStore(ms)))
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {}))
+
+	var issueTests = []struct {
+		session  string
+		expected int
+	}{
+		{"alice", http.StatusOK},
+		{"bob", http.StatusForbidden},
+	}
+
+	for _, it := range issueTests {
+		r := newSessionRequest(t, "POST", it.session)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != it.expected {
+			t.Fatalf("session %q: middleware returned the wrong status: got %v want %v",
+				it.session, rr.Code, it.expected)
+		}
+	}
+
+	if _, err := Issue(ms, ""); err != ErrNoSession {
+		t.Fatalf("Issue did not reject an empty session ID: got %v want %v", err, ErrNoSession)
+	}
+
+	if _, err := Issue(&cookieStore{}, "alice"); err == nil {
+		t.Fatal("Issue did not return an error for a store without keyed saves")
+	}
+}
+
+// TestIssueOptions tests that tokens issued with the middleware's options
+// validate when it sets a TokenLength, TokenEncoding, SessionIDFunc or
+// BindMethod.
+func TestIssueOptions(t *testing.T) {
+	for _, opts := range [][]Option{
+		{TokenLength(48)},
+		{TokenEncoding(base64.RawURLEncoding)},
+		{SessionIDFunc(testSessionID), BindMethod(true)},
+	} {
+		ms := NewInMemoryStore(time.Hour, testSessionID)
+		defer ms.Close()
+
+		token, err := Issue(ms, "alice", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := web.New()
+		s.Use(Protect(testKey, append(opts, SetStore(ms))...))
+		s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {}))
+
+		r := newSessionRequest(t, "POST", "alice")
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("token issued with %d options rejected: got %v want %v",
+				len(opts), rr.Code, http.StatusOK)
+		}
+	}
+
+	ms := NewInMemoryStore(time.Hour, testSessionID)
+	defer ms.Close()
+
+	if _, err := Issue(ms, "alice", TokenLength(8)); err == nil {
+		t.Fatal("Issue did not reject invalid options")
+	}
+}
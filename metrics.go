@@ -0,0 +1,58 @@
+package csrf
+
+import "errors"
+
+// Metrics receives counts of the tokens issued and the requests validated by
+// the middleware - e.g. to export them as Prometheus counters - without this
+// package depending on a metrics library. Implementations must be safe for
+// concurrent use.
+type Metrics interface {
+	// IncIssued is called each time a new token is issued.
+	IncIssued()
+	// IncValidated is called each time an unsafe request passes validation.
+	IncValidated()
+	// IncFailed is called each time a request fails, with a short, fixed label
+	// for the reason: one of "no_referer", "bad_referer", "no_origin",
+	// "bad_origin", "no_cookie", "no_token", "token_mismatch", "bad_token",
+	// "domain_mismatch", "multiple_tokens", "token_reused", or "error" for any
+	// other error (such as a store failure).
+	IncFailed(reason string)
+}
+
+// noopMetrics is the default Metrics implementation, which discards the counts.
+type noopMetrics struct{}
+
+func (noopMetrics) IncIssued()       {}
+func (noopMetrics) IncValidated()    {}
+func (noopMetrics) IncFailed(string) {}
+
+// failureLabels maps each failure reason to its label, for IncFailed.
+var failureLabels = []struct {
+	err   error
+	label string
+}{
+	// ErrNoOrigin wraps ErrNoReferer, so must be matched first.
+	{ErrNoOrigin, "no_origin"},
+	{ErrNoReferer, "no_referer"},
+	{ErrBadReferer, "bad_referer"},
+	{ErrBadOrigin, "bad_origin"},
+	{ErrNoCookie, "no_cookie"},
+	{ErrNoToken, "no_token"},
+	// ErrTokenCookieMismatch wraps ErrBadToken, so must be matched first.
+	{ErrTokenCookieMismatch, "token_mismatch"},
+	{ErrBadToken, "bad_token"},
+	{ErrDomainMismatch, "domain_mismatch"},
+	{ErrMultipleTokens, "multiple_tokens"},
+	{ErrTokenReused, "token_reused"},
+}
+
+// failureLabel returns the IncFailed label for the failure reason err.
+func failureLabel(err error) string {
+	for _, fl := range failureLabels {
+		if errors.Is(err, fl.err) {
+			return fl.label
+		}
+	}
+
+	return "error"
+}
@@ -0,0 +1,102 @@
+package csrf
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+// countingMetrics counts each event reported to it.
+type countingMetrics struct {
+	issued    int
+	validated int
+	failed    map[string]int
+}
+
+func (m *countingMetrics) IncIssued()    { m.issued++ }
+func (m *countingMetrics) IncValidated() { m.validated++ }
+func (m *countingMetrics) IncFailed(reason string) {
+	m.failed[reason]++
+}
+
+// TestMetrics tests that the middleware reports each event to the Metrics
+// implementation.
+func TestMetrics(t *testing.T) {
+	m := &countingMetrics{failed: make(map[string]int)}
+	s := web.New()
+	s.Use(Protect(testKey, WithMetrics(m)))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	for _, header := range []string{token, "", "bad-token"} {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		if header != "" {
+			r.Header.Set("X-CSRF-Token", header)
+		}
+
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// A request without a cookie is issued a new token, and fails.
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	if m.issued != 2 {
+		t.Errorf("wrong number of tokens issued: got %v want %v", m.issued, 2)
+	}
+
+	if m.validated != 1 {
+		t.Errorf("wrong number of requests validated: got %v want %v", m.validated, 1)
+	}
+
+	for reason, expected := range map[string]int{"no_token": 1, "bad_token": 1, "no_cookie": 1} {
+		if m.failed[reason] != expected {
+			t.Errorf("wrong number of %q failures: got %v want %v",
+				reason, m.failed[reason], expected)
+		}
+	}
+}
+
+// TestFailureLabel tests that wrapped failure reasons map to their label.
+func TestFailureLabel(t *testing.T) {
+	var labelTests = []struct {
+		err      error
+		expected string
+	}{
+		{ErrBadOrigin, "bad_origin"},
+		{ErrNoOrigin, "no_origin"},
+		{ErrNoReferer, "no_referer"},
+		{fmt.Errorf("%w: domain", ErrDomainMismatch), "domain_mismatch"},
+		{ErrTokenCookieMismatch, "token_mismatch"},
+		{ErrBadToken, "bad_token"},
+		{ErrCookieTooLong, "error"},
+	}
+
+	for _, lt := range labelTests {
+		if label := failureLabel(lt.err); label != lt.expected {
+			t.Errorf("failureLabel(%v): got %q want %q", lt.err, label, lt.expected)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package csrf
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+// contextKey is the type of the keys used to store CSRF state in a request's
+// context.Context.
+type contextKey int
+
+const (
+	goContextKey contextKey = iota
+	skipCheckKey
+	tokenContextKey
+)
+
+// ProtectHTTP is a net/http-native variant of Protect for applications that do
+// not use Goji. It returns a standard func(http.Handler) http.Handler middleware
+// that stores the CSRF state in the request's context.Context, to be retrieved
+// with RequestToken, RequestTemplateField and RequestFailureReason - and used by
+// RequestRotate, RequestClear, RequestValidate and RequestVerifyToken.
+//
+// Options are the same as for Protect: use HTTPErrorHandler to set a plain
+// http.Handler as the error handler.
+//
+// Example:
+//
+//	mux := http.NewServeMux()
+//	mux.HandleFunc("/signup", ShowSignupForm)
+//	http.ListenAndServe(":8000", csrf.ProtectHTTP([]byte("9f86d081884c7d659a2feaa0c55ad015"))(mux))
+func ProtectHTTP(authKey []byte, opts ...Option) func(http.Handler) http.Handler {
+	m := Protect(authKey, opts...)
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := &web.C{Env: make(map[interface{}]interface{})}
+			m(c, h).ServeHTTP(w, withContext(r, c))
+		})
+	}
+}
+
+// HTTPErrorHandler allows you to change the handler called when CSRF request
+// processing encounters an invalid token or request, using a plain http.Handler
+// rather than a web.Handler - see ErrorHandler. The handler can retrieve the
+// failure reason with RequestFailureReason.
+func HTTPErrorHandler(h http.Handler) Option {
+	return ErrorHandler(web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, withContext(r, &c))
+	}))
+}
+
+// RequestToken returns a masked CSRF token for a request handled by
+// ProtectHTTP - see Token. An empty token will be returned if the middleware has
+// not been applied (which will fail subsequent validation).
+func RequestToken(r *http.Request) string {
+	return Token(fromContext(r), r)
+}
+
+// RequestTemplateField is a template helper for html/template that provides an
+// <input> field populated with a CSRF token for a request handled by
+// ProtectHTTP - see TemplateField.
+func RequestTemplateField(r *http.Request) template.HTML {
+	return TemplateField(fromContext(r), r)
+}
+
+// RequestMetaTag is a template helper for html/template that provides a <meta>
+// tag populated with a CSRF token for a request handled by ProtectHTTP - see
+// MetaTag.
+func RequestMetaTag(r *http.Request) template.HTML {
+	return MetaTag(fromContext(r))
+}
+
+// RequestFailureReason returns the CSRF validation error for a request handled
+// by ProtectHTTP - see FailureReason.
+func RequestFailureReason(r *http.Request) error {
+	return FailureReason(fromContext(r), r)
+}
+
+// RequestRotate generates a new CSRF token for a request handled by ProtectHTTP
+// and returns the new masked token - see Rotate.
+func RequestRotate(w http.ResponseWriter, r *http.Request) (string, error) {
+	return Rotate(fromContext(r), w)
+}
+
+// RequestClear deletes the CSRF token for a request handled by ProtectHTTP from
+// the store - see Clear.
+func RequestClear(w http.ResponseWriter, r *http.Request) error {
+	return Clear(fromContext(r), w)
+}
+
+// RequestValidate validates the CSRF token and origin of a request handled by
+// ProtectHTTP, returning the failure reason (or nil) - see ValidateRequest.
+func RequestValidate(r *http.Request) error {
+	return ValidateRequest(fromContext(r), r)
+}
+
+// RequestVerifyToken reports whether token matches the real token for a request
+// handled by ProtectHTTP - see VerifyToken.
+func RequestVerifyToken(r *http.Request, token string) bool {
+	return VerifyToken(fromContext(r), r, token)
+}
+
+// WithToken returns a copy of ctx that carries the masked CSRF token, for
+// retrieval with TokenFromContext. This allows the token to be passed into
+// derived contexts and goroutines - e.g. an errgroup rendering parts of the same
+// response - which must not access the (unsynchronized) web.C.
+//
+// Example:
+//
+//	ctx := csrf.WithToken(r.Context(), csrf.Token(c, r))
+//	g, ctx := errgroup.WithContext(ctx)
+//	g.Go(func() error {
+//	    return renderForm(ctx, w, csrf.TokenFromContext(ctx))
+//	})
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenContextKey, token)
+}
+
+// TokenFromContext returns the masked CSRF token carried by ctx or one of its
+// parents - see WithToken. For the context of a request handled by ProtectHTTP,
+// it falls back to the request's token, as RequestToken does: this must only
+// be called from the request's goroutine. An empty token will be returned if
+// there is none.
+func TokenFromContext(ctx context.Context) string {
+	if token, ok := ctx.Value(tokenContextKey).(string); ok {
+		return token
+	}
+
+	if c, ok := ctx.Value(goContextKey).(*web.C); ok {
+		return Token(*c, nil)
+	}
+
+	return ""
+}
+
+// withContext returns a shallow copy of r with the Goji request context stored
+// in its context.Context.
+func withContext(r *http.Request, c *web.C) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), goContextKey, c))
+}
+
+// fromContext returns the Goji request context stored in r's context.Context,
+// or an empty context if there is none.
+func fromContext(r *http.Request) web.C {
+	if c, ok := r.Context().Value(goContextKey).(*web.C); ok {
+		return *c
+	}
+
+	return web.C{}
+}
@@ -0,0 +1,223 @@
+package csrf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestProtectHTTP tests that the net/http middleware issues a token that
+// validates on a subsequent request, without a Goji router.
+func TestProtectHTTP(t *testing.T) {
+	var token string
+	var field string
+	h := ProtectHTTP(testKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = RequestToken(r)
+		field = string(RequestTemplateField(r))
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	if token == "" {
+		t.Fatalf("token not available in the request context: got %q", token)
+	}
+
+	if !strings.Contains(field, token) {
+		t.Fatalf("template field does not contain the token: got %q want %q", field, token)
+	}
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+}
+
+// TestHTTPErrorHandler tests that a http.Handler error handler is called with
+// the failure reason available from the request.
+func TestHTTPErrorHandler(t *testing.T) {
+	var reason error
+	errorHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason = RequestFailureReason(r)
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	h := ProtectHTTP(testKey, HTTPErrorHandler(errorHandler))(http.NotFoundHandler())
+
+	r, err := http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusTeapot {
+		t.Fatalf("custom error handler was not called: got %v want %v",
+			rr.Code, http.StatusTeapot)
+	}
+
+	if !errors.Is(reason, ErrNoCookie) {
+		t.Fatalf("failure reason incorrect: got %v want %v", reason, ErrNoCookie)
+	}
+}
+
+// TestRequestHelpers tests that tokens can be rotated, verified, validated and
+// cleared through the request helpers of the net/http middleware.
+func TestRequestHelpers(t *testing.T) {
+	var token, rotated string
+	var verified, verifiedRotated bool
+	var validateErr, rotateErr, clearErr error
+	h := ProtectHTTP(testKey)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/rotate":
+				token = RequestToken(r)
+				rotated, rotateErr = RequestRotate(w, r)
+				verified = RequestVerifyToken(r, token)
+				verifiedRotated = RequestVerifyToken(r, rotated)
+			case "/validate":
+				validateErr = RequestValidate(r)
+			case "/clear":
+				clearErr = RequestClear(w, r)
+			}
+		}))
+
+	r, err := http.NewRequest("GET", "/rotate", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	if rotateErr != nil {
+		t.Fatalf("token not rotated: %v", rotateErr)
+	}
+
+	if verified || !verifiedRotated {
+		t.Fatalf("tokens verified incorrectly: got %v, %v (old, rotated) want false, true",
+			verified, verifiedRotated)
+	}
+
+	// The rotated cookie follows the one issued for the request.
+	cookies := rr.Result().Cookies()
+	cookie := cookies[len(cookies)-1]
+
+	var validateTests = []struct {
+		token string
+		valid bool
+	}{
+		{rotated, true},
+		{token, false},
+	}
+
+	for _, vt := range validateTests {
+		r, err := http.NewRequest("GET", "/validate", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.AddCookie(cookie)
+		r.Header.Set("X-CSRF-Token", vt.token)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		if (validateErr == nil) != vt.valid {
+			t.Fatalf("token %q: got %v want valid %v", vt.token, validateErr, vt.valid)
+		}
+	}
+
+	r, err = http.NewRequest("GET", "/clear", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddCookie(cookie)
+	cleared := httptest.NewRecorder()
+	h.ServeHTTP(cleared, r)
+
+	if clearErr != nil {
+		t.Fatalf("token not cleared: %v", clearErr)
+	}
+
+	if c := cleared.Header().Get("Set-Cookie"); !strings.Contains(c, "Max-Age=0") {
+		t.Fatalf("cookie not expired: got %q", c)
+	}
+}
+
+// TestRequestHelpersWithoutMiddleware tests that the request helpers return
+// empty values when the middleware has not been applied.
+func TestRequestHelpersWithoutMiddleware(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token := RequestToken(r); token != "" {
+		t.Fatalf("token returned without middleware: got %q want %q", token, "")
+	}
+
+	if err := RequestFailureReason(r); err != nil {
+		t.Fatalf("failure reason returned without middleware: got %v want %v", err, nil)
+	}
+}
+
+// TestTokenFromContext tests that the token can be read from contexts derived
+// from the request context, including in another goroutine.
+func TestTokenFromContext(t *testing.T) {
+	var token, fromRequest, fromChild string
+	h := ProtectHTTP(testKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = RequestToken(r)
+		fromRequest = TokenFromContext(r.Context())
+
+		ctx, cancel := context.WithCancel(WithToken(r.Context(), token))
+		defer cancel()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			fromChild = TokenFromContext(ctx)
+		}()
+		<-done
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if fromRequest != token {
+		t.Fatalf("token not available from the request context: got %q want %q",
+			fromRequest, token)
+	}
+
+	if fromChild != token {
+		t.Fatalf("token not available from a child context: got %q want %q",
+			fromChild, token)
+	}
+
+	if token := TokenFromContext(context.Background()); token != "" {
+		t.Fatalf("token returned without the middleware: got %q", token)
+	}
+}
@@ -0,0 +1,88 @@
+package csrf
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTokenReused is returned when the OneTimeTokens option is set and a request
+// supplies a token that has already been used to validate a request.
+var ErrTokenReused = errors.New("CSRF token has already been used")
+
+// NonceStore records the nonces of tokens that have been used, so that each
+// token validates only once - see OneTimeTokens. Implementations must be safe
+// for concurrent use, and should be shared by every instance of an application.
+type NonceStore interface {
+	// Consume records nonce as used until expires. It returns false if the
+	// nonce has already been used (and has not expired). The check and the
+	// update must be atomic, so that concurrent requests cannot both consume
+	// the same nonce.
+	Consume(nonce string, expires time.Time) (bool, error)
+}
+
+// nonce returns the nonce identifying the real token realToken: a hash, so that
+// stores never hold the token itself.
+func nonce(realToken []byte) string {
+	sum := sha256.Sum256(realToken)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// consume records the one-time token realToken as used, returning
+// ErrTokenReused if it already was. It does nothing without OneTimeTokens.
+func (cs *csrf) consume(realToken []byte) error {
+	if cs.opts.NonceStore == nil {
+		return nil
+	}
+
+	ok, err := cs.opts.NonceStore.Consume(nonce(realToken), cs.now().Add(cs.tokenTTL()))
+	if err == nil && !ok {
+		return ErrTokenReused
+	}
+
+	return err
+}
+
+// InMemoryNonceStore is a NonceStore that records nonces in memory. Expired
+// nonces are removed as new nonces are consumed.
+//
+// Note that nonces are not shared between processes, and are lost on restart.
+type InMemoryNonceStore struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	// sweep is when expired nonces are next removed.
+	sweep time.Time
+}
+
+// NewInMemoryNonceStore returns an empty InMemoryNonceStore.
+func NewInMemoryNonceStore() *InMemoryNonceStore {
+	return &InMemoryNonceStore{nonces: make(map[string]time.Time)}
+}
+
+// Consume records nonce as used until expires, returning false if it has
+// already been used. It implements NonceStore.
+func (ns *InMemoryNonceStore) Consume(nonce string, expires time.Time) (bool, error) {
+	now := time.Now()
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	// Remove expired nonces at most once a minute, rather than on every call.
+	if now.After(ns.sweep) {
+		for n, exp := range ns.nonces {
+			if now.After(exp) {
+				delete(ns.nonces, n)
+			}
+		}
+		ns.sweep = now.Add(time.Minute)
+	}
+
+	if exp, ok := ns.nonces[nonce]; ok && !now.After(exp) {
+		return false, nil
+	}
+
+	ns.nonces[nonce] = expires
+	return true, nil
+}
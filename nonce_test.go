@@ -0,0 +1,155 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Check NonceStore implementations
+var _ NonceStore = &InMemoryNonceStore{}
+
+// TestOneTimeTokens tests that a token validates a single request, and that
+// replaying the request (cookie included) fails with ErrTokenReused.
+func TestOneTimeTokens(t *testing.T) {
+	var reason error
+	var validated int
+	s := web.New()
+	s.Use(Protect(testKey, OneTimeTokens(NewInMemoryNonceStore()),
+		OnFailure(func(c web.C, r *http.Request, err error) { reason = err }),
+		OnTokenEvent(func(evt TokenEvent) {
+			if evt.Type == TokenValidated {
+				validated++
+			}
+		})))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	post := func(rr *httptest.ResponseRecorder, token string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+		return resp
+	}
+
+	used := token
+	first := post(rr, used)
+	if first.Code != http.StatusOK {
+		t.Fatalf("one-time token failed validation: got %v want %v", first.Code, http.StatusOK)
+	}
+
+	if first.Header().Get("Set-Cookie") == "" {
+		t.Fatal("new token not issued after the one-time token was used")
+	}
+
+	replay := post(rr, used)
+	if replay.Code != http.StatusForbidden {
+		t.Fatalf("reused token passed validation: got %v want %v",
+			replay.Code, http.StatusForbidden)
+	}
+
+	if reason != ErrTokenReused {
+		t.Fatalf("wrong failure reason: got %v want %v", reason, ErrTokenReused)
+	}
+
+	// The reused token is not reported as validated before it fails.
+	if validated != 1 {
+		t.Fatalf("validated events: got %d want %d", validated, 1)
+	}
+
+	// The newly issued token validates.
+	if resp := post(first, token); resp.Code != http.StatusOK {
+		t.Fatalf("new token failed validation: got %v want %v", resp.Code, http.StatusOK)
+	}
+}
+
+// TestOneTimeTokensValidateRequest tests that ValidateRequest consumes one-time
+// tokens, failing a second use with ErrTokenReused.
+func TestOneTimeTokensValidateRequest(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, OneTimeTokens(NewInMemoryNonceStore())))
+
+	var token string
+	var validateErr error
+	s.Get("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+	s.Get("/ws", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		validateErr = ValidateRequest(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	for i, expected := range []error{nil, ErrTokenReused} {
+		r, err := http.NewRequest("GET", "/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		if validateErr != expected {
+			t.Fatalf("use %d: ValidateRequest incorrect: got %v want %v", i+1, validateErr, expected)
+		}
+	}
+}
+
+// TestInMemoryNonceStore tests that nonces can be consumed once until they
+// expire.
+func TestInMemoryNonceStore(t *testing.T) {
+	ns := NewInMemoryNonceStore()
+	expires := time.Now().Add(time.Hour)
+
+	var consumeTests = []struct {
+		nonce    string
+		expires  time.Time
+		expected bool
+	}{
+		{"a", expires, true},
+		{"a", expires, false},
+		{"b", expires, true},
+		{"expired", time.Now().Add(-time.Second), true},
+		{"expired", expires, true},
+		{"expired", expires, false},
+	}
+
+	for i, ct := range consumeTests {
+		ok, err := ns.Consume(ct.nonce, ct.expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != ct.expected {
+			t.Fatalf("#%d: Consume(%q): got %v want %v", i, ct.nonce, ok, ct.expected)
+		}
+	}
+}
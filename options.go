@@ -1,8 +1,20 @@
 package csrf
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
 
+	"github.com/gorilla/securecookie"
 	"github.com/zenazn/goji/web"
 )
 
@@ -10,7 +22,8 @@ import (
 type Option func(*csrf) error
 
 // MaxAge sets the maximum age (in seconds) of a CSRF token's underlying cookie.
-// Defaults to 12 hours.
+// Defaults to 12 hours. The cookie also carries the equivalent Expires
+// attribute, for clients that do not support Max-Age.
 func MaxAge(age int) Option {
 	return func(cs *csrf) error {
 		cs.opts.MaxAge = age
@@ -18,21 +31,47 @@ func MaxAge(age int) Option {
 	}
 }
 
+// TokenTTL sets how long a token remains valid, independently of the cookie's
+// MaxAge - e.g. to keep a long-lived cookie but require tokens be refreshed
+// more often. Defaults to the MaxAge. The TTL must be at least one second.
+//
+// A token past its TTL fails validation on unsafe requests, and is replaced
+// with a fresh token on the next request.
+func TokenTTL(d time.Duration) Option {
+	return func(cs *csrf) error {
+		if d < time.Second {
+			return errors.New("token TTL must be at least one second")
+		}
+
+		cs.opts.TokenTTL = d
+		return nil
+	}
+}
+
 // Domain sets the cookie domain. Defaults to the current domain of the request
 // only (recommended).
 //
 // This should be a hostname and not a URL. If set, the domain is treated as
 // being prefixed with a '.' - e.g. "example.com" becomes ".example.com" and
 // matches "www.example.com" and "secure.example.com".
+//
+// Domains that are not a valid hostname (e.g. a URL, or a host with a port)
+// return an error. An empty domain leaves the domain unset. Unsafe requests to a
+// host the domain does not match - for which browsers would silently drop the
+// cookie - fail with ErrDomainMismatch.
 func Domain(domain string) Option {
 	return func(cs *csrf) error {
+		if domain != "" && !isHostname(strings.TrimPrefix(domain, ".")) {
+			return fmt.Errorf("invalid cookie domain %q: must be a hostname", domain)
+		}
+
 		cs.opts.Domain = domain
 		return nil
 	}
 }
 
 // Path sets the cookie path. Defaults to the path the cookie was issued from
-// (recommended).
+// (recommended), or the CookiePathPrefix if set.
 //
 // This instructs clients to only respond with cookie for that path and its
 // subpaths - i.e. a cookie issued from "/register" would be included in requests
@@ -44,6 +83,41 @@ func Path(p string) Option {
 	}
 }
 
+// CookiePathPrefix sets the cookie path to the prefix an application is mounted
+// under - e.g. "/app" when a reverse proxy serves the application from
+// https://example.com/app/ - unless a Path is also set, which takes precedence.
+//
+// Without a Path, the cookie is scoped to the path it was issued from: a cookie
+// first issued from "/app/account/settings" would not be sent with requests to
+// "/app/checkout", which would then fail validation.
+func CookiePathPrefix(prefix string) Option {
+	return func(cs *csrf) error {
+		if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, ";\r\n") {
+			return fmt.Errorf("invalid cookie path prefix %q", prefix)
+		}
+
+		cs.opts.PathPrefix = path.Clean(prefix)
+		return nil
+	}
+}
+
+// PathScoped gives each top-level section of the application - the first path
+// segment beneath the cookie Path, such as "/admin" or "/shop" - its own token,
+// in a cookie named for the section (e.g. "_goji_csrf.admin") and limited to its
+// path. A token rendered in one section then fails validation with ErrBadToken
+// in another. Requests outside of any section (e.g. for "/") use the unscoped
+// cookie. Defaults to false.
+//
+// The cookie name is part of its authenticated value, except in
+// ModeDoubleSubmit. PathScoped cannot be used with the __Host- cookie prefix,
+// which requires a Path of "/", or with a CookieExtractor.
+func PathScoped(s bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.PathScoped = s
+		return nil
+	}
+}
+
 // Secure sets the 'Secure' flag on the cookie. Defaults to true (recommended).
 func Secure(s bool) Option {
 	return func(cs *csrf) error {
@@ -66,9 +140,10 @@ func HttpOnly(h bool) Option {
 // ErrorHandler allows you to change the handler called when CSRF request
 // processing encounters an invalid token or request. A typical use would be to
 // provide a handler that returns a static HTML file with a HTTP 403 status. By
-// default a HTTP 403 status and a plain text CSRF failure reason are served.
+// default a HTTP 403 status (see FailureStatus) and a plain text CSRF failure
+// reason are served.
 //
-// Note that a custom error handler can also access the csrf.Failure(c, r)
+// Note that a custom error handler can also access the csrf.FailureReason(c, r)
 // function to retrieve the CSRF validation reason from Goji's request context.
 func ErrorHandler(h web.Handler) Option {
 	return func(cs *csrf) error {
@@ -77,11 +152,324 @@ func ErrorHandler(h web.Handler) Option {
 	}
 }
 
+// FailureStatus sets the HTTP status code served by the default error handler
+// - e.g. http.StatusUnprocessableEntity for form-based clients. Defaults to
+// http.StatusForbidden (403). It has no effect on a custom ErrorHandler, and
+// codes outside of the 4xx and 5xx ranges return an error.
+func FailureStatus(code int) Option {
+	return func(cs *csrf) error {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("invalid failure status %d: must be a 4xx or 5xx code", code)
+		}
+
+		cs.opts.FailureStatus = code
+		return nil
+	}
+}
+
+// OnFailure sets a hook that is called with the failure reason each time a
+// request fails CSRF validation, before the error handler is called - e.g. to
+// count or log failures without replacing the error handler. The hook cannot
+// prevent the error handler from being called.
+func OnFailure(f func(c web.C, r *http.Request, reason error)) Option {
+	return func(cs *csrf) error {
+		cs.opts.OnFailure = f
+		return nil
+	}
+}
+
+// Logger sets a logger that the middleware logs each CSRF failure to, at the
+// WARN level with the reason, method, path and remote address of the request.
+// Token values are never logged. Defaults to nil, which disables logging.
+func Logger(l *slog.Logger) Option {
+	return func(cs *csrf) error {
+		cs.opts.Logger = l
+		return nil
+	}
+}
+
+// OnTokenEvent sets a hook that is called at each point in the lifecycle of a
+// token - when it is issued, rotated, validated, or fails validation - e.g. to
+// keep an audit trail. Events carry request metadata, but never the token. The
+// hook is called synchronously, so must not block.
+func OnTokenEvent(f func(evt TokenEvent)) Option {
+	return func(cs *csrf) error {
+		cs.opts.OnTokenEvent = f
+		return nil
+	}
+}
+
+// OnNewToken sets a hook that is called each time a token is issued to a
+// request that did not include one - e.g. to count new visitors - as opposed to
+// a request whose token was invalid or expired. For stores other than the
+// default cookie store, a request has no token when Get returns an error that
+// wraps http.ErrNoCookie.
+func OnNewToken(f func(r *http.Request)) Option {
+	return func(cs *csrf) error {
+		cs.opts.OnNewToken = f
+		return nil
+	}
+}
+
+// OnConfigWarning sets a hook that is called, when the middleware is
+// configured, with a description of each risky (but valid) combination of
+// options - e.g. to log them at startup. Options that browsers would reject
+// outright, such as SameSite=None without Secure, are returned as errors
+// instead.
+func OnConfigWarning(f func(warning string)) Option {
+	return func(cs *csrf) error {
+		cs.opts.OnConfigWarning = f
+		return nil
+	}
+}
+
 // RequestHeader allows you to change the request header the CSRF middleware
 // inspects. The default is X-CSRF-Token.
 func RequestHeader(header string) Option {
+	return RequestHeaders(header)
+}
+
+// RequestHeaders allows the CSRF middleware to inspect multiple request headers
+// - e.g. when migrating clients from one header to another. The headers are
+// checked in order and the first non-empty value is used. The default is
+// X-CSRF-Token.
+func RequestHeaders(headers ...string) Option {
+	return func(cs *csrf) error {
+		if len(headers) == 0 {
+			return errors.New("at least one request header is required")
+		}
+
+		for _, header := range headers {
+			if header == "" {
+				return errors.New("request header names cannot be empty")
+			}
+		}
+
+		cs.opts.RequestHeaders = headers
+		return nil
+	}
+}
+
+// SafeMethods overrides the set of HTTP methods treated as idempotent ("safe")
+// and therefore not validated by the middleware. The default is GET, HEAD,
+// OPTIONS and TRACE, as per RFC7231 section 4.2.2. Methods are matched
+// case-insensitively.
+//
+// For example, SafeMethods("HEAD", "OPTIONS") protects legacy APIs that change
+// state on GET requests. Calling SafeMethods with no methods validates every
+// request.
+func SafeMethods(methods ...string) Option {
+	return func(cs *csrf) error {
+		cs.opts.SafeMethods = make([]string, 0, len(methods))
+		for _, method := range methods {
+			if !isToken(method) {
+				return fmt.Errorf("invalid HTTP method %q", method)
+			}
+
+			cs.opts.SafeMethods = append(cs.opts.SafeMethods, strings.ToUpper(method))
+		}
+
+		return nil
+	}
+}
+
+// NoIssueOnMethods sets the safe HTTP methods for which the middleware never
+// writes a token cookie - e.g. to keep CORS preflight responses small. The
+// default is HEAD and OPTIONS. Methods are matched case-insensitively, and only
+// apply to requests that are not validated (see SafeMethods): validation is
+// unchanged. Calling NoIssueOnMethods with no methods issues cookies for every
+// method.
+//
+// Token still returns a token for these requests, but it will not validate
+// unless the client already holds the cookie.
+func NoIssueOnMethods(methods ...string) Option {
+	return func(cs *csrf) error {
+		cs.opts.NoIssueMethods = make([]string, 0, len(methods))
+		for _, method := range methods {
+			if !isToken(method) {
+				return fmt.Errorf("invalid HTTP method %q", method)
+			}
+
+			cs.opts.NoIssueMethods = append(cs.opts.NoIssueMethods, strings.ToUpper(method))
+		}
+
+		return nil
+	}
+}
+
+// SafeContentTypes sets request media types - e.g. "application/json" - for
+// which unsafe requests that do not supply a token are allowed through. A token
+// that is supplied must still validate, and the Origin/Referer check still
+// applies. Disabled by default.
+//
+// Browsers cannot send cross-origin requests with these content types without a
+// CORS preflight, which makes such requests resistant to CSRF as long as a CORS
+// policy does not allow them. This is a defence-in-depth convenience for APIs,
+// not a replacement for tokens: a permissive CORS configuration (or a browser
+// bug) removes the protection entirely. The "simple" content types -
+// application/x-www-form-urlencoded, multipart/form-data and text/plain - are
+// rejected, as any site can submit them.
+func SafeContentTypes(types ...string) Option {
+	return func(cs *csrf) error {
+		cs.opts.SafeContentTypes = nil
+		for _, t := range types {
+			mt, _, err := mime.ParseMediaType(t)
+			if err != nil {
+				return fmt.Errorf("invalid content type %q: %v", t, err)
+			}
+
+			switch mt {
+			case "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+				return fmt.Errorf("content type %q can be sent cross-origin without a preflight", t)
+			}
+
+			cs.opts.SafeContentTypes = append(cs.opts.SafeContentTypes, mt)
+		}
+
+		return nil
+	}
+}
+
+// ResponseHeader sets a response header - e.g. "X-CSRF-Token" - that the
+// middleware writes the masked token for the current request to, before calling
+// the wrapped handler. This allows JavaScript clients to read a fresh token from
+// any response. Disabled by default.
+func ResponseHeader(header string) Option {
+	return func(cs *csrf) error {
+		if !isToken(header) {
+			return fmt.Errorf("invalid response header name %q", header)
+		}
+
+		cs.opts.ResponseHeader = header
+		return nil
+	}
+}
+
+// TokenHeaderFormat sets a function that formats the masked token for the
+// current request as a response header - its name and value - that the
+// middleware writes before calling the wrapped handler (and again if the token is
+// rotated), as with ResponseHeader. This allows the token to be written in the
+// format a caching layer or client expects, e.g.
+//
+//	csrf.TokenHeaderFormat(func(token string) (string, string) {
+//		return "X-Edge-Token", `"` + token + `"`
+//	})
+//
+// Headers with an empty or invalid name are not written. Disabled by default.
+func TokenHeaderFormat(format func(token string) (name, value string)) Option {
+	return func(cs *csrf) error {
+		if format == nil {
+			return errors.New("token header format func cannot be nil")
+		}
+
+		cs.opts.TokenHeader = format
+		return nil
+	}
+}
+
+// StrictMultipleTokens rejects requests that supply more than one distinct
+// token across the request header(s) and form fields with ErrMultipleTokens,
+// treating the conflict as tampering. Defaults to false, where the header takes
+// precedence over the form field.
+//
+// Note that clients must then send the same token in each source: tokens from
+// different renders are masked differently, even when each is valid.
+func StrictMultipleTokens(s bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.StrictMultipleTokens = s
+		return nil
+	}
+}
+
+// MultipartMaxMemory sets the maximum memory (in bytes) used when parsing
+// multipart/form-data request bodies for the token field, with the remainder of
+// file parts stored on disk. Defaults to 32MB.
+func MultipartMaxMemory(n int64) Option {
+	return func(cs *csrf) error {
+		if n <= 0 {
+			return errors.New("multipart max memory must be positive")
+		}
+
+		cs.opts.MultipartMaxMemory = n
+		return nil
+	}
+}
+
+// TokenFromQuery sets a URL query parameter - e.g. "csrf_token" - to read the
+// token from when it is not supplied in the request header(s) or form body. This
+// is intended for requests where browsers cannot set headers, such as WebSocket
+// handshakes (see ValidateRequest), or links that change state - e.g. one-time
+// download links - once GET is removed from the safe methods (see SafeMethods).
+// Disabled by default.
+//
+// The query parameter is only checked where the request is validated: for
+// unsafe methods, or by ValidateRequest. The Origin/Referer check still applies
+// to HTTPS requests, so links must be followed from the same origin.
+//
+// Note that URLs are often logged, and are leaked by the Referer header unless
+// a referrer policy prevents it: prefer the header or form field where possible.
+func TokenFromQuery(param string) Option {
+	return func(cs *csrf) error {
+		if param == "" {
+			return errors.New("query parameter name must not be empty")
+		}
+
+		cs.opts.QueryParam = param
+		return nil
+	}
+}
+
+// TokenFromAuthorization reads the token from the Authorization header when it
+// uses the given scheme - e.g. "CSRF" for "Authorization: CSRF <token>" - and the
+// token is not supplied in the request header(s). Schemes are matched
+// case-insensitively, and Authorization headers using other schemes (such as
+// "Bearer") are ignored. Disabled by default.
+func TokenFromAuthorization(scheme string) Option {
+	return func(cs *csrf) error {
+		if !isToken(scheme) {
+			return fmt.Errorf("invalid authorization scheme %q", scheme)
+		}
+
+		cs.opts.AuthScheme = scheme
+		return nil
+	}
+}
+
+// TokenFromTrailer reads the token from a HTTP trailer - for chunked, streamed
+// request bodies where the client cannot set the header up front - when it is
+// not supplied in the request header(s). The trailer must be one of the
+// configured request headers, declared in the request's Trailer header.
+// Defaults to false.
+//
+// Trailers are only available once the body has been read in full, so the
+// middleware buffers the body - up to the MultipartMaxMemory limit - before
+// validating the request, and restores it for the wrapped handler. Requests
+// with larger bodies fail validation, and validation (and the handler) cannot
+// start until the upload is complete.
+func TokenFromTrailer(t bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.TrailerToken = t
+		return nil
+	}
+}
+
+// TokenFromBody reads the token from a JSON request body (application/json or
+// any +json media type) when it is not supplied in the request header(s) or form
+// body. jsonPath is the dot-separated path to a string value - e.g. "csrf_token"
+// for {"csrf_token": "..."}, or "meta.csrf_token" for a nested object.
+//
+// The body is buffered - up to the MultipartMaxMemory limit - and restored, so
+// that handlers can still read it in full.
+func TokenFromBody(jsonPath string) Option {
 	return func(cs *csrf) error {
-		cs.opts.RequestHeader = header
+		keys := strings.Split(jsonPath, ".")
+		for _, key := range keys {
+			if key == "" {
+				return fmt.Errorf("invalid JSON path %q", jsonPath)
+			}
+		}
+
+		cs.opts.BodyPath = keys
 		return nil
 	}
 }
@@ -95,46 +483,892 @@ func FieldName(name string) Option {
 	}
 }
 
-// CookieName changes the name of the CSRF cookie issued to clients.
+// MetaName changes the name of the <meta> tag generated by csrf.MetaTag. The
+// default is "csrf-token".
+func MetaName(name string) Option {
+	return func(cs *csrf) error {
+		if name == "" {
+			return errors.New("meta tag name must not be empty")
+		}
+
+		cs.opts.MetaName = name
+		return nil
+	}
+}
+
+// CookieName changes the name of the CSRF cookie issued to clients. Defaults to
+// "_goji_csrf".
 //
-// Note that cookie names should not contain whitespace, commas, semicolons,
-// backslashes or control characters as per RFC6265.
+// Note that cookie names must be a valid RFC6265 token: names containing
+// whitespace, control characters or separators (such as ';', ',' or '=')
+// return an error.
 func CookieName(name string) Option {
 	return func(cs *csrf) error {
+		if !isToken(name) {
+			return fmt.Errorf("invalid cookie name %q", name)
+		}
+
 		cs.opts.CookieName = name
 		return nil
 	}
 }
 
-// setStore sets the store used by the CSRF middleware.
-// Note: this is private (for now) to allow for internal API changes.
-func setStore(s store) Option {
+// TokenLength sets the length (in bytes) of the random token generated for each
+// session, before masking. Defaults to 32 bytes, which is also the minimum:
+// shorter lengths return an error.
+//
+// Note that the masked token returned by csrf.Token is the base64 encoding of
+// twice this length.
+func TokenLength(n int) Option {
+	return func(cs *csrf) error {
+		if n < tokenLength {
+			return fmt.Errorf("token length must be at least %d bytes", tokenLength)
+		}
+
+		cs.opts.TokenLength = n
+		return nil
+	}
+}
+
+// TokenEncoding sets the base64 encoding of the masked tokens returned by Token
+// and the template helpers - e.g. base64.RawURLEncoding for tokens sent in URLs,
+// where the '+', '/' and '=' characters of the default base64.StdEncoding need
+// escaping. Request tokens are decoded with the same encoding, so tokens issued
+// with a different encoding fail validation.
+func TokenEncoding(enc *base64.Encoding) Option {
+	return func(cs *csrf) error {
+		if enc == nil {
+			return errors.New("token encoding cannot be nil")
+		}
+
+		cs.opts.Encoding = enc
+		return nil
+	}
+}
+
+// TrustedOrigins configures a set of origins - e.g. "https://app.example.com" -
+// that are allowed to make cross-origin requests. A HTTPS request whose Origin
+// or Referer header matches a trusted origin passes the same-origin check even
+// though it differs from the requested host.
+//
+// Origins are matched exactly on their scheme, host and port: trusting
+// "https://example.com" does not trust "https://evil-example.com" or
+// "http://example.com". Note that this only relaxes the origin check: requests
+// from trusted origins must still provide a valid CSRF token.
+//
+// An origin whose host begins with a "*." label - e.g. "https://*.example.com",
+// or "*.example.com" for HTTPS - trusts any single-label subdomain:
+// "https://a.example.com" but not "https://example.com" itself,
+// "https://a.b.example.com" or "https://evil-example.com". The wildcard must
+// be followed by at least two labels.
+func TrustedOrigins(origins []string) Option {
+	return func(cs *csrf) error {
+		for _, origin := range origins {
+			// Bare wildcard origins match HTTPS requests.
+			if strings.HasPrefix(origin, "*.") {
+				origin = "https://" + origin
+			}
+
+			u, err := url.Parse(origin)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("invalid trusted origin %q", origin)
+			}
+
+			if base, ok := strings.CutPrefix(u.Hostname(), "*."); ok {
+				if !isHostname(base) || !strings.Contains(base, ".") {
+					return fmt.Errorf("invalid trusted origin %q: the wildcard must precede a domain", origin)
+				}
+			} else if strings.Contains(u.Host, "*") {
+				return fmt.Errorf("invalid trusted origin %q: only the first label can be a wildcard", origin)
+			}
+
+			cs.opts.TrustedOrigins = append(cs.opts.TrustedOrigins, originOf(u))
+		}
+
+		return nil
+	}
+}
+
+// ExemptPath exempts requests to the given paths from CSRF validation - e.g. a
+// webhook receiver that authenticates requests by other means. A token is still
+// issued for exempt requests.
+//
+// Paths are matched exactly, unless they end in a '*' - e.g. "/webhooks/*" -
+// which matches any path under that prefix. Request paths are cleaned before
+// matching, so "/webhooks/../admin" is not exempted by "/webhooks/*".
+func ExemptPath(paths ...string) Option {
+	return func(cs *csrf) error {
+		for _, p := range paths {
+			if !strings.HasPrefix(p, "/") {
+				return fmt.Errorf("exempt path %q must begin with a '/'", p)
+			}
+
+			if !strings.HasSuffix(p, "*") {
+				p = path.Clean(p)
+			}
+
+			cs.opts.ExemptPaths = append(cs.opts.ExemptPaths, p)
+		}
+
+		return nil
+	}
+}
+
+// TrustProxyHeaders allows the middleware to use the X-Forwarded-Proto header
+// to determine whether a request was made over HTTPS - and therefore requires
+// an origin check - when running behind a TLS-terminating proxy. Defaults to
+// false.
+//
+// Only enable this if your application is only reachable via a proxy that sets
+// (or overwrites) the header, as it can otherwise be spoofed by clients.
+func TrustProxyHeaders(t bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.TrustProxy = t
+		return nil
+	}
+}
+
+// RefererCheck enables or disables the Origin/Referer check performed on unsafe
+// HTTPS requests. Defaults to true.
+//
+// Disabling the check leaves the token as the only defence against cross-site
+// requests - including requests from an attacker-controlled subdomain or a
+// HTTP page on the same host, which the check otherwise rejects. Only disable it
+// where clients are known to strip both headers and the network is otherwise
+// controlled (e.g. behind mutual TLS).
+func RefererCheck(check bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.RefererCheck = check
+		return nil
+	}
+}
+
+// AllowNullOrigin allows unsafe requests with an opaque "Origin: null" header -
+// sent by sandboxed iframes, and some privacy modes - to pass the Origin/Referer
+// check, leaving the token as their only check. Defaults to false, which rejects
+// them with ErrBadOrigin over HTTP and HTTPS alike.
+//
+// Only enable this for applications that intentionally run in sandboxed frames:
+// any site can embed a sandboxed frame, so a null origin says nothing about
+// where a request came from.
+func AllowNullOrigin(allow bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.AllowNullOrigin = allow
+		return nil
+	}
+}
+
+// StrictReferer compares the scheme, host and port of the Referer header with
+// the request's effective values one by one when the Origin/Referer check falls
+// back to the Referer. Defaults to false.
+//
+// Ports are compared with the scheme's default port made explicit, so a Referer
+// of https://example.com:443/ matches https://example.com, and a mismatch is
+// reported as an ErrBadReferer that names the mismatched component, e.g.
+// `referer invalid: port "8443" does not match "443"`. Trusted origins (see
+// TrustedOrigins) are still accepted.
+func StrictReferer(strict bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.StrictReferer = strict
+		return nil
+	}
+}
+
+// SkipAfterPreflight skips the Origin/Referer check for HTTPS requests that
+// supply the token in a request header (see RequestHeader), while still
+// requiring a valid token. Defaults to false.
+//
+// Browsers only send a custom header with a cross-origin request after a CORS
+// preflight has allowed it, so the CORS policy takes the place of the origin
+// check: it must only allow the header from trusted origins - typically the same
+// set passed to TrustedOrigins. Never combine this option with a CORS policy
+// that allows any origin (or reflects the Origin header) with credentials.
+// Requests that supply the token in the form body are checked as usual.
+func SkipAfterPreflight(skip bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.SkipAfterPreflight = skip
+		return nil
+	}
+}
+
+// WithIssueLimiter sets a limiter that is consulted before a new token - and
+// cookie - is issued to a request without a valid token, to stop clients from
+// churning cookies (and server-side store entries) by hammering safe endpoints.
+// Requests the limiter denies are served without a cookie (and fail validation
+// if unsafe) or, if reject is true, with a 429 Too Many Requests response.
+//
+// See NewIPLimiter for a limiter keyed by the client's IP address.
+func WithIssueLimiter(l TokenIssueLimiter, reject bool) Option {
+	return func(cs *csrf) error {
+		if l == nil {
+			return errors.New("issue limiter cannot be nil")
+		}
+
+		cs.opts.IssueLimiter = l
+		cs.opts.RejectLimited = reject
+		return nil
+	}
+}
+
+// InjectTokenInJSON inserts the masked token - as a field with the given name -
+// into application/json responses whose body is a JSON object, e.g.
+// {"csrf_token": "<token>", ...}, for API clients that read the token from each
+// response. Arrays, other JSON values and other content types are written
+// unmodified.
+//
+// The response must be buffered to rewrite it, so JSON responses are written
+// once the handler returns. Responses larger than 1MB, compressed responses,
+// and responses the handler flushes are written unmodified, without the token.
+func InjectTokenInJSON(fieldName string) Option {
+	return func(cs *csrf) error {
+		if fieldName == "" {
+			return errors.New("JSON field name cannot be empty")
+		}
+
+		cs.opts.InjectField = fieldName
+		return nil
+	}
+}
+
+// SetVaryHeader controls whether the middleware adds "Cookie" to the Vary
+// header of responses, so that shared caches do not serve one user's token (or
+// cookie) to another. Defaults to true. Existing Vary values - e.g. set by an
+// outer compression middleware - are preserved: handlers that set their own
+// Vary values should use Header().Add rather than Header().Set.
+func SetVaryHeader(vary bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.NoVary = !vary
+		return nil
+	}
+}
+
+// Debug enables DebugHandler, which serves the token state and configuration
+// of the middleware. Defaults to false: only enable it during development.
+func Debug(debug bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.Debug = debug
+		return nil
+	}
+}
+
+// OneTimeTokens allows each token to validate only one request, to prevent a
+// captured token from being replayed within its lifetime - e.g. on sensitive
+// endpoints. Each token's nonce is recorded in store once it validates a
+// request, until the token expires, and later requests with the same token fail
+// with ErrTokenReused. A new token is issued after each successful validation
+// (as with RotateOnUse), which clients must use for their next request, so
+// OneTimeTokens cannot be used with IssueCookie(false).
+//
+// Use NewInMemoryNonceStore for a single process, or implement NonceStore to
+// share nonces between instances.
+func OneTimeTokens(store NonceStore) Option {
+	return func(cs *csrf) error {
+		if store == nil {
+			return errors.New("nonce store cannot be nil")
+		}
+
+		cs.opts.NonceStore = store
+		return nil
+	}
+}
+
+// RotateOnUse issues a new token - and cookie - after each request that passes
+// validation, so that a token can only be used for a single state-changing
+// request. Token and TemplateField return the new token within the handler.
+// Defaults to false.
+//
+// Note that pages rendered before the rotation (e.g. in other tabs) hold stale
+// tokens, and their next submission fails validation. With the default cookie
+// store, a replayed request that also carries the previous cookie still
+// validates: use a server-side store (see SetStore) or OneTimeTokens to prevent
+// this.
+func RotateOnUse(rotate bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.RotateOnUse = rotate
+		return nil
+	}
+}
+
+// RefreshOnRender only writes the cookie for safe (e.g. GET) requests that
+// render the token - via Token, TemplateField, MetaTag or RealToken - and
+// re-writes the cookie of an existing token when they do, to extend its expiry.
+// Safe requests that do not render the token never set a cookie, and unsafe
+// requests are unaffected. Defaults to false.
+//
+// As with LazyCookie, the token must be rendered before the response is
+// written. The ResponseHeader option renders the token on every request.
+func RefreshOnRender(refresh bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.RefreshOnRender = refresh
+		return nil
+	}
+}
+
+// LazyCookie defers issuing the cookie for a new token until the token is
+// first accessed in the request - via Token, TemplateField, MetaTag or
+// RealToken - rather than on every request without a valid cookie. This avoids
+// a Set-Cookie header on responses (such as cacheable API responses) that never
+// use the token. Defaults to false.
+//
+// The token must be accessed before the response is written, as the cookie
+// cannot be set afterwards. The ResponseHeader option always issues the cookie.
+func LazyCookie(lazy bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.LazyCookie = lazy
+		return nil
+	}
+}
+
+// IssueCookie controls whether the middleware issues a cookie for requests
+// without a valid token. Defaults to true. Set it to false for a tier that only
+// validates tokens - e.g. an API behind a separate frontend that issues them
+// with the same key and options - and must never set the cookie itself.
+//
+// Tokens returned by Token and the template helpers do not validate for
+// requests without a valid cookie, and IssueCookie(false) cannot be combined
+// with RotateOnUse.
+func IssueCookie(issue bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.ValidateOnly = !issue
+		return nil
+	}
+}
+
+// RotationKeys sets previous authentication keys - newest first - that are
+// accepted when decoding the CSRF cookie. New cookies are always signed with the
+// key passed to Protect. This allows keys to be rotated without invalidating
+// tokens that were issued before the rotation: remove a key once cookies
+// signed with it have expired (see MaxAge).
+func RotationKeys(keys [][]byte) Option {
+	return func(cs *csrf) error {
+		for _, key := range keys {
+			if err := checkKey(key); err != nil {
+				return fmt.Errorf("invalid rotation key: %w", err)
+			}
+		}
+
+		cs.opts.RotationKeys = keys
+		return nil
+	}
+}
+
+// WithMetrics sets the Metrics implementation that the middleware reports issued
+// tokens, validated requests and failures to. Defaults to discarding them.
+func WithMetrics(m Metrics) Option {
+	return func(cs *csrf) error {
+		if m == nil {
+			return errors.New("metrics cannot be nil")
+		}
+
+		cs.opts.Metrics = m
+		return nil
+	}
+}
+
+// WithCodec replaces the securecookie codecs used to sign the CSRF cookie with
+// the given codecs - e.g. an AEAD-based codec. New cookies are encoded with the
+// first codec, and cookies are decoded with each codec in turn, to allow
+// codecs to be rotated. The authKey passed to Protect is not used.
+//
+// Custom codecs must authenticate the cookie value: a codec that does not
+// allows an attacker to choose the token. TokenTTL and TokenAge require the
+// timestamp included by securecookie, and have no effect with custom codecs.
+func WithCodec(codecs ...Codec) Option {
+	return func(cs *csrf) error {
+		if len(codecs) == 0 {
+			return errors.New("at least one codec is required")
+		}
+
+		cs.sc = make([]securecookie.Codec, 0, len(codecs))
+		for _, codec := range codecs {
+			if codec == nil {
+				return errors.New("codecs cannot be nil")
+			}
+
+			cs.sc = append(cs.sc, codec)
+		}
+
+		return nil
+	}
+}
+
+// LegacyCodec sets a codec that decodes CSRF cookies in the format being
+// migrated from - e.g. those signed by a previous cookie codec - when none of the
+// current codecs can. Tokens in legacy cookies validate as usual, and their
+// cookie is re-saved in the current format once a state-changing request
+// validates, so that the legacy codec can be removed once clients have migrated.
+//
+// Like the codecs passed to WithCodec, the legacy codec must authenticate the
+// cookie value. It is only used by the default cookie store.
+func LegacyCodec(codec Codec) Option {
+	return func(cs *csrf) error {
+		if codec == nil {
+			return errors.New("legacy codec cannot be nil")
+		}
+
+		cs.opts.LegacyCodec = codec
+		return nil
+	}
+}
+
+// KeyFunc sets a function that returns the current authentication keys - newest
+// first - in place of the key passed to Protect and any RotationKeys. This
+// allows keys held in a KMS to be rotated without restarting the process: new
+// cookies are signed with the first key, and cookies signed with any of the
+// keys are accepted.
+//
+// The keys are cached for a minute between calls to fn. If fn returns an error
+// (or no keys, or a key that is too short - see Protect), the previous keys
+// continue to be used; if there are none, tokens cannot be issued or validated
+// and requests fail validation.
+func KeyFunc(fn func() ([][]byte, error)) Option {
+	return func(cs *csrf) error {
+		if fn == nil {
+			return errors.New("KeyFunc cannot be nil")
+		}
+
+		cs.keyFunc = fn
+		return nil
+	}
+}
+
+// SameSiteMode sets the SameSite attribute of the CSRF cookie. It mirrors the
+// http.SameSite values so that it can be converted directly.
+type SameSiteMode int
+
+// SameSite options. See https://tools.ietf.org/html/draft-ietf-httpbis-cookie-same-site
+const (
+	// SameSiteDefaultMode omits the SameSite attribute, leaving browsers to
+	// apply their default (Lax, in most current browsers).
+	SameSiteDefaultMode SameSiteMode = iota + 1
+	// SameSiteLaxMode sends the cookie with top-level cross-site navigations
+	// only.
+	SameSiteLaxMode
+	// SameSiteStrictMode never sends the cookie with cross-site requests.
+	SameSiteStrictMode
+	// SameSiteNoneMode sends the cookie with all requests. Browsers reject
+	// SameSite=None cookies that are not also Secure.
+	SameSiteNoneMode
+)
+
+// SameSite sets the SameSite attribute on the cookie. Defaults to
+// SameSiteLaxMode, which matches the behaviour of modern browsers.
+//
+// Note that SameSiteNoneMode requires the cookie to be Secure: combining it with
+// Secure(false) returns an error.
+func SameSite(mode SameSiteMode) Option {
+	return func(cs *csrf) error {
+		if mode < SameSiteDefaultMode || mode > SameSiteNoneMode {
+			return errors.New("invalid SameSite mode")
+		}
+
+		cs.opts.SameSite = mode
+		return nil
+	}
+}
+
+// SameSiteFunc sets the SameSite attribute of the cookie for each request,
+// overriding the SameSite option - e.g. to issue a SameSite=None cookie to an
+// OAuth callback that is reached by a cross-site redirect, and a Lax cookie
+// everywhere else.
+//
+// The SameSite=None and Partitioned checks only apply to the static SameSite
+// option: browsers discard SameSite=None cookies that are not also Secure.
+func SameSiteFunc(fn func(r *http.Request) http.SameSite) Option {
+	return func(cs *csrf) error {
+		if fn == nil {
+			return errors.New("SameSite func cannot be nil")
+		}
+
+		cs.opts.SameSiteFunc = fn
+		return nil
+	}
+}
+
+// CookieNamePrefix is a cookie name prefix that browsers use to enforce additional
+// constraints on a cookie. See
+// https://tools.ietf.org/html/draft-ietf-httpbis-rfc6265bis#section-4.1.3
+type CookieNamePrefix string
+
+const (
+	// SecurePrefix requires the cookie to be Secure.
+	SecurePrefix CookieNamePrefix = "__Secure-"
+	// HostPrefix requires the cookie to be Secure, to have a Path of "/" and to
+	// omit the Domain attribute, locking the cookie to the issuing host.
+	HostPrefix CookieNamePrefix = "__Host-"
+)
+
+// CookiePrefix sets a prefix that is prepended to the cookie name. The prefix's
+// constraints are checked when the middleware is configured: SecurePrefix and
+// HostPrefix return an error when combined with Secure(false), and HostPrefix
+// returns an error when combined with a Domain or a Path other than "/".
+// HostPrefix defaults the Path to "/".
+func CookiePrefix(prefix CookieNamePrefix) Option {
+	return func(cs *csrf) error {
+		if prefix != SecurePrefix && prefix != HostPrefix {
+			return fmt.Errorf("invalid cookie prefix %q", prefix)
+		}
+
+		cs.opts.CookiePrefix = prefix
+		return nil
+	}
+}
+
+// TokenMode is the strategy used to store the real token - see Mode.
+type TokenMode int
+
+const (
+	// ModeSynchronizer stores the real token in an authenticated (signed)
+	// cookie, so that it cannot be set or modified without the auth key.
+	ModeSynchronizer TokenMode = iota
+	// ModeDoubleSubmit stores the real token in a plain (unsigned) cookie, and
+	// validates that the submitted token matches the cookie value.
+	ModeDoubleSubmit
+)
+
+// Mode sets the strategy used to store the real token in the default cookie
+// store. Defaults to ModeSynchronizer. Submitted tokens are masked, and compared
+// in constant time, in either mode.
+//
+// ModeDoubleSubmit does not require the cookie to be decoded with the auth key,
+// but is weaker: anyone who can write a cookie for the domain - such as a
+// compromised or user-controlled subdomain - can set a known token and submit
+// it. Pair it with CookiePrefix(HostPrefix) so that the cookie cannot be set by
+// other hosts.
+func Mode(mode TokenMode) Option {
+	return func(cs *csrf) error {
+		if mode != ModeSynchronizer && mode != ModeDoubleSubmit {
+			return fmt.Errorf("invalid token mode %d", mode)
+		}
+
+		cs.opts.Mode = mode
+		return nil
+	}
+}
+
+// SetStore sets the store used by the CSRF middleware to persist the real
+// (unmasked) token. Defaults to an authenticated cookie store.
+//
+// A server-side store allows tokens to be invalidated - e.g. on logout - but
+// note that options describing the default cookie (MaxAge, Domain, Path, Secure,
+// HttpOnly, SameSite and the cookie name) are not applied to a custom store.
+func SetStore(s Store) Option {
 	return func(cs *csrf) error {
 		cs.st = s
 		return nil
 	}
 }
 
+// Partitioned sets the 'Partitioned' attribute on the cookie, for
+// applications embedded in third-party contexts (e.g. iframes) under
+// partitioned cookie storage (CHIPS). Defaults to false.
+//
+// Partitioned cookies must also be Secure and SameSite=None: other combinations
+// return an error.
+func Partitioned(p bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.Partitioned = p
+		return nil
+	}
+}
+
+// CompressCookie compresses the token with flate before it is encoded in the
+// cookie of the default store. Defaults to false.
+//
+// Compressed values are marked with a prefix, and cookies are read whether or
+// not they were compressed, so the option can be enabled (or disabled) without
+// invalidating existing cookies. Note that random tokens do not compress: this
+// only reduces the size of the cookie for payloads with redundancy, and slightly
+// increases it otherwise. It is not applied to custom stores.
+func CompressCookie(compress bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.CompressCookie = compress
+		return nil
+	}
+}
+
+// SessionIDFunc binds tokens to the session ID returned by fn for the request -
+// e.g. the ID of the user's authenticated session - so that a token issued to
+// one session does not validate for another. This mitigates login CSRF and
+// session swapping: a token rendered before login (or for another user) fails
+// validation with ErrTokenCookieMismatch once the session ID changes.
+//
+// Tokens rendered after the session ID changes validate as normal, as the cookie
+// holds a single real token from which each session's token is derived.
+// Requests without a session should return an empty ID, which is bound like any
+// other. As with BindMethod, tokens created by Issue do not validate.
+func SessionIDFunc(fn func(r *http.Request) string) Option {
+	return func(cs *csrf) error {
+		if fn == nil {
+			return errors.New("session ID func cannot be nil")
+		}
+
+		cs.opts.SessionID = fn
+		return nil
+	}
+}
+
+// BindMethod binds tokens to the HTTP method of the request they are issued
+// for, so that a token for a form POST cannot be replayed against a handler for
+// another method. Defaults to false.
+//
+// Token, Tokens and the template helpers return tokens for POST requests: use
+// TokenForMethod for other methods, including GET requests checked by
+// ValidateRequest. The cookie still holds a single real token, from which each
+// method's token is derived. Tokens created by Issue are not bound, and do not
+// validate with this option.
+func BindMethod(bind bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.BindMethod = bind
+		return nil
+	}
+}
+
+// DevelopmentMode clears the Secure attribute of the cookie, and skips the
+// Origin/Referer check, for requests made to localhost (or a loopback IP) from a
+// loopback address - e.g. a local development server without HTTPS. Defaults to
+// false.
+//
+// It has no effect on requests to any other host, or on requests forwarded by a
+// proxy (with a Forwarded or X-Forwarded-* header). Do not enable it where a
+// reverse proxy on the same machine forwards requests without these headers, as
+// they then appear to be loopback requests. Prefixed cookies (see CookiePrefix)
+// and SameSite=None cookies remain Secure, as browsers reject them otherwise.
+func DevelopmentMode(dev bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.DevelopmentMode = dev
+		return nil
+	}
+}
+
+// RawCookieWriter sets the function that writes the cookie of the default store
+// to the response, in place of http.SetCookie - e.g. to serialize the SameSite
+// attribute as a proxy or an older Go version expects. The writer is responsible
+// for the entire Set-Cookie header, and is only used by the default store.
+func RawCookieWriter(fn func(w http.ResponseWriter, c *http.Cookie)) Option {
+	return func(cs *csrf) error {
+		if fn == nil {
+			return errors.New("cookie writer cannot be nil")
+		}
+
+		cs.opts.CookieWriter = fn
+		return nil
+	}
+}
+
+// setRandReader sets the source of random bytes used to generate tokens.
+// Note: this is private to allow deterministic tests; the default source is
+// crypto/rand.
+func setRandReader(r io.Reader) Option {
+	return func(cs *csrf) error {
+		cs.rand = r
+		return nil
+	}
+}
+
+// setClock sets the clock used for token ages.
+// Note: this is private to allow deterministic tests; the default clock is
+// time.Now.
+func setClock(now func() time.Time) Option {
+	return func(cs *csrf) error {
+		cs.now = now
+		return nil
+	}
+}
+
 // parseOptions parses the supplied options functions and returns a configured
-// csrf handler.
-func parseOptions(h http.Handler, opts ...Option) *csrf {
+// csrf handler. It returns an error if an option is invalid or the options
+// conflict with each other.
+func parseOptions(h http.Handler, opts ...Option) (*csrf, error) {
 	// Set the handler to call after processing.
 	cs := &csrf{
-		h: h,
+		h:    h,
+		rand: rand.Reader,
+		now:  time.Now,
 	}
 
 	// Default to true. See Secure & HttpOnly function comments for rationale.
 	// Set here to allow package users to override the default.
 	cs.opts.Secure = true
 	cs.opts.HttpOnly = true
+	cs.opts.SameSite = SameSiteLaxMode
+	cs.opts.RefererCheck = true
+	cs.opts.Metrics = noopMetrics{}
 
 	// Range over each options function and apply it
 	// to our csrf type to configure it. Options functions are
 	// applied in order, with any conflicting options overriding
 	// earlier calls.
 	for _, option := range opts {
-		option(cs)
+		if err := option(cs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Browsers discard SameSite=None cookies without the Secure flag.
+	if cs.opts.SameSite == SameSiteNoneMode && !cs.opts.Secure {
+		return nil, errors.New("SameSite=None requires a Secure cookie")
+	}
+
+	// Browsers require partitioned cookies to be usable in a cross-site context.
+	if cs.opts.Partitioned && (cs.opts.SameSite != SameSiteNoneMode || !cs.opts.Secure) {
+		return nil, errors.New("Partitioned requires a Secure, SameSite=None cookie")
+	}
+
+	// Custom codecs replace the keys, and double-submit cookies are unsigned.
+	if cs.sc != nil && (cs.keyFunc != nil || cs.opts.Mode == ModeDoubleSubmit) {
+		return nil, errors.New("WithCodec cannot be combined with KeyFunc or ModeDoubleSubmit")
+	}
+
+	// Rotating tokens requires a new cookie.
+	if cs.opts.ValidateOnly && cs.opts.RotateOnUse {
+		return nil, errors.New("RotateOnUse requires IssueCookie")
+	}
+
+	// One-time tokens must be replaced after each use.
+	if cs.opts.ValidateOnly && cs.opts.NonceStore != nil {
+		return nil, errors.New("OneTimeTokens requires IssueCookie")
+	}
+
+	// Extracted cookies are not named for a section.
+	if cs.opts.PathScoped && cs.opts.CookieExtractor != nil {
+		return nil, errors.New("PathScoped cannot be combined with CookieExtractor")
+	}
+
+	// An explicit Path takes precedence over the path prefix.
+	if cs.opts.Path == "" {
+		cs.opts.Path = cs.opts.PathPrefix
+	}
+
+	if err := checkCookiePrefix(&cs.opts); err != nil {
+		return nil, err
+	}
+
+	if err := checkCookieScope(&cs.opts); err != nil {
+		return nil, err
+	}
+
+	if cs.opts.OnConfigWarning != nil {
+		for _, warning := range configWarnings(&cs.opts) {
+			cs.opts.OnConfigWarning(warning)
+		}
+	}
+
+	return cs, nil
+}
+
+// configWarnings returns a description of each risky combination of options.
+func configWarnings(o *options) []string {
+	var warnings []string
+	if !o.Secure {
+		warnings = append(warnings, "Secure is disabled: the CSRF cookie is sent over plain HTTP")
+	}
+
+	if !o.HttpOnly {
+		warnings = append(warnings, "HttpOnly is disabled: the CSRF cookie is readable by JavaScript")
+	}
+
+	if o.SameSite == SameSiteNoneMode {
+		warnings = append(warnings, "SameSite=None: the CSRF cookie is sent with cross-site requests")
+	}
+
+	if !o.RefererCheck {
+		warnings = append(warnings, "RefererCheck is disabled: the origin of HTTPS requests is not checked")
+	}
+
+	if o.Debug {
+		warnings = append(warnings, "Debug is enabled: DebugHandler serves the CSRF configuration")
+	}
+
+	if o.SkipAfterPreflight && o.RefererCheck {
+		warnings = append(warnings, "SkipAfterPreflight: the CORS policy replaces the origin check for header tokens")
+	}
+
+	if o.DevelopmentMode {
+		warnings = append(warnings, "DevelopmentMode is enabled: loopback requests get an insecure cookie and no origin check")
+	}
+
+	if o.Mode == ModeDoubleSubmit && o.Domain != "" {
+		warnings = append(warnings, "ModeDoubleSubmit with a Domain: subdomains can overwrite the unsigned CSRF cookie")
+	}
+
+	return warnings
+}
+
+// checkCookieScope rejects cookie Domain and Path settings that browsers ignore
+// or that leave the cookie out of the requests it protects, which would
+// otherwise fail validation at runtime.
+func checkCookieScope(o *options) error {
+	// Browsers reject cookies for a top-level domain (or public suffix).
+	if d := strings.TrimPrefix(o.Domain, "."); d != "" && !strings.Contains(d, ".") &&
+		!strings.EqualFold(d, "localhost") {
+		return fmt.Errorf("cookie domain %q is a top-level domain: browsers reject the cookie", o.Domain)
+	}
+
+	if o.Path == "" {
+		return nil
+	}
+
+	// Browsers replace a relative path with the path the cookie was issued
+	// from.
+	if !strings.HasPrefix(o.Path, "/") || strings.ContainsAny(o.Path, ";\r\n") {
+		return fmt.Errorf("invalid cookie path %q: must be an absolute path", o.Path)
+	}
+
+	// A path beside the path prefix is never sent to the mounted application.
+	if p := o.PathPrefix; p != "" && !pathWithin(o.Path, p) && !pathWithin(p, o.Path) {
+		return fmt.Errorf("cookie path %q does not cover the path prefix %q: the cookie is never sent", o.Path, p)
+	}
+
+	return nil
+}
+
+// pathWithin reports whether the path p is the path dir, or beneath it.
+func pathWithin(p, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// CheckConfig reports whether the options are valid - e.g. as a deploy-time check
+// - returning the error that New (and Protect) would for invalid options,
+// including combinations of the cookie Domain, Path, Secure and SameSite
+// attributes that browsers reject. It does not check the auth key. Warnings are
+// reported to the OnConfigWarning hook, if set.
+func CheckConfig(opts ...Option) error {
+	if _, err := parseOptions(nil, opts...); err != nil {
+		return fmt.Errorf(errorPrefix+"%w", err)
+	}
+
+	return nil
+}
+
+// checkCookiePrefix enforces the constraints browsers apply to prefixed cookie
+// names, as they would otherwise silently discard the cookie.
+func checkCookiePrefix(o *options) error {
+	switch o.CookiePrefix {
+	case "":
+		return nil
+	case HostPrefix:
+		if o.Domain != "" {
+			return fmt.Errorf("cookie prefix %s cannot be used with a Domain", o.CookiePrefix)
+		}
+
+		if o.Path == "" {
+			o.Path = "/"
+		}
+
+		if o.Path != "/" {
+			return fmt.Errorf("cookie prefix %s requires a Path of \"/\"", o.CookiePrefix)
+		}
+
+		if o.PathScoped {
+			return fmt.Errorf("cookie prefix %s cannot be used with PathScoped", o.CookiePrefix)
+		}
+	}
+
+	if !o.Secure {
+		return fmt.Errorf("cookie prefix %s requires a Secure cookie", o.CookiePrefix)
 	}
 
-	return cs
+	return nil
 }
@@ -2,8 +2,11 @@ package csrf
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/zenazn/goji/web"
 )
@@ -30,10 +33,16 @@ func TestOptions(t *testing.T) {
 		FieldName(field),
 		ErrorHandler(web.HandlerFunc(errorHandler)),
 		CookieName(name),
+		SameSite(SameSiteStrictMode),
+		TokenLength(64),
+		TrustProxyHeaders(true),
 	}
 
 	// Parse our test options and check that they set the related struct fields.
-	cs := parseOptions(h, testOpts...)
+	cs, err := parseOptions(h, testOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if cs.opts.MaxAge != age {
 		t.Errorf("MaxAge not set correctly: got %v want %v", cs.opts.MaxAge, age)
@@ -55,8 +64,8 @@ func TestOptions(t *testing.T) {
 		t.Errorf("Secure not set correctly: got %v want %v", cs.opts.Secure, false)
 	}
 
-	if cs.opts.RequestHeader != header {
-		t.Errorf("RequestHeader not set correctly: got %v want %v", cs.opts.RequestHeader, header)
+	if len(cs.opts.RequestHeaders) != 1 || cs.opts.RequestHeaders[0] != header {
+		t.Errorf("RequestHeader not set correctly: got %v want %v", cs.opts.RequestHeaders, header)
 	}
 
 	if cs.opts.FieldName != field {
@@ -72,4 +81,570 @@ func TestOptions(t *testing.T) {
 		t.Errorf("CookieName not set correctly: got %v want %v",
 			cs.opts.CookieName, name)
 	}
+
+	if cs.opts.TokenLength != 64 {
+		t.Errorf("TokenLength not set correctly: got %v want %v",
+			cs.opts.TokenLength, 64)
+	}
+
+	if cs.opts.TrustProxy != true {
+		t.Errorf("TrustProxyHeaders not set correctly: got %v want %v",
+			cs.opts.TrustProxy, true)
+	}
+
+	if cs.opts.SameSite != SameSiteStrictMode {
+		t.Errorf("SameSite not set correctly: got %v want %v",
+			cs.opts.SameSite, SameSiteStrictMode)
+	}
+}
+
+// TestTokenLengthMinimum tests that token lengths below the minimum are
+// rejected.
+func TestTokenLengthMinimum(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, TokenLength(16)); err == nil {
+		t.Fatal("parseOptions did not reject a 16 byte token length")
+	}
+}
+
+// TestTrustedOriginsInvalid tests that trusted origins must be absolute URLs.
+func TestTrustedOriginsInvalid(t *testing.T) {
+	var h http.Handler
+
+	cs, err := parseOptions(h, TrustedOrigins([]string{"https://Goji.io:8443"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cs.opts.TrustedOrigins[0] != "https://goji.io:8443" {
+		t.Fatalf("TrustedOrigins not normalised: got %q want %q",
+			cs.opts.TrustedOrigins[0], "https://goji.io:8443")
+	}
+
+	for _, origin := range []string{"goji.io", "/forms", "://goji.io", "*.com",
+		"https://*", "https://a.*.goji.io", "https://*goji.io"} {
+		if _, err := parseOptions(h, TrustedOrigins([]string{origin})); err == nil {
+			t.Errorf("parseOptions did not reject trusted origin %q", origin)
+		}
+	}
+}
+
+// TestExemptPathInvalid tests that exempt paths must be absolute.
+func TestExemptPathInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, ExemptPath("webhook")); err == nil {
+		t.Fatal("parseOptions did not reject a relative exempt path")
+	}
+}
+
+// TestRequestHeadersInvalid tests that an empty set of request headers is
+// rejected.
+func TestRequestHeadersInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, RequestHeaders()); err == nil {
+		t.Fatal("parseOptions did not reject an empty set of request headers")
+	}
+
+	if _, err := parseOptions(h, RequestHeaders("X-CSRF-Token", "")); err == nil {
+		t.Fatal("parseOptions did not reject an empty request header name")
+	}
+}
+
+// TestTokenTTLInvalid tests that sub-second token TTLs are rejected.
+func TestTokenTTLInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, TokenTTL(time.Millisecond)); err == nil {
+		t.Fatal("parseOptions did not reject a sub-second token TTL")
+	}
+}
+
+// TestPartitionedInvalid tests that Partitioned cookies must be Secure and
+// SameSite=None.
+func TestPartitionedInvalid(t *testing.T) {
+	var h http.Handler
+
+	var partitionedTests = []struct {
+		opts  []Option
+		valid bool
+	}{
+		{[]Option{Partitioned(true), SameSite(SameSiteNoneMode)}, true},
+		{[]Option{Partitioned(true)}, false},
+		{[]Option{Partitioned(true), SameSite(SameSiteNoneMode), Secure(false)}, false},
+		{[]Option{Partitioned(false)}, true},
+	}
+
+	for i, pt := range partitionedTests {
+		if _, err := parseOptions(h, pt.opts...); (err == nil) != pt.valid {
+			t.Errorf("partitioned test %d failed: got error %v want valid %v", i, err, pt.valid)
+		}
+	}
+}
+
+// TestResponseHeaderInvalid tests that invalid response header names are
+// rejected.
+func TestResponseHeaderInvalid(t *testing.T) {
+	var h http.Handler
+
+	for _, header := range []string{"", "X-CSRF Token", "X-CSRF-Token:"} {
+		if _, err := parseOptions(h, ResponseHeader(header)); err == nil {
+			t.Errorf("parseOptions did not reject response header %q", header)
+		}
+	}
+}
+
+// TestTokenHeaderFormatInvalid tests that a nil formatter is rejected.
+func TestTokenHeaderFormatInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, TokenHeaderFormat(nil)); err == nil {
+		t.Fatal("parseOptions did not reject a nil token header format")
+	}
+}
+
+// TestPathScopedInvalid tests that PathScoped is rejected with options that fix
+// the cookie name or path.
+func TestPathScopedInvalid(t *testing.T) {
+	var h http.Handler
+
+	extract := func(r *http.Request) (string, error) { return "", nil }
+	for _, opt := range []Option{CookiePrefix(HostPrefix), CookieExtractor(extract)} {
+		if _, err := parseOptions(h, Secure(true), PathScoped(true), opt); err == nil {
+			t.Fatal("parseOptions did not reject PathScoped with a fixed cookie name or path")
+		}
+	}
+}
+
+// TestNoIssueOnMethodsInvalid tests that invalid method names are rejected.
+func TestNoIssueOnMethodsInvalid(t *testing.T) {
+	var h http.Handler
+
+	for _, method := range []string{"", "GET POST", "GET\r\n"} {
+		if _, err := parseOptions(h, NoIssueOnMethods(method)); err == nil {
+			t.Errorf("parseOptions did not reject method %q", method)
+		}
+	}
+}
+
+// TestMultipartMaxMemoryInvalid tests that non-positive sizes are rejected.
+func TestMultipartMaxMemoryInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, MultipartMaxMemory(0)); err == nil {
+		t.Fatal("parseOptions did not reject a zero multipart max memory")
+	}
+}
+
+// TestSafeMethodsOption tests that methods are normalised to upper case and that
+// invalid methods are rejected.
+func TestSafeMethodsOption(t *testing.T) {
+	var h http.Handler
+
+	cs, err := parseOptions(h, SafeMethods("get", "Head"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(cs.opts.SafeMethods, []string{"GET", "HEAD"}) {
+		t.Fatalf("SafeMethods not set correctly: got %v want %v",
+			cs.opts.SafeMethods, []string{"GET", "HEAD"})
+	}
+
+	for _, method := range []string{"", "GET POST"} {
+		if _, err := parseOptions(h, SafeMethods(method)); err == nil {
+			t.Errorf("parseOptions did not reject method %q", method)
+		}
+	}
+}
+
+// TestTokenFromQueryInvalid tests that an empty query parameter is rejected.
+func TestTokenFromQueryInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, TokenFromQuery("")); err == nil {
+		t.Fatal("parseOptions did not reject an empty query parameter")
+	}
+}
+
+// TestSameSiteNoneInsecure tests that SameSite=None is rejected for cookies
+// without the Secure flag.
+func TestSameSiteNoneInsecure(t *testing.T) {
+	var h http.Handler
+
+	_, err := parseOptions(h, SameSite(SameSiteNoneMode), Secure(false))
+	if err == nil {
+		t.Fatal("parseOptions did not reject SameSite=None without Secure")
+	}
+
+	if _, err := parseOptions(h, SameSite(SameSiteNoneMode)); err != nil {
+		t.Fatalf("parseOptions rejected SameSite=None with Secure: %v", err)
+	}
+
+	if _, err := parseOptions(h, SameSite(SameSiteMode(42))); err == nil {
+		t.Fatal("parseOptions did not reject an invalid SameSite mode")
+	}
+}
+
+// TestCookieNameInvalid tests that cookie names that are not valid RFC6265
+// tokens are rejected.
+func TestCookieNameInvalid(t *testing.T) {
+	var h http.Handler
+
+	var nameTests = []struct {
+		name  string
+		valid bool
+	}{
+		{"_goji_csrf", true},
+		{"app-one.csrf", true},
+		{"", false},
+		{"csrf token", false},
+		{"csrf;token", false},
+		{"csrf=token", false},
+		{"csrf\ttoken", false},
+		{"csrf\x7ftoken", false},
+	}
+
+	for _, nt := range nameTests {
+		_, err := parseOptions(h, CookieName(nt.name))
+		if (err == nil) != nt.valid {
+			t.Errorf("CookieName(%q) validation failed: got error %v want valid %v",
+				nt.name, err, nt.valid)
+		}
+	}
+}
+
+// TestCookiePrefix tests that the constraints of each cookie prefix are
+// enforced when parsing options.
+func TestCookiePrefix(t *testing.T) {
+	var h http.Handler
+
+	var prefixTests = []struct {
+		opts  []Option
+		valid bool
+	}{
+		{[]Option{CookiePrefix(SecurePrefix)}, true},
+		{[]Option{CookiePrefix(SecurePrefix), Domain("goji.io"), Path("/forms/")}, true},
+		{[]Option{CookiePrefix(SecurePrefix), Secure(false)}, false},
+		{[]Option{CookiePrefix(HostPrefix)}, true},
+		{[]Option{CookiePrefix(HostPrefix), Path("/")}, true},
+		{[]Option{CookiePrefix(HostPrefix), Domain("goji.io")}, false},
+		{[]Option{CookiePrefix(HostPrefix), Path("/forms/")}, false},
+		{[]Option{CookiePrefix(HostPrefix), Secure(false)}, false},
+		{[]Option{CookiePrefix("__Bogus-")}, false},
+	}
+
+	for i, pt := range prefixTests {
+		cs, err := parseOptions(h, pt.opts...)
+		if (err == nil) != pt.valid {
+			t.Errorf("prefix test %d failed: got error %v want valid %v", i, err, pt.valid)
+			continue
+		}
+
+		if err == nil && cs.opts.CookiePrefix == HostPrefix && cs.opts.Path != "/" {
+			t.Errorf("prefix test %d did not default the path: got %q want %q",
+				i, cs.opts.Path, "/")
+		}
+	}
+}
+
+// TestTokenFromBodyInvalid tests that empty JSON path segments are rejected.
+func TestTokenFromBodyInvalid(t *testing.T) {
+	var h http.Handler
+
+	for _, path := range []string{"", "meta.", ".csrf_token", "meta..csrf_token"} {
+		if _, err := parseOptions(h, TokenFromBody(path)); err == nil {
+			t.Errorf("parseOptions did not reject JSON path %q", path)
+		}
+	}
+}
+
+// TestModeInvalid tests that unknown token modes are rejected.
+func TestModeInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, Mode(TokenMode(2))); err == nil {
+		t.Fatal("parseOptions did not reject an unknown token mode")
+	}
+}
+
+// TestDomainInvalid tests that cookie domains that are not hostnames are
+// rejected.
+func TestDomainInvalid(t *testing.T) {
+	var h http.Handler
+
+	for _, domain := range []string{".", "https://goji.io", "goji.io:8000", "goji.io/forms", "goji..io"} {
+		if _, err := parseOptions(h, Domain(domain)); err == nil {
+			t.Errorf("parseOptions did not reject domain %q", domain)
+		}
+	}
+
+	for _, domain := range []string{"goji.io", ".goji.io", "localhost"} {
+		if _, err := parseOptions(h, Domain(domain)); err != nil {
+			t.Errorf("parseOptions rejected domain %q: %v", domain, err)
+		}
+	}
+
+	// An empty domain (e.g. passed through from config) leaves it unset.
+	cs, err := parseOptions(h, Domain("goji.io"), Domain(""))
+	if err != nil {
+		t.Fatalf("parseOptions rejected an empty domain: %v", err)
+	}
+
+	if cs.opts.Domain != "" {
+		t.Errorf("empty domain not unset: got %q want %q", cs.opts.Domain, "")
+	}
+}
+
+// TestSafeContentTypesInvalid tests that invalid and "simple" content types are
+// rejected.
+func TestSafeContentTypesInvalid(t *testing.T) {
+	var h http.Handler
+
+	for _, ct := range []string{"", "application/", "text/plain", "Multipart/Form-Data"} {
+		if _, err := parseOptions(h, SafeContentTypes(ct)); err == nil {
+			t.Errorf("parseOptions did not reject content type %q", ct)
+		}
+	}
+}
+
+// TestFailureStatusInvalid tests that non-error status codes are rejected.
+func TestFailureStatusInvalid(t *testing.T) {
+	var h http.Handler
+
+	for _, code := range []int{0, 200, 302, 600} {
+		if _, err := parseOptions(h, FailureStatus(code)); err == nil {
+			t.Errorf("parseOptions did not reject status %d", code)
+		}
+	}
+}
+
+// TestTokenFromAuthorizationInvalid tests that invalid schemes are rejected.
+func TestTokenFromAuthorizationInvalid(t *testing.T) {
+	var h http.Handler
+
+	for _, scheme := range []string{"", "CSRF Token", "CSRF:"} {
+		if _, err := parseOptions(h, TokenFromAuthorization(scheme)); err == nil {
+			t.Errorf("parseOptions did not reject scheme %q", scheme)
+		}
+	}
+}
+
+// TestKeyFuncInvalid tests that a nil KeyFunc is rejected.
+func TestKeyFuncInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, KeyFunc(nil)); err == nil {
+		t.Fatal("parseOptions did not reject a nil KeyFunc")
+	}
+}
+
+// TestWithMetricsInvalid tests that a nil Metrics implementation is rejected.
+func TestWithMetricsInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, WithMetrics(nil)); err == nil {
+		t.Fatal("parseOptions did not reject nil metrics")
+	}
+}
+
+// TestOnConfigWarning tests that a warning is reported for each risky
+// combination of options.
+func TestOnConfigWarning(t *testing.T) {
+	var h http.Handler
+
+	var warningTests = []struct {
+		name     string
+		opts     []Option
+		expected []string
+	}{
+		{"default", nil, nil},
+		{"insecure", []Option{Secure(false)}, []string{"Secure is disabled"}},
+		{"not HttpOnly", []Option{HttpOnly(false)}, []string{"HttpOnly is disabled"}},
+		{"SameSite=None", []Option{SameSite(SameSiteNoneMode)}, []string{"SameSite=None"}},
+		{"no referer check", []Option{RefererCheck(false)}, []string{"RefererCheck is disabled"}},
+		{"debug", []Option{Debug(true)}, []string{"Debug is enabled"}},
+		{"skip after preflight", []Option{SkipAfterPreflight(true)}, []string{"SkipAfterPreflight"}},
+		{"double-submit domain", []Option{Mode(ModeDoubleSubmit), Domain("example.com")},
+			[]string{"ModeDoubleSubmit with a Domain"}},
+		{"multiple", []Option{Secure(false), HttpOnly(false)},
+			[]string{"Secure is disabled", "HttpOnly is disabled"}},
+	}
+
+	for _, wt := range warningTests {
+		var warnings []string
+		opts := append([]Option{OnConfigWarning(func(w string) {
+			warnings = append(warnings, w)
+		})}, wt.opts...)
+
+		if _, err := parseOptions(h, opts...); err != nil {
+			t.Fatalf("%s: %v", wt.name, err)
+		}
+
+		if len(warnings) != len(wt.expected) {
+			t.Fatalf("%s: wrong warnings: got %q want %q", wt.name, warnings, wt.expected)
+		}
+
+		for i, expected := range wt.expected {
+			if !strings.HasPrefix(warnings[i], expected) {
+				t.Fatalf("%s: wrong warning: got %q want %q", wt.name, warnings[i], expected)
+			}
+		}
+	}
+}
+
+// TestOneTimeTokensInvalid tests that a nil NonceStore is rejected.
+func TestOneTimeTokensInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, OneTimeTokens(nil)); err == nil {
+		t.Fatal("parseOptions did not reject a nil nonce store")
+	}
+}
+
+// TestCookiePathPrefix tests the cookie path emitted for each combination of
+// Path and CookiePathPrefix.
+func TestCookiePathPrefix(t *testing.T) {
+	var pathTests = []struct {
+		opts     []Option
+		expected string
+	}{
+		{nil, ""},
+		{[]Option{CookiePathPrefix("/app/")}, "/app"},
+		{[]Option{Path("/"), CookiePathPrefix("/app")}, "/"},
+		{[]Option{CookiePathPrefix("/app"), Path("/app/admin")}, "/app/admin"},
+	}
+
+	for _, pt := range pathTests {
+		s := web.New()
+		s.Use(Protect(testKey, pt.opts...))
+		s.Handle("/*", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {}))
+
+		r, err := http.NewRequest("GET", "/app/account/settings", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("wrong number of cookies: got %v want %v", len(cookies), 1)
+		}
+
+		if cookies[0].Path != pt.expected {
+			t.Fatalf("cookie path not set correctly: got %q want %q",
+				cookies[0].Path, pt.expected)
+		}
+	}
+
+	for _, prefix := range []string{"", "app", "/app;Domain=evil.com"} {
+		if _, err := parseOptions(nil, CookiePathPrefix(prefix)); err == nil {
+			t.Errorf("parseOptions did not reject cookie path prefix %q", prefix)
+		}
+	}
+}
+
+// TestIssueCookieInvalid tests that RotateOnUse and OneTimeTokens require
+// IssueCookie.
+func TestIssueCookieInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, IssueCookie(false), RotateOnUse(true)); err == nil {
+		t.Fatal("parseOptions did not reject RotateOnUse without IssueCookie")
+	}
+
+	if _, err := parseOptions(h, IssueCookie(false), OneTimeTokens(NewInMemoryNonceStore())); err == nil {
+		t.Fatal("parseOptions did not reject OneTimeTokens without IssueCookie")
+	}
+}
+
+// TestTokenEncodingInvalid tests that a nil encoding is rejected.
+func TestTokenEncodingInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, TokenEncoding(nil)); err == nil {
+		t.Fatal("parseOptions did not reject a nil token encoding")
+	}
+}
+
+// TestWithIssueLimiterInvalid tests that a nil limiter is rejected.
+func TestWithIssueLimiterInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, WithIssueLimiter(nil, false)); err == nil {
+		t.Fatal("parseOptions did not reject a nil issue limiter")
+	}
+}
+
+// TestInjectTokenInJSONInvalid tests that an empty field name is rejected.
+func TestInjectTokenInJSONInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, InjectTokenInJSON("")); err == nil {
+		t.Fatal("parseOptions did not reject an empty JSON field name")
+	}
+}
+
+// TestSameSiteFuncInvalid tests that a nil SameSite func is rejected.
+func TestSameSiteFuncInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, SameSiteFunc(nil)); err == nil {
+		t.Fatal("parseOptions did not reject a nil SameSite func")
+	}
+}
+
+// TestRawCookieWriterInvalid tests that a nil cookie writer is rejected.
+func TestRawCookieWriterInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, RawCookieWriter(nil)); err == nil {
+		t.Fatal("parseOptions did not reject a nil cookie writer")
+	}
+}
+
+// TestSessionIDFuncInvalid tests that a nil session ID func is rejected.
+func TestSessionIDFuncInvalid(t *testing.T) {
+	var h http.Handler
+
+	if _, err := parseOptions(h, SessionIDFunc(nil)); err == nil {
+		t.Fatal("parseOptions did not reject a nil session ID func")
+	}
+}
+
+// TestCheckConfig tests that CheckConfig rejects cookie settings that browsers
+// ignore, or that leave the cookie out of protected requests.
+func TestCheckConfig(t *testing.T) {
+	var configTests = []struct {
+		name  string
+		opts  []Option
+		valid bool
+	}{
+		{"defaults", nil, true},
+		{"domain and path", []Option{Domain("goji.io"), Path("/forms/")}, true},
+		{"localhost", []Option{Domain("localhost")}, true},
+		{"path above prefix", []Option{CookiePathPrefix("/app"), Path("/")}, true},
+		{"path below prefix", []Option{CookiePathPrefix("/app"), Path("/app/admin")}, true},
+		{"top-level domain", []Option{Domain("io")}, false},
+		{"relative path", []Option{Path("forms")}, false},
+		{"path beside prefix", []Option{CookiePathPrefix("/app"), Path("/application")}, false},
+		{"insecure SameSite=None", []Option{SameSite(SameSiteNoneMode), Secure(false)}, false},
+		{"insecure prefix", []Option{CookiePrefix(SecurePrefix), Secure(false)}, false},
+		{"host prefix with domain", []Option{CookiePrefix(HostPrefix), Domain("goji.io")}, false},
+	}
+
+	for _, ct := range configTests {
+		err := CheckConfig(ct.opts...)
+		if (err == nil) != ct.valid {
+			t.Fatalf("%s: CheckConfig incorrect: got %v want valid %v", ct.name, err, ct.valid)
+		}
+
+		if err != nil && !strings.HasPrefix(err.Error(), errorPrefix) {
+			t.Fatalf("%s: error not prefixed: got %q", ct.name, err)
+		}
+	}
 }
@@ -0,0 +1,156 @@
+// Package redisstore provides a Redis-backed csrf.Store for deployments that run
+// more than one instance of an application.
+//
+// The store talks to Redis through the small Client interface, so that callers
+// can wrap the client library (and version) they already use:
+//
+//	type client struct{ rdb *redis.Client }
+//
+//	func (c client) Get(ctx context.Context, key string) ([]byte, error) {
+//		b, err := c.rdb.Get(ctx, key).Bytes()
+//		if err == redis.Nil {
+//			return nil, nil
+//		}
+//		return b, err
+//	}
+//
+//	// ... Set and Del.
+//
+//	store := redisstore.New(client{rdb}, redisstore.FromCookie("session_id"), 12*time.Hour)
+//	goji.Use(csrf.Protect(authKey, csrf.SetStore(store)))
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/goji/csrf"
+)
+
+// keyPrefix namespaces the keys written by the store.
+const keyPrefix = "goji.csrf:"
+
+// errTokenNotFound is returned when a session does not have a (current) token.
+var errTokenNotFound = errors.New("token not found for session")
+
+// Client is the subset of a Redis client used by the store.
+type Client interface {
+	// Get returns the value of key, or a nil slice and nil error if the key
+	// does not exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set sets key to value, expiring after ttl.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Del deletes key. Deleting a key that does not exist is not an error.
+	Del(ctx context.Context, key string) error
+}
+
+// RedisStore is a server-side csrf.Store that keeps tokens in Redis, keyed by a
+// session ID supplied by the caller. Requests without a session ID fail CSRF
+// validation with csrf.ErrNoSession.
+type RedisStore struct {
+	client    Client
+	sessionID func(r *http.Request) string
+	ttl       time.Duration
+}
+
+// New returns a RedisStore that keys tokens by the session ID returned by
+// sessionID - see FromCookie and FromHeader. Tokens expire after ttl, which
+// should match the MaxAge passed to csrf.Protect (defaulting to 12 hours).
+func New(client Client, sessionID func(r *http.Request) string, ttl time.Duration) *RedisStore {
+	if ttl <= 0 {
+		ttl = 12 * time.Hour
+	}
+
+	return &RedisStore{
+		client:    client,
+		sessionID: sessionID,
+		ttl:       ttl,
+	}
+}
+
+// FromCookie returns a session ID function that reads the ID from the named
+// cookie.
+func FromCookie(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+
+		return cookie.Value
+	}
+}
+
+// FromHeader returns a session ID function that reads the ID from the named
+// request header.
+func FromHeader(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// Get returns the token for the request's session.
+func (rs *RedisStore) Get(r *http.Request) ([]byte, error) {
+	id := rs.sessionID(r)
+	if id == "" {
+		return nil, csrf.ErrNoSession
+	}
+
+	token, err := rs.client.Get(r.Context(), keyPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+
+	if token == nil {
+		return nil, errTokenNotFound
+	}
+
+	return token, nil
+}
+
+// Save always returns csrf.ErrNoSession, as tokens must be saved against a
+// session: the middleware calls SaveSession instead.
+func (rs *RedisStore) Save(token []byte, w http.ResponseWriter) error {
+	return csrf.ErrNoSession
+}
+
+// SaveSession stores the token against the request's session, replacing any
+// existing token.
+func (rs *RedisStore) SaveSession(r *http.Request, token []byte, w http.ResponseWriter) error {
+	id := rs.sessionID(r)
+	if id == "" {
+		return csrf.ErrNoSession
+	}
+
+	return rs.client.Set(r.Context(), keyPrefix+id, token, rs.ttl)
+}
+
+// SaveKey stores the token against the given session, replacing any existing
+// token. It implements csrf.KeyedStore, for tokens issued outside of a request
+// with csrf.Issue.
+func (rs *RedisStore) SaveKey(sessionID string, token []byte) error {
+	if sessionID == "" {
+		return csrf.ErrNoSession
+	}
+
+	return rs.client.Set(context.Background(), keyPrefix+sessionID, token, rs.ttl)
+}
+
+// Revoke deletes the token for the given session - e.g. on logout. A new token
+// is issued on the session's next request.
+func (rs *RedisStore) Revoke(ctx context.Context, sessionID string) error {
+	return rs.client.Del(ctx, keyPrefix+sessionID)
+}
+
+// Clear deletes the token for the request's session. It implements
+// csrf.ClearStore.
+func (rs *RedisStore) Clear(r *http.Request, w http.ResponseWriter) error {
+	id := rs.sessionID(r)
+	if id == "" {
+		return csrf.ErrNoSession
+	}
+
+	return rs.Revoke(r.Context(), id)
+}
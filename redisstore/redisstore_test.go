@@ -0,0 +1,248 @@
+package redisstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goji/csrf"
+	"github.com/zenazn/goji/web"
+)
+
+// Check Store implementations
+var _ csrf.SessionStore = &RedisStore{}
+var _ csrf.ClearStore = &RedisStore{}
+var _ csrf.KeyedStore = &RedisStore{}
+
+var testKey = []byte("keep-it-secret-keep-it-safe-----")
+
+// mockClient is an in-memory Client that records the TTL of each key.
+type mockClient struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	ttls map[string]time.Duration
+	err  error
+}
+
+func newMockClient() *mockClient {
+	return &mockClient{
+		data: make(map[string][]byte),
+		ttls: make(map[string]time.Duration),
+	}
+}
+
+func (m *mockClient) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data[key], m.err
+}
+
+func (m *mockClient) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+
+	m.data[key] = value
+	m.ttls[key] = ttl
+	return nil
+}
+
+func (m *mockClient) Del(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+	delete(m.ttls, key)
+	return m.err
+}
+
+// TestRedisStore tests that tokens are saved against the session with the
+// configured TTL, validate on subsequent requests and can be revoked.
+func TestRedisStore(t *testing.T) {
+	client := newMockClient()
+	store := New(client, FromHeader("X-Session-ID"), time.Hour)
+
+	s := web.New()
+	s.Use(csrf.Protect(testKey, csrf.SetStore(store)))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = csrf.Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set("X-Session-ID", "session-a")
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	saved, ok := client.data[keyPrefix+"session-a"]
+	if !ok {
+		t.Fatal("token not saved against the session")
+	}
+
+	if ttl := client.ttls[keyPrefix+"session-a"]; ttl != time.Hour {
+		t.Fatalf("token TTL incorrect: got %v want %v", ttl, time.Hour)
+	}
+
+	post := func(session string) int {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("X-Session-ID", session)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	if code := post("session-a"); code != http.StatusOK {
+		t.Fatalf("valid token rejected: got %v want %v", code, http.StatusOK)
+	}
+
+	if code := post("session-b"); code != http.StatusForbidden {
+		t.Fatalf("token accepted for another session: got %v want %v", code, http.StatusForbidden)
+	}
+
+	if err := store.Revoke(context.Background(), "session-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := post("session-a"); code != http.StatusForbidden {
+		t.Fatalf("revoked token accepted: got %v want %v", code, http.StatusForbidden)
+	}
+
+	if bytes.Equal(client.data[keyPrefix+"session-a"], saved) {
+		t.Fatal("new token not issued after revocation")
+	}
+}
+
+// TestRedisStoreNoSession tests that requests without a session ID fail.
+func TestRedisStoreNoSession(t *testing.T) {
+	store := New(newMockClient(), FromCookie("session_id"), 0)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get(r); err != csrf.ErrNoSession {
+		t.Fatalf("Get without a session: got %v want %v", err, csrf.ErrNoSession)
+	}
+
+	if err := store.SaveSession(r, []byte("token"), httptest.NewRecorder()); err != csrf.ErrNoSession {
+		t.Fatalf("SaveSession without a session: got %v want %v", err, csrf.ErrNoSession)
+	}
+
+	if err := store.Save([]byte("token"), httptest.NewRecorder()); err != csrf.ErrNoSession {
+		t.Fatalf("Save: got %v want %v", err, csrf.ErrNoSession)
+	}
+
+	if store.ttl != 12*time.Hour {
+		t.Fatalf("default TTL incorrect: got %v want %v", store.ttl, 12*time.Hour)
+	}
+}
+
+// TestRedisStoreAnonymous tests that the middleware serves safe requests
+// without a session ID, and fails unsafe requests without one.
+func TestRedisStoreAnonymous(t *testing.T) {
+	client := newMockClient()
+	store := New(client, FromCookie("session_id"), time.Hour)
+
+	s := web.New()
+	s.Use(csrf.Protect(testKey, csrf.SetStore(store)))
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {}))
+
+	var anonymousTests = []struct {
+		method   string
+		expected int
+	}{
+		{"GET", http.StatusOK},
+		{"POST", http.StatusForbidden},
+	}
+
+	for _, at := range anonymousTests {
+		r, err := http.NewRequest(at.method, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if rr.Code != at.expected {
+			t.Fatalf("anonymous %s: got %v want %v", at.method, rr.Code, at.expected)
+		}
+	}
+
+	if len(client.data) != 0 {
+		t.Fatalf("token saved without a session: got %d keys want 0", len(client.data))
+	}
+}
+
+// TestRedisStoreClientError tests that client errors are returned.
+func TestRedisStoreClientError(t *testing.T) {
+	client := newMockClient()
+	client.err = errors.New("connection refused")
+	store := New(client, FromCookie("session_id"), time.Hour)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddCookie(&http.Cookie{Name: "session_id", Value: "session-a"})
+
+	if _, err := store.Get(r); err != client.err {
+		t.Fatalf("Get client error: got %v want %v", err, client.err)
+	}
+
+	if err := store.SaveSession(r, []byte("token"), httptest.NewRecorder()); err != client.err {
+		t.Fatalf("SaveSession client error: got %v want %v", err, client.err)
+	}
+}
+
+// TestRedisStoreIssue tests that a token issued with csrf.Issue validates on a
+// later request from the same session.
+func TestRedisStoreIssue(t *testing.T) {
+	client := newMockClient()
+	rs := New(client, FromHeader("X-Session-ID"), time.Hour)
+
+	token, err := csrf.Issue(rs, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := client.ttls[keyPrefix+"alice"]; ttl != time.Hour {
+		t.Fatalf("token saved with the wrong TTL: got %v want %v", ttl, time.Hour)
+	}
+
+	s := web.New()
+	s.Use(csrf.Protect(testKey, csrf.SetStore(rs)))
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {}))
+
+	r, err := http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-Session-ID", "alice")
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("pre-issued token failed validation: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
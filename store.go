@@ -1,17 +1,45 @@
 package csrf
 
 import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/securecookie"
-	"github.com/zenazn/goji/web"
 )
 
-// store represents the session storage used for CSRF tokens.
-type store interface {
-	// Get returns the real CSRF token from the store.
-	Get(c *web.C, r *http.Request) ([]byte, error)
+// maxCookieLength is the maximum length of a cookie (name, value and attributes)
+// that browsers are required to store, as per RFC6265 section 6.1.
+const maxCookieLength = 4096
+
+// ErrCookieTooLong is returned when the encoded CSRF cookie exceeds the 4096 byte
+// limit that browsers enforce - e.g. due to a very large TokenLength - and would
+// otherwise be silently discarded by the browser.
+var ErrCookieTooLong = errors.New("CSRF cookie exceeds the 4096 byte limit")
+
+// errTokenExpired is returned when a cookie is older than the token TTL.
+var errTokenExpired = errors.New("token expired")
+
+// compressedPrefix marks a token compressed before encoding - see
+// CompressCookie.
+var compressedPrefix = []byte("\x00csrf-flate\x00")
+
+// Store represents the session storage used for CSRF tokens. The default
+// store is a signed cookie: implement Store (and pass it to SetStore) to back
+// tokens with a server-side session store instead.
+type Store interface {
+	// Get returns the real CSRF token from the store. It should return an error
+	// if the token does not exist or cannot be retrieved.
+	Get(r *http.Request) ([]byte, error)
 	// Save stores the real CSRF token in the store and writes a
 	// cookie to the http.ResponseWriter.
 	// For non-cookie stores, the cookie should contain a unique (256 bit) ID
@@ -20,64 +48,439 @@ type store interface {
 	Save(token []byte, w http.ResponseWriter) error
 }
 
+// SessionStore is an optional interface implemented by server-side stores that
+// key tokens by the session of the current request, rather than an ID issued
+// in their own cookie. The middleware calls SaveSession in place of Save when
+// the configured Store implements it.
+type SessionStore interface {
+	Store
+	// SaveSession stores the real CSRF token against the session of the
+	// request r.
+	SaveSession(r *http.Request, token []byte, w http.ResponseWriter) error
+}
+
+// ClearStore is an optional interface implemented by stores that can delete the
+// token for the current request - e.g. on logout. See Clear.
+type ClearStore interface {
+	Store
+	// Clear deletes the token for the request r, expiring any cookie that
+	// references it.
+	Clear(r *http.Request, w http.ResponseWriter) error
+}
+
+// KeyedStore is an optional interface implemented by server-side stores that
+// can save a token against a known session ID, outside of a request - see Issue.
+type KeyedStore interface {
+	Store
+	// SaveKey stores the real CSRF token against the session sessionID,
+	// replacing any existing token.
+	SaveKey(sessionID string, token []byte) error
+}
+
+// timestampStore is implemented by stores that record when the token for a
+// request was issued.
+type timestampStore interface {
+	issued(r *http.Request) (time.Time, bool)
+}
+
+// legacyStore is implemented by stores that decode tokens saved in a legacy
+// format, which the middleware re-saves in the current format.
+type legacyStore interface {
+	legacy(r *http.Request) bool
+}
+
 // cookieStore is a signed cookie session store for CSRF tokens.
 type cookieStore struct {
-	name     string
-	maxAge   int
-	secure   bool
-	httpOnly bool
-	path     string
-	domain   string
-	sc       *securecookie.SecureCookie
+	name        string
+	maxAge      int
+	secure      bool
+	httpOnly    bool
+	path        string
+	domain      string
+	sameSite    SameSiteMode
+	partitioned bool
+	// compress compresses tokens before encoding them.
+	compress bool
+	// dev clears the Secure attribute for loopback requests.
+	dev bool
+	// scoped gives each top-level path segment its own cookie - see scope.
+	scoped bool
+	// write, if set, writes the cookie to the response in place of
+	// http.SetCookie.
+	write func(w http.ResponseWriter, c *http.Cookie)
+	// sameSiteFn, if set, returns the SameSite attribute for each request in
+	// place of sameSite.
+	sameSiteFn func(r *http.Request) http.SameSite
+	// sc contains a codec for each key, newest first.
+	sc []securecookie.Codec
+	// keys, if set, provides the codecs in place of sc.
+	keys *keyRing
+	// legacyCodec, if set, decodes cookies that none of the codecs can.
+	legacyCodec securecookie.Codec
+	// extract, if set, returns the cookie value in place of the named cookie.
+	extract func(r *http.Request) (string, error)
+	// ttl is the maximum age of a token, as of now. Tokens are not checked
+	// against the ttl if it is zero.
+	ttl time.Duration
+	now func() time.Time
 }
 
 // Get retrieves a CSRF token from the session cookie. It returns an empty token
 // if decoding fails (e.g. HMAC validation fails or the named cookie doesn't exist).
-func (cs *cookieStore) Get(c *web.C, r *http.Request) ([]byte, error) {
+func (cs *cookieStore) Get(r *http.Request) ([]byte, error) {
 	// Retrieve the cookie from the request
-	cookie, err := r.Cookie(cs.name)
+	value, err := cs.value(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sc, err := cs.codecs()
 	if err != nil {
 		return nil, err
 	}
 
+	name, _ := cs.scope(r)
 	token := make([]byte, tokenLength)
-	// Decode the HMAC authenticated cookie.
-	err = cs.sc.Decode(cs.name, cookie.Value, &token)
+	// Decode the HMAC authenticated cookie, trying each key in turn.
+	err = securecookie.DecodeMulti(name, value, &token, sc...)
+	if err != nil && cs.legacyCodec != nil {
+		// Fall back to the legacy format while cookies are migrated.
+		token = make([]byte, tokenLength)
+		err = cs.legacyCodec.Decode(name, value, &token)
+	}
 	if err != nil {
 		return nil, err
 	}
+	// Cookies are read whether or not they were compressed.
+	token = decompressToken(token)
+
+	// Reject tokens older than the ttl.
+	if cs.ttl > 0 {
+		if issued, ok := cs.timestamp(sc, value); ok && cs.clock().Sub(issued) > cs.ttl {
+			return nil, errTokenExpired
+		}
+	}
 
 	return token, nil
 }
 
+// issued returns the time the session cookie was issued, from the timestamp
+// that securecookie includes in the authenticated value. It must only be called
+// once Get has authenticated the cookie.
+func (cs *cookieStore) issued(r *http.Request) (time.Time, bool) {
+	value, err := cs.value(r)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	sc, err := cs.codecs()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return cs.timestamp(sc, value)
+}
+
+// legacy reports whether the session cookie is in the legacy format: decoded by
+// the legacy codec, rather than the current codecs. It must only be called once
+// Get has authenticated the cookie.
+func (cs *cookieStore) legacy(r *http.Request) bool {
+	if cs.legacyCodec == nil {
+		return false
+	}
+
+	value, err := cs.value(r)
+	if err != nil {
+		return false
+	}
+
+	sc, err := cs.codecs()
+	if err != nil {
+		return false
+	}
+
+	name, _ := cs.scope(r)
+	var token []byte
+	return securecookie.DecodeMulti(name, value, &token, sc...) != nil
+}
+
+// value returns the raw value of the session cookie, or http.ErrNoCookie if the
+// request does not include it.
+func (cs *cookieStore) value(r *http.Request) (string, error) {
+	if cs.extract == nil {
+		name, _ := cs.scope(r)
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return "", err
+		}
+
+		return cookie.Value, nil
+	}
+
+	value, err := cs.extract(r)
+	if err == nil && value == "" {
+		err = http.ErrNoCookie
+	}
+
+	return value, err
+}
+
+// codecs returns the codecs for the current keys, newest first.
+func (cs *cookieStore) codecs() ([]securecookie.Codec, error) {
+	if cs.keys != nil {
+		return cs.keys.get()
+	}
+
+	return cs.sc, nil
+}
+
+// timestamp returns the timestamp of a securecookie value authenticated by one
+// of the codecs sc.
+func (cs *cookieStore) timestamp(sc []securecookie.Codec, value string) (time.Time, bool) {
+	// Only securecookie values are timestamped.
+	if _, ok := sc[0].(*securecookie.SecureCookie); !ok {
+		return time.Time{}, false
+	}
+
+	// securecookie values are encoded as base64("timestamp|value|mac").
+	b, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	parts := bytes.SplitN(b, []byte("|"), 3)
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	ts, err := strconv.ParseInt(string(parts[0]), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(ts, 0), true
+}
+
+// clock returns the current time from the store's clock, if set.
+func (cs *cookieStore) clock() time.Time {
+	if cs.now == nil {
+		return time.Now()
+	}
+
+	return cs.now()
+}
+
 // Save stores the CSRF token in the session cookie.
 func (cs *cookieStore) Save(token []byte, w http.ResponseWriter) error {
-	// Generate an encoded cookie value with the CSRF token.
-	encoded, err := cs.sc.Encode(cs.name, token)
+	return cs.save(nil, token, w)
+}
+
+// SaveSession stores the CSRF token in the session cookie, with the attributes
+// for the request r (see SameSiteFunc and DevelopmentMode). It implements
+// SessionStore.
+func (cs *cookieStore) SaveSession(r *http.Request, token []byte, w http.ResponseWriter) error {
+	return cs.save(r, token, w)
+}
+
+// sameSiteFor returns the SameSite attribute of the cookie for the request r.
+func (cs *cookieStore) sameSiteFor(r *http.Request) http.SameSite {
+	if cs.sameSiteFn != nil && r != nil {
+		return cs.sameSiteFn(r)
+	}
+
+	return http.SameSite(cs.sameSite)
+}
+
+// scope returns the cookie name and path for the request r (which may be nil).
+// With PathScoped, each top-level path segment beneath the cookie path - e.g.
+// "/admin" - has its own cookie, named for the segment and limited to its path.
+// The name is part of the authenticated value, so a cookie from one section
+// cannot be replayed under the name of another. Segments that are not valid in a
+// cookie name are hashed, and their cookie keeps the cookie path.
+func (cs *cookieStore) scope(r *http.Request) (name, path string) {
+	if !cs.scoped || r == nil {
+		return cs.name, cs.path
+	}
+
+	base := strings.TrimSuffix(cs.path, "/")
+	rest, ok := strings.CutPrefix(r.URL.EscapedPath(), base+"/")
+	section, _, _ := strings.Cut(rest, "/")
+	switch {
+	case !ok || section == "":
+		return cs.name, cs.path
+	case isToken(section):
+		return cs.name + "." + section, base + "/" + section
+	}
+
+	sum := sha256.Sum256([]byte(section))
+	return cs.name + "." + hex.EncodeToString(sum[:8]), cs.path
+}
+
+// secureFor returns the Secure attribute of a cookie for the request r with the
+// given SameSite attribute. Browsers reject SameSite=None cookies that are not
+// Secure, so these are always Secure.
+func (cs *cookieStore) secureFor(r *http.Request, sameSite http.SameSite) bool {
+	if cs.dev && sameSite != http.SameSiteNoneMode && isLoopbackRequest(r) {
+		return false
+	}
+
+	return cs.secure
+}
+
+// save writes the session cookie for the token, with the attributes for the
+// request r (which may be nil).
+func (cs *cookieStore) save(r *http.Request, token []byte, w http.ResponseWriter) error {
+	sc, err := cs.codecs()
+	if err != nil {
+		return err
+	}
+
+	if cs.compress {
+		if token, err = compressToken(token); err != nil {
+			return err
+		}
+	}
+
+	// Generate an encoded cookie value with the CSRF token, signed with the
+	// newest key.
+	name, path := cs.scope(r)
+	encoded, err := securecookie.EncodeMulti(name, token, sc...)
 	if err != nil {
 		return err
 	}
 
+	sameSite := cs.sameSiteFor(r)
 	cookie := &http.Cookie{
-		Name:     cs.name,
-		Value:    encoded,
-		MaxAge:   cs.maxAge,
-		HttpOnly: cs.httpOnly,
-		Secure:   cs.secure,
-		Path:     cs.path,
-		Domain:   cs.domain,
+		Name:        name,
+		Value:       encoded,
+		MaxAge:      cs.maxAge,
+		HttpOnly:    cs.httpOnly,
+		Secure:      cs.secureFor(r, sameSite),
+		Path:        path,
+		Domain:      cs.domain,
+		SameSite:    sameSite,
+		Partitioned: cs.partitioned,
 	}
 
 	// Set the Expires field on the cookie based on the MaxAge
 	if cs.maxAge > 0 {
-		cookie.Expires = time.Now().Add(
+		cookie.Expires = cs.clock().Add(
 			time.Duration(cs.maxAge) * time.Second)
 	} else {
 		cookie.Expires = time.Unix(1, 0)
 	}
 
+	// Browsers drop oversized cookies, leaving every request to fail validation.
+	if n := len(cookie.String()); n > maxCookieLength {
+		return fmt.Errorf("%w (%d bytes)", ErrCookieTooLong, n)
+	}
+
 	// Write the authenticated cookie to the response.
-	http.SetCookie(w, cookie)
+	cs.setCookie(w, cookie)
+
+	return nil
+}
+
+// setCookie writes the cookie to the response, with the store's cookie writer
+// if set.
+func (cs *cookieStore) setCookie(w http.ResponseWriter, c *http.Cookie) {
+	if cs.write != nil {
+		cs.write(w, c)
+		return
+	}
+
+	http.SetCookie(w, c)
+}
+
+// compressToken returns the token compressed with flate, after the
+// compressedPrefix.
+func compressToken(token []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(compressedPrefix)
+
+	fw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fw.Write(token); err != nil {
+		return nil, err
+	}
+
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompressToken returns the token in a decoded cookie value. Values without
+// the compressedPrefix - written without compression - and values that fail to
+// decompress are returned as is.
+func decompressToken(value []byte) []byte {
+	if !bytes.HasPrefix(value, compressedPrefix) {
+		return value
+	}
+
+	fr := flate.NewReader(bytes.NewReader(value[len(compressedPrefix):]))
+	defer fr.Close()
+
+	// A token cannot be longer than the cookie that carried it.
+	token, err := io.ReadAll(io.LimitReader(fr, maxCookieLength))
+	if err != nil {
+		return value
+	}
+
+	return token
+}
+
+// plainCodec is a securecookie.Codec that encodes tokens as unsigned base64, for
+// double-submit cookies.
+type plainCodec struct{}
+
+// Encode encodes the token ([]byte) value.
+func (plainCodec) Encode(name string, value interface{}) (string, error) {
+	token, ok := value.([]byte)
+	if !ok {
+		return "", fmt.Errorf("cannot encode %T as a token", value)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// Decode decodes the token into dst, which must be a *[]byte.
+func (plainCodec) Decode(name, value string, dst interface{}) error {
+	token, ok := dst.(*[]byte)
+	if !ok {
+		return fmt.Errorf("cannot decode a token into %T", dst)
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+
+	*token = decoded
+	return nil
+}
+
+// Clear expires the session cookie, using the same name, path and domain so that
+// browsers drop it immediately.
+func (cs *cookieStore) Clear(r *http.Request, w http.ResponseWriter) error {
+	name, path := cs.scope(r)
+	sameSite := cs.sameSiteFor(r)
+	cs.setCookie(w, &http.Cookie{
+		Name:        name,
+		Value:       "",
+		MaxAge:      -1,
+		Expires:     time.Unix(1, 0),
+		HttpOnly:    cs.httpOnly,
+		Secure:      cs.secureFor(r, sameSite),
+		Path:        path,
+		Domain:      cs.domain,
+		SameSite:    sameSite,
+		Partitioned: cs.partitioned,
+	})
 
 	return nil
 }
@@ -1,25 +1,34 @@
 package csrf
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"github.com/zenazn/goji/web"
 )
 
 // Check Store implementations
-var _ store = &cookieStore{}
+var _ ClearStore = &cookieStore{}
+var _ SessionStore = &cookieStore{}
+var _ Store = &memoryStore{}
 
 // brokenSaveStore is a CSRF store that cannot, well, save.
 type brokenSaveStore struct {
-	store
+	Store
 }
 
-func (bs *brokenSaveStore) Get(*web.C, *http.Request) ([]byte, error) {
+func (bs *brokenSaveStore) Get(*http.Request) ([]byte, error) {
 	// Generate an invalid token so we can progress to our Save method
 	return generateRandomBytes(24)
 }
@@ -28,11 +37,94 @@ func (bs *brokenSaveStore) Save(realToken []byte, w http.ResponseWriter) error {
 	return errors.New("test error")
 }
 
+// memoryStore is an example of a custom (server-side) Store, keyed on a random
+// session ID issued to the client in a cookie.
+type memoryStore struct {
+	mu     sync.Mutex
+	tokens map[string][]byte
+}
+
+func (ms *memoryStore) Get(r *http.Request) ([]byte, error) {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	token, ok := ms.tokens[cookie.Value]
+	if !ok {
+		return nil, errors.New("token not found")
+	}
+
+	return token, nil
+}
+
+func (ms *memoryStore) Save(token []byte, w http.ResponseWriter) error {
+	id, err := generateRandomBytes(32)
+	if err != nil {
+		return err
+	}
+	key := hex.EncodeToString(id)
+
+	ms.mu.Lock()
+	ms.tokens[key] = token
+	ms.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: "session", Value: key})
+	return nil
+}
+
+// TestSetStore tests that a custom store is used to persist and validate tokens.
+func TestSetStore(t *testing.T) {
+	s := web.New()
+	ms := &memoryStore{tokens: make(map[string][]byte)}
+	s.Use(Protect(testKey, SetStore(ms)))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if len(ms.tokens) != 1 {
+		t.Fatalf("custom store not used: got %d tokens want %d", len(ms.tokens), 1)
+	}
+
+	if c := rr.Header().Get("Set-Cookie"); !strings.HasPrefix(c, "session=") {
+		t.Fatalf("custom store did not issue its cookie: got %q", c)
+	}
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("custom store failed to validate the token: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+}
+
 // Tests for failure if the middleware can't save to the Store.
 func TestStoreCannotSave(t *testing.T) {
 	s := web.New()
 	bs := &brokenSaveStore{}
-	s.Use(Protect(testKey, setStore(bs)))
+	s.Use(Protect(testKey, SetStore(bs)))
 	s.Get("/", testHandler)
 
 	r, err := http.NewRequest("GET", "/", nil)
@@ -67,12 +159,18 @@ func TestCookieDecode(t *testing.T) {
 	// Test with a nil hash key
 	sc := securecookie.New(nil, nil)
 	sc.MaxAge(age)
-	st := &cookieStore{cookieName, age, true, true, "", "", sc}
+	st := &cookieStore{
+		name:     cookieName,
+		maxAge:   age,
+		secure:   true,
+		httpOnly: true,
+		sc:       []securecookie.Codec{sc},
+	}
 
 	// Set a fake cookie value so r.Cookie passes.
 	r.Header.Set("Cookie", fmt.Sprintf("%s=%s", cookieName, "notacookie"))
 
-	_, err = st.Get(&web.C{}, r)
+	_, err = st.Get(r)
 	if err == nil {
 		t.Fatal("cookiestore did not report an invalid hashkey on decode")
 	}
@@ -85,7 +183,13 @@ func TestCookieEncode(t *testing.T) {
 	// Test with a nil hash key
 	sc := securecookie.New(nil, nil)
 	sc.MaxAge(age)
-	st := &cookieStore{cookieName, age, true, true, "", "", sc}
+	st := &cookieStore{
+		name:     cookieName,
+		maxAge:   age,
+		secure:   true,
+		httpOnly: true,
+		sc:       []securecookie.Codec{sc},
+	}
 
 	rr := httptest.NewRecorder()
 
@@ -94,3 +198,558 @@ func TestCookieEncode(t *testing.T) {
 		t.Fatal("cookiestore did not report an invalid hashkey on encode")
 	}
 }
+
+// TestCookieSameSite tests that the cookie is issued with the SameSite
+// attribute.
+func TestCookieSameSite(t *testing.T) {
+	var sameSiteTests = []struct {
+		opts     []Option
+		expected string
+	}{
+		{nil, "SameSite=Lax"},
+		{[]Option{SameSite(SameSiteStrictMode)}, "SameSite=Strict"},
+		{[]Option{SameSite(SameSiteNoneMode)}, "SameSite=None"},
+	}
+
+	for _, sameSite := range sameSiteTests {
+		s := web.New()
+		s.Use(Protect(testKey, sameSite.opts...))
+		s.Get("/", testHandler)
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		if c := rr.Header().Get("Set-Cookie"); !strings.Contains(c, sameSite.expected) {
+			t.Fatalf("cookie SameSite attribute not set: got %q want %q",
+				c, sameSite.expected)
+		}
+	}
+}
+
+// TestCookiePrefixName tests that the cookie prefix is prepended to the cookie
+// name written by the store.
+func TestCookiePrefixName(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, CookiePrefix(HostPrefix), CookieName("csrf")))
+	s.Get("/", testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	c := rr.Header().Get("Set-Cookie")
+	if !strings.HasPrefix(c, "__Host-csrf=") {
+		t.Fatalf("cookie name not prefixed: got %q want prefix %q", c, "__Host-csrf=")
+	}
+
+	if !strings.Contains(c, "Path=/;") {
+		t.Fatalf("cookie path not set: got %q want %q", c, "Path=/")
+	}
+}
+
+// TestRotationKeys tests that cookies signed with a previous key validate after
+// the key is rotated, and that new cookies are signed with the current key.
+func TestRotationKeys(t *testing.T) {
+	oldKey := []byte("an-old-key-we-are-rotating-out--")
+
+	newMux := func(key []byte, opts ...Option) (*web.Mux, *string) {
+		s := web.New()
+		s.Use(Protect(key, opts...))
+
+		token := new(string)
+		s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			*token = Token(c, r)
+		}))
+
+		return s, token
+	}
+
+	// post submits the cookie from rr and token to s, returning the status.
+	post := func(s *web.Mux, rr *httptest.ResponseRecorder, token string) int {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+		return resp.Code
+	}
+
+	// Issue a cookie signed with the old key.
+	old, oldToken := newMux(oldKey)
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldRR := httptest.NewRecorder()
+	old.ServeHTTP(oldRR, r)
+
+	rotated, rotatedToken := newMux(testKey, RotationKeys([][]byte{oldKey}))
+	if code := post(rotated, oldRR, *oldToken); code != http.StatusOK {
+		t.Fatalf("cookie signed with a rotated key failed validation: got %v want %v",
+			code, http.StatusOK)
+	}
+
+	unrotated, _ := newMux(testKey)
+	if code := post(unrotated, oldRR, *oldToken); code != http.StatusForbidden {
+		t.Fatalf("cookie signed with an unknown key passed validation: got %v want %v",
+			code, http.StatusForbidden)
+	}
+
+	// New cookies should be signed with the current key only.
+	rr := httptest.NewRecorder()
+	rotated.ServeHTTP(rr, r)
+
+	if code := post(unrotated, rr, *rotatedToken); code != http.StatusOK {
+		t.Fatalf("new cookie not signed with the current key: got %v want %v",
+			code, http.StatusOK)
+	}
+}
+
+// TestCookiePartitioned tests that the Partitioned attribute is set on the
+// cookie.
+func TestCookiePartitioned(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, SameSite(SameSiteNoneMode), Partitioned(true)))
+	s.Get("/", testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if c := rr.Header().Get("Set-Cookie"); !strings.Contains(c, "Partitioned") {
+		t.Fatalf("cookie Partitioned attribute not set: got %q", c)
+	}
+}
+
+// TestCookieTooLong tests that an oversized cookie is rejected with
+// ErrCookieTooLong, and that the middleware surfaces it as the failure reason.
+func TestCookieTooLong(t *testing.T) {
+	var reason error
+	s := web.New()
+	s.Use(Protect(testKey, TokenLength(4096), ErrorHandler(web.HandlerFunc(
+		func(c web.C, w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(c, r)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))))
+	s.Get("/", testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if !errors.Is(reason, ErrCookieTooLong) {
+		t.Fatalf("failure reason incorrect: got %v want %v", reason, ErrCookieTooLong)
+	}
+
+	if cookie := rr.Header().Get("Set-Cookie"); cookie != "" {
+		t.Fatalf("oversized cookie was set: got %d bytes", len(cookie))
+	}
+}
+
+// TestMode tests that the double-submit mode stores the plain token in the
+// cookie, and that only the double-submit mode accepts a cookie set without the
+// auth key.
+func TestMode(t *testing.T) {
+	forged := bytes.Repeat([]byte("f"), tokenLength)
+	forgedCookie := "_goji_csrf=" + base64.RawURLEncoding.EncodeToString(forged)
+	forgedToken := (&csrf{rand: rand.Reader}).mask(forged)
+
+	var modeTests = []struct {
+		mode   TokenMode
+		forged int
+	}{
+		{ModeSynchronizer, http.StatusForbidden},
+		{ModeDoubleSubmit, http.StatusOK},
+	}
+
+	for _, mt := range modeTests {
+		s := web.New()
+		s.Use(Protect(testKey, Mode(mt.mode)))
+
+		var token string
+		var realToken []byte
+		s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+			token = Token(c, r)
+			realToken, _ = RealToken(c)
+		}))
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		value := strings.TrimPrefix(strings.Split(rr.Header().Get("Set-Cookie"), ";")[0], "_goji_csrf=")
+		plain := value == base64.RawURLEncoding.EncodeToString(realToken)
+		if plain != (mt.mode == ModeDoubleSubmit) {
+			t.Fatalf("mode %d: cookie holds the plain token: got %v want %v",
+				mt.mode, plain, mt.mode == ModeDoubleSubmit)
+		}
+
+		// Submit the issued token.
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("mode %d: issued token failed validation: got %v want %v",
+				mt.mode, resp.Code, http.StatusOK)
+		}
+
+		// Submit a token matching a cookie that was not issued by the middleware.
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Cookie", forgedCookie)
+		r.Header.Set("X-CSRF-Token", forgedToken)
+
+		resp = httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != mt.forged {
+			t.Fatalf("mode %d: forged cookie returned the wrong status: got %v want %v",
+				mt.mode, resp.Code, mt.forged)
+		}
+	}
+}
+
+// TestClear tests that Clear expires the cookie with the configured name, path
+// and domain.
+func TestClear(t *testing.T) {
+	s := web.New()
+	s.Use(Protect(testKey, CookieName("session_csrf"), Path("/forms/"), Domain("goji.io")))
+
+	var clearErr error
+	s.Get("/forms/", testHandler)
+	s.Get("/forms/logout", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		clearErr = Clear(c, w)
+	}))
+
+	r, err := http.NewRequest("GET", "https://goji.io/forms/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	r, err = http.NewRequest("GET", "https://goji.io/forms/logout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if clearErr != nil {
+		t.Fatal(clearErr)
+	}
+
+	cookies := (&http.Response{Header: rr.Header()}).Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Clear did not write a single cookie: got %d", len(cookies))
+	}
+
+	c := cookies[0]
+	if c.Name != "session_csrf" || c.Value != "" || c.MaxAge != -1 ||
+		c.Path != "/forms/" || c.Domain != "goji.io" || !c.Secure || !c.HttpOnly {
+		t.Fatalf("cookie not expired correctly: got %q", rr.Header().Get("Set-Cookie"))
+	}
+
+	if err := Clear(web.C{}, httptest.NewRecorder()); err == nil {
+		t.Fatal("Clear did not return an error without the middleware")
+	}
+}
+
+// TestCookieExpiryClock tests that cookies older than the MaxAge - measured by
+// the middleware's clock - are rejected, without waiting in real time.
+func TestCookieExpiryClock(t *testing.T) {
+	clock := time.Now()
+	s := web.New()
+	s.Use(Protect(testKey, MaxAge(3600), setClock(func() time.Time { return clock })))
+
+	var token string
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		token = Token(c, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	for _, ct := range []struct {
+		advance  time.Duration
+		expected int
+	}{
+		// Timestamps have a resolution of one second.
+		{59 * time.Minute, http.StatusOK},
+		{2 * time.Minute, http.StatusForbidden},
+	} {
+		clock = clock.Add(ct.advance)
+
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+
+		if resp.Code != ct.expected {
+			t.Fatalf("token after %v returned the wrong status: got %v want %v",
+				ct.advance, resp.Code, ct.expected)
+		}
+	}
+}
+
+// TestCookieExpires tests that the cookie has both Max-Age and a consistent
+// Expires attribute - computed from the middleware's clock - for clients that
+// only honor Expires.
+func TestCookieExpires(t *testing.T) {
+	clock := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	s := web.New()
+	s.Use(Protect(testKey, MaxAge(3600), setClock(func() time.Time { return clock })))
+	s.Handle("/", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	header := rr.Header().Get("Set-Cookie")
+	for _, attr := range []string{"Max-Age=3600", "Expires=Wed, 01 Jan 2020 13:00:00 GMT"} {
+		if !strings.Contains(header, attr) {
+			t.Fatalf("cookie does not include %q: got %q", attr, header)
+		}
+	}
+}
+
+// TestSameSiteFunc checks that the SameSite attribute of the cookie is set per
+// request by SameSiteFunc.
+func TestSameSiteFunc(t *testing.T) {
+	fn := func(r *http.Request) http.SameSite {
+		if r.URL.Path == "/oauth/callback" {
+			return http.SameSiteNoneMode
+		}
+		return http.SameSiteStrictMode
+	}
+
+	s := web.New()
+	s.Use(Protect(testKey, SameSite(SameSiteLaxMode), SameSiteFunc(fn)))
+	s.Get("/*", testHandler)
+
+	var testTable = []struct {
+		path     string
+		expected http.SameSite
+	}{
+		{"/oauth/callback", http.SameSiteNoneMode},
+		{"/login", http.SameSiteStrictMode},
+	}
+
+	for _, v := range testTable {
+		r, err := http.NewRequest("GET", v.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("%s: cookie not set: got %d cookies want 1", v.path, len(cookies))
+		}
+
+		if cookies[0].SameSite != v.expected {
+			t.Fatalf("%s: bad SameSite: got %v want %v", v.path, cookies[0].SameSite, v.expected)
+		}
+	}
+}
+
+// TestCookieScope tests the cookie name and path for each section of the
+// application with PathScoped.
+func TestCookieScope(t *testing.T) {
+	var scopeTests = []struct {
+		base string
+		path string
+		name string
+		want string
+	}{
+		{"/", "/admin/users", cookieName + ".admin", "/admin"},
+		{"/", "/admin", cookieName + ".admin", "/admin"},
+		{"/", "/", cookieName, "/"},
+		{"", "/shop/", cookieName + ".shop", "/shop"},
+		{"/app", "/app/shop/cart", cookieName + ".shop", "/app/shop"},
+		{"/app", "/app", cookieName, "/app"},
+		{"/app", "/other/shop", cookieName, "/app"},
+		// Segments that are not valid in a cookie name are hashed.
+		{"/", "/a:b/c", cookieName + ".6783a31eabf68ccc", "/"},
+	}
+
+	for _, v := range scopeTests {
+		cs := &cookieStore{name: cookieName, path: v.base, scoped: true}
+		r, err := http.NewRequest("GET", v.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name, path := cs.scope(r); name != v.name || path != v.want {
+			t.Fatalf("scope of %s under %q: got %s (path %q) want %s (path %q)",
+				v.path, v.base, name, path, v.name, v.want)
+		}
+	}
+}
+
+// TestCompressCookie tests that compressed and legacy (uncompressed) cookies are
+// both read by stores with and without compression.
+func TestCompressCookie(t *testing.T) {
+	token, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newStore := func(compress bool) *cookieStore {
+		return &cookieStore{
+			name:     cookieName,
+			maxAge:   3600,
+			compress: compress,
+			sc:       newCodecs([][]byte{testKey}),
+		}
+	}
+
+	var compressTests = []struct {
+		save, get bool
+	}{
+		{true, true},
+		{false, true},
+		{true, false},
+		{false, false},
+	}
+
+	for _, ct := range compressTests {
+		rr := httptest.NewRecorder()
+		if err := newStore(ct.save).Save(token, rr); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setCookie(rr, r)
+
+		got, err := newStore(ct.get).Get(r)
+		if err != nil {
+			t.Fatalf("compressed %v, read with compression %v: %v", ct.save, ct.get, err)
+		}
+
+		if !bytes.Equal(got, token) {
+			t.Fatalf("compressed %v, read with compression %v: token mismatch: got %v want %v",
+				ct.save, ct.get, got, token)
+		}
+	}
+
+	compressed, err := compressToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(compressed, compressedPrefix) || bytes.Equal(compressed, token) {
+		t.Fatalf("token not compressed: got %v", compressed)
+	}
+
+	// Values with the prefix that do not decompress are returned as is.
+	invalid := append(append([]byte(nil), compressedPrefix...), "not flate"...)
+	if got := decompressToken(invalid); !bytes.Equal(got, invalid) {
+		t.Fatalf("invalid compressed value modified: got %v want %v", got, invalid)
+	}
+}
+
+// TestRawCookieWriter tests that a custom writer serializes the cookie, both
+// when it is saved and cleared.
+func TestRawCookieWriter(t *testing.T) {
+	write := func(w http.ResponseWriter, c *http.Cookie) {
+		w.Header().Add("Set-Cookie", c.Name+"="+c.Value+"; Path=/; SameSite=lax")
+	}
+
+	s := web.New()
+	s.Use(Protect(testKey, RawCookieWriter(write)))
+	s.Get("/", testHandler)
+	s.Get("/logout", web.HandlerFunc(func(c web.C, w http.ResponseWriter, r *http.Request) {
+		if err := Clear(c, w); err != nil {
+			t.Fatal(err)
+		}
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	c := rr.Header().Get("Set-Cookie")
+	value, ok := strings.CutPrefix(c, cookieName+"=")
+	if !ok || !strings.HasSuffix(value, "; Path=/; SameSite=lax") {
+		t.Fatalf("cookie not written by the custom writer: got %q", c)
+	}
+
+	r, err = http.NewRequest("GET", "/logout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCookie(rr, r)
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+
+	if c := rr.Header().Values("Set-Cookie"); len(c) != 1 || c[0] != cookieName+"=; Path=/; SameSite=lax" {
+		t.Fatalf("cleared cookie not written by the custom writer: got %q", c)
+	}
+}